@@ -0,0 +1,430 @@
+/*
+attrib.go- Attribution of tampering to the process (and user)
+responsible. Protected paths are marked with fanotify, which,
+unlike inotify, tells us the PID behind every event. When
+fanotify isn't available we fall back to scanning /proc for
+processes that have the file open for writing.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// fanotify constants (see fanotify_init(2) and fanotify_mark(2))
+const (
+	fanCloexec        = 0x1
+	fanReportDfidName = 0xc00 // FAN_REPORT_DIR_FID | FAN_REPORT_NAME
+	fanMarkAdd        = 0x1
+	fanMarkRemove     = 0x2
+	fanModify         = 0x2
+	fanAttrib         = 0x4
+	fanMovedFrom      = 0x40
+	fanMovedTo        = 0x80
+	fanCreate         = 0x100
+	fanDelete         = 0x200
+	fanQOverflow      = 0x4000
+	fanEventOnChild   = 0x08000000
+	fanOnDir          = 0x40000000
+	fanInfoDfidName   = 2
+	fanInfoDfid       = 3
+	atSymlinkFollow   = 0x400
+	maxHandleSize     = 128
+
+	// Everything that can happen to a protected file, reported on its parent directory
+	attribMask = fanModify | fanAttrib | fanMovedFrom | fanMovedTo | fanCreate | fanDelete | fanEventOnChild | fanOnDir
+)
+
+// AT_FDCWD. This is a var so it can be passed as a uintptr.
+var atFdcwd = -100
+
+// Verbs for each event, in order of precedence
+var attribEvents = []struct {
+	mask uint64
+	verb string
+}{
+	{fanDelete, "Deleted"},
+	{fanMovedFrom, "Moved away"},
+	{fanMovedTo, "Replaced"},
+	{fanCreate, "Created"},
+	{fanModify, "Modified"},
+	{fanAttrib, "Attributes changed"},
+}
+
+// The event header fanotify hands us
+type fanotifyEventMetadata struct {
+	EventLen    uint32
+	Vers        uint8
+	Reserved    uint8
+	MetadataLen uint16
+	Mask        uint64
+	Fd          int32
+	Pid         int32
+}
+
+// The directory handle (and name) following the event header
+type fanotifyEventInfoFid struct {
+	InfoType    uint8
+	Pad         uint8
+	Len         uint16
+	Fsid        [8]byte
+	HandleBytes uint32
+	HandleType  int32
+}
+
+// Who did something to a protected path
+type Attribution struct {
+	Event   string     `json:"event"`
+	Time    time.Time  `json:"time"`
+	Source  string     `json:"source"` // fanotify or proc
+	Process ProcInfo   `json:"process"`
+	Parents []ProcInfo `json:"parents"`
+	Exited  bool       `json:"exited"` // The process was gone before we could look at it
+	rank    int        // Index of the event in attribEvents
+}
+
+// Global attribution object
+var attributor Attributor
+
+type Attributor struct {
+	fd      int
+	enabled int32 // Cleared from the event goroutine as well, so only use it through Enabled
+	lock    sync.Mutex
+	dirs    map[string]string      // Marked directory -> handle key
+	handles map[string]string      // Handle key -> marked directory
+	paths   map[string]bool        // Paths worth recording events for
+	known   map[string]bool        // Directories whose new children are worth recording
+	recent  map[string]Attribution // Last event on each path by someone other than us
+}
+
+// Initialize fanotify and start reading events
+func InitAttribution() {
+	attributor = Attributor{
+		dirs:    map[string]string{},
+		handles: map[string]string{},
+		paths:   map[string]bool{},
+		known:   map[string]bool{},
+		recent:  map[string]Attribution{},
+	}
+	fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT, fanCloexec|fanReportDfidName, uintptr(os.O_RDONLY|syscall.O_LARGEFILE|syscall.O_CLOEXEC), 0)
+	if errno != 0 {
+		Warnf("Could not initialize fanotify (%v). Falling back to /proc for attribution.\n", errno)
+		return
+	}
+	attributor.fd = int(fd)
+	attributor.setEnabled(true)
+	attributor.Sync()
+	go attributor.Start()
+}
+
+// Returns true if fanotify is set up and reading events
+func (a *Attributor) Enabled() bool {
+	return atomic.LoadInt32(&a.enabled) == 1
+}
+
+func (a *Attributor) setEnabled(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&a.enabled, value)
+}
+
+// Get the syscall number of name_to_handle_at, which
+// the syscall package doesn't know about
+func sysNameToHandleAt() uintptr {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 303
+	case "arm64":
+		return 264
+	case "386":
+		return 341
+	case "arm":
+		return 370
+	}
+	return 0
+}
+
+// Build a key that identifies a directory's inode the same way fanotify does
+func handleKey(fsid [8]byte, handleType int32, handle []byte) string {
+	return string(fsid[:]) + fmt.Sprintf("%d:", handleType) + string(handle)
+}
+
+// Get the handle key of a path, so events can be mapped back to it
+func GetHandleKey(path string) (string, bool) {
+	nr := sysNameToHandleAt()
+	if nr == 0 {
+		return "", false
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", false
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return "", false
+	}
+	// struct file_handle: handle_bytes, handle_type, then the handle
+	buf := make([]byte, 8+maxHandleSize)
+	*(*uint32)(unsafe.Pointer(&buf[0])) = maxHandleSize
+	var mountId int32
+	_, _, errno := syscall.Syscall6(nr, uintptr(atFdcwd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&mountId)), atSymlinkFollow, 0)
+	if errno != 0 {
+		return "", false
+	}
+	size := *(*uint32)(unsafe.Pointer(&buf[0]))
+	handleType := *(*int32)(unsafe.Pointer(&buf[4]))
+	return handleKey(*(*[8]byte)(unsafe.Pointer(&st.Fsid)), handleType, buf[8:8+size]), true
+}
+
+// Add or remove a fanotify mark on a directory
+func fanotifyMark(fd int, flags uintptr, path string) bool {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return false
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, uintptr(fd), flags, attribMask, uintptr(atFdcwd), uintptr(unsafe.Pointer(p)), 0)
+	return errno == 0
+}
+
+// Mark the parent directory of every protected path (and every
+// protected directory), the same set of directories the watcher
+// uses. Marks follow the inode, so any directory that has been
+// replaced since it was marked is marked again.
+func (a *Attributor) Sync() {
+	if !a.Enabled() {
+		return
+	}
+	wanted := map[string]bool{}
+	paths := map[string]bool{}
+	known := map[string]bool{}
+	isFreeing.Lock()
+	ForEachObject(func(obj *ServiceObject, label string) {
+		paths[obj.Path] = true
+		wanted[filepath.Dir(obj.Path)] = true
+		if obj.isDir {
+			wanted[obj.Path] = true
+		}
+	})
+	for _, dir := range master.Directories {
+		for path := range dir.known {
+			known[path] = true
+		}
+	}
+	isFreeing.Unlock()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.paths = paths
+	a.known = known
+	for path := range wanted {
+		key, ok := GetHandleKey(path)
+		if !ok || a.dirs[path] == key {
+			continue
+		}
+		if fanotifyMark(a.fd, fanMarkAdd, path) {
+			delete(a.handles, a.dirs[path])
+			a.dirs[path] = key
+			a.handles[key] = path
+		}
+	}
+	for path, key := range a.dirs {
+		if !wanted[path] {
+			fanotifyMark(a.fd, fanMarkRemove, path)
+			delete(a.dirs, path)
+			delete(a.handles, key)
+		}
+	}
+}
+
+// Read fanotify events until the descriptor is closed
+func (a *Attributor) Start() {
+	self := os.Getpid()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(a.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			Errorf("\nFanotify read failed (%v). Falling back to /proc for attribution.\n", err)
+			a.setEnabled(false)
+			return
+		}
+		for offset := 0; offset+int(unsafe.Sizeof(fanotifyEventMetadata{})) <= n; {
+			event := (*fanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if event.EventLen == 0 {
+				break
+			}
+			record := buf[offset+int(event.MetadataLen) : offset+int(event.EventLen)]
+			offset += int(event.EventLen)
+			if event.Fd >= 0 {
+				syscall.Close(int(event.Fd))
+			}
+			// Our own restores aren't interesting
+			if event.Mask&fanQOverflow != 0 || int(event.Pid) == self {
+				continue
+			}
+			path, ok := a.resolve(record)
+			if ok {
+				a.record(path, event.Mask, int(event.Pid))
+			}
+		}
+	}
+}
+
+// Get the path an event happened to from its directory handle and name
+func (a *Attributor) resolve(record []byte) (string, bool) {
+	size := int(unsafe.Sizeof(fanotifyEventInfoFid{}))
+	for len(record) >= size {
+		info := (*fanotifyEventInfoFid)(unsafe.Pointer(&record[0]))
+		if info.Len == 0 || int(info.Len) > len(record) {
+			break
+		}
+		body := record[size:info.Len]
+		record = record[info.Len:]
+		if (info.InfoType != fanInfoDfidName && info.InfoType != fanInfoDfid) || int(info.HandleBytes) > len(body) {
+			continue
+		}
+		key := handleKey(info.Fsid, info.HandleType, body[:info.HandleBytes])
+		a.lock.Lock()
+		dir, ok := a.handles[key]
+		a.lock.Unlock()
+		if !ok {
+			return "", false
+		}
+		name := strings.TrimRight(string(body[info.HandleBytes:]), "\x00")
+		if name == "" || name == "." {
+			return dir, true
+		}
+		return ConcatenatePath(dir, name), true
+	}
+	return "", false
+}
+
+// Look up the process behind an event and remember it, if the
+// path is one we care about. This happens right away, since the
+// process may not be around for much longer.
+func (a *Attributor) record(path string, mask uint64, pid int) {
+	a.lock.Lock()
+	interesting := a.paths[path] || a.known[filepath.Dir(path)]
+	a.lock.Unlock()
+	if !interesting {
+		return
+	}
+	attr := Attribution{
+		Event:  "Changed",
+		Time:   time.Now(),
+		Source: "fanotify",
+		rank:   len(attribEvents),
+	}
+	for i, e := range attribEvents {
+		if mask&e.mask != 0 {
+			attr.Event = e.verb
+			attr.rank = i
+			break
+		}
+	}
+	a.lock.Lock()
+	prev, ok := a.recent[path]
+	a.lock.Unlock()
+	if ok && prev.Process.Pid == pid {
+		// Several events from one process (i.e. touch creating a file,
+		// then setting its times). Keep the most telling one.
+		if prev.rank <= attr.rank {
+			attr.Event = prev.Event
+			attr.rank = prev.rank
+		}
+		// The process may have exited since its first event
+		if !prev.Exited {
+			attr.Process, attr.Parents = prev.Process, prev.Parents
+		}
+	}
+	if attr.Process.Pid == 0 {
+		attr.Process, attr.Exited = LookupProcess(pid)
+		attr.Parents = GetProcChain(attr.Process.Ppid)
+	}
+	a.lock.Lock()
+	a.recent[path] = attr
+	a.lock.Unlock()
+}
+
+// Get the details of a process, keeping the pid if it already exited.
+// A process caught on its way out still has a status (and parent),
+// but no executable or command line.
+func LookupProcess(pid int) (ProcInfo, bool) {
+	info, ok := GetProcInfo(pid)
+	return info, !ok || (info.Exe == "" && info.Cmdline == "")
+}
+
+// Find out who last touched a path. The recorded event is used up
+// so that it isn't blamed for a later change. Without a fanotify
+// event, fall back to anything that has the file open for writing.
+func (a *Attributor) Take(path string) *Attribution {
+	a.lock.Lock()
+	attr, ok := a.recent[path]
+	delete(a.recent, path)
+	a.lock.Unlock()
+	if ok {
+		return &attr
+	}
+	for _, pid := range FindWriters(path) {
+		info, exited := LookupProcess(pid)
+		if exited {
+			continue
+		}
+		return &Attribution{
+			Event:   "Open for writing",
+			Time:    time.Now(),
+			Source:  "proc",
+			Process: info,
+			Parents: GetProcChain(info.Ppid),
+		}
+	}
+	return nil
+}
+
+// Print who was responsible for a change
+func (a *Attribution) Print() {
+	if a.Exited {
+		Errorf("%s by pid %d (already exited)\n", a.Event, a.Process.Pid)
+	} else {
+		Errorf("%s by %s\n", a.Event, a.Process)
+	}
+	for _, parent := range a.Parents {
+		fmt.Printf("  from %s\n", parent)
+	}
+}
+
+// Check if the process behind an attribution is still the one
+// running under its pid, so it can be killed
+func (a *Attribution) Alive() bool {
+	if a.Exited {
+		return false
+	}
+	info, ok := GetProcInfo(a.Process.Pid)
+	return ok && info.Exe == a.Process.Exe && info.Ppid == a.Process.Ppid
+}
+
+// Print the current attribution status
+func (a *Attributor) PrintStatus() {
+	if !a.Enabled() {
+		fmt.Println("Fanotify is unavailable. Attributing changes by scanning /proc.")
+		return
+	}
+	a.lock.Lock()
+	count := len(a.dirs)
+	a.lock.Unlock()
+	fmt.Printf("Attributing changes with fanotify on %d directories.\n", count)
+}
@@ -0,0 +1,392 @@
+/*
+blobs.go- Content addressed backup store. The contents of every
+backup are stored once in the blobs folder, named after their
+hash, and the backup of each path is just a pointer to its blob.
+Identical files (i.e. sshd under both sshd and sshd_backup, or
+the same index.html in every web root) share a single blob on
+disk and a single buffer in memory.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Backups in the backup folder that point at a blob start with this
+const blobPointer = "bandaid-blob:"
+
+// Pointers are tiny, so anything bigger is an old style backup
+// that holds the contents itself
+const maxPointerSize = 512
+
+// Contents shared by every object in memory with the same blob
+type sharedBuffer struct {
+	data []byte
+	refs int
+}
+
+// Index of which store files (backups and generations) point at
+// which blobs, so a blob can be deleted once nothing points at it
+type BlobStore struct {
+	lock    sync.Mutex
+	loaded  bool
+	files   map[string]string        // Store file -> blob key
+	refs    map[string]int           // Blob key -> number of store files pointing at it
+	buffers map[string]*sharedBuffer // Blob key -> buffer shared in memory
+}
+
+var blobs BlobStore = BlobStore{buffers: map[string]*sharedBuffer{}}
+
+// Pairs a decrypting reader with the file under it
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Get the folder blobs are kept in
+func BlobFolder() string {
+	return ConcatenatePath(config.backupLocation, "blobs")
+}
+
+// Get the path of a blob
+func BlobPath(key string) string {
+	return ConcatenatePath(BlobFolder(), key)
+}
+
+// Get the key some contents are stored under. With encryption on this
+// is an HMAC, so blob names don't give away the hashes of our files.
+func BlobKey(contents []byte) string {
+	if !config.doEncryption {
+		sha := sha256.Sum256(contents)
+		return hex.EncodeToString(sha[:])
+	}
+	mac := hmac.New(sha256.New, config.key)
+	mac.Write(contents)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get the blob a backup in the backup folder points at, if it's a pointer
+func readPointer(file string) (string, bool) {
+	stat, err := os.Lstat(file)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() > maxPointerSize {
+		return "", false
+	}
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false
+	}
+	if config.doEncryption {
+		contents = decrypt(contents, config.key)
+	}
+	str := string(contents)
+	if !strings.HasPrefix(str, blobPointer) {
+		return "", false
+	}
+	key := strings.TrimPrefix(str, blobPointer)
+	if _, err := hex.DecodeString(key); err != nil || len(key) != sha256.Size*2 {
+		return "", false
+	}
+	return key, true
+}
+
+// Build the index from the backup folder. The caller must hold b.lock.
+func (b *BlobStore) load() {
+	if b.loaded {
+		return
+	}
+	b.loaded = true
+	b.files = map[string]string{}
+	b.refs = map[string]int{}
+	items, _ := ioutil.ReadDir(config.backupLocation)
+	for _, item := range items {
+		file := ConcatenatePath(config.backupLocation, item.Name())
+		if key, ok := readPointer(file); ok {
+			b.set(file, key)
+		}
+	}
+	// Past generations hold on to their blobs too
+	history := ConcatenatePath(config.backupLocation, "history")
+	folders, _ := ioutil.ReadDir(history)
+	for _, folder := range folders {
+		dir := ConcatenatePath(history, folder.Name())
+		gens, _ := ioutil.ReadDir(dir)
+		for _, item := range gens {
+			if !strings.HasSuffix(item.Name(), ".json") {
+				continue
+			}
+			file := ConcatenatePath(dir, item.Name())
+			contents, ok := readHistoryFile(file)
+			if !ok {
+				continue
+			}
+			var gen Generation
+			if json.Unmarshal(contents, &gen) == nil && gen.Blob != "" {
+				b.set(file, gen.Blob)
+			}
+		}
+	}
+}
+
+// Point a store file at a blob (or at nothing, if key is empty), and
+// delete the blob it pointed at before if that was the last reference.
+// The caller must hold b.lock.
+func (b *BlobStore) set(file string, key string) {
+	old := b.files[file]
+	if old == key {
+		return
+	}
+	if key == "" {
+		delete(b.files, file)
+	} else {
+		b.files[file] = key
+		b.refs[key]++
+	}
+	if old == "" {
+		return
+	}
+	b.refs[old]--
+	if b.refs[old] <= 0 {
+		delete(b.refs, old)
+		os.Remove(BlobPath(old))
+	}
+}
+
+// Make sure a blob is on disk and record that a store file points at it.
+// The store file should be written after this, so a pointer never
+// exists without its blob.
+func (b *BlobStore) Ref(file string, key string, contents []byte) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.load()
+	path := BlobPath(key)
+	if !FileExists(path) {
+		if err := os.MkdirAll(BlobFolder(), 0700); err != nil {
+			return false
+		}
+		if config.doEncryption {
+			contents = encrypt(contents, config.key)
+		}
+		if !WriteFileAtomic(path, contents, 0600, os.Getuid(), os.Getgid(), nil) {
+			return false
+		}
+	}
+	b.set(file, key)
+	return true
+}
+
+// Copy a reader into the blob store without holding it in memory. The
+// blob is written to a temp file as it's hashed, then moved into place
+// under its key (or dropped, if that blob already exists). Returns the
+// key, the SHA-256 checksum of the contents and their size. Nothing
+// points at the blob until Ref is called.
+func (b *BlobStore) WriteStream(r io.Reader) (string, string, int64, error) {
+	if err := os.MkdirAll(BlobFolder(), 0700); err != nil {
+		return "", "", 0, err
+	}
+	tmp, err := ioutil.TempFile(BlobFolder(), ".stream-")
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	// Without encryption the key is the checksum, so it's only hashed once
+	checksum := sha256.New()
+	keyHash := checksum
+	var w io.Writer = io.MultiWriter(tmp, checksum)
+	if config.doEncryption {
+		keyHash = hmac.New(sha256.New, config.key)
+		encrypted, err := EncryptWriter(tmp, config.key)
+		if err != nil {
+			tmp.Close()
+			return "", "", 0, err
+		}
+		w = io.MultiWriter(encrypted, checksum, keyHash)
+	}
+	size, err := io.Copy(w, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return "", "", 0, err
+	}
+	key := hex.EncodeToString(keyHash.Sum(nil))
+	sum := key
+	if config.doEncryption {
+		sum = hex.EncodeToString(checksum.Sum(nil))
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !FileExists(BlobPath(key)) {
+		if err := os.Rename(tmp.Name(), BlobPath(key)); err != nil {
+			return "", "", 0, err
+		}
+	}
+	return key, sum, size, nil
+}
+
+// Get the size of the contents ReadState would read from path, without
+// reading them. Backups in the backup folder are measured by their blob.
+func StoredSize(path string, stat os.FileInfo, doEncrypt bool) int64 {
+	if !doEncrypt {
+		return stat.Size()
+	}
+	key, ok := readPointer(path)
+	if !ok {
+		return stat.Size()
+	}
+	blob, err := os.Stat(BlobPath(key))
+	if err != nil {
+		return stat.Size()
+	}
+	if config.doEncryption {
+		// Less the IV
+		return blob.Size() - aes.BlockSize
+	}
+	return blob.Size()
+}
+
+// Record that a store file was removed
+func (b *BlobStore) Unref(file string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.load()
+	b.set(file, "")
+}
+
+// Open a blob for reading
+func (b *BlobStore) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(BlobPath(key))
+	if err != nil {
+		return nil, err
+	}
+	if !config.doEncryption {
+		return f, nil
+	}
+	r, err := DecryptReader(f, config.key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{r, f}, nil
+}
+
+// Get the buffer shared by every object with this blob, using data
+// if there isn't one yet
+func (b *BlobStore) Share(key string, data []byte) []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	buf, ok := b.buffers[key]
+	if !ok {
+		buf = &sharedBuffer{data: data}
+		b.buffers[key] = buf
+	}
+	buf.refs++
+	return buf.data
+}
+
+// Let go of a shared buffer, freeing it once nobody is using it
+func (b *BlobStore) Release(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	buf, ok := b.buffers[key]
+	if !ok {
+		return
+	}
+	buf.refs--
+	if buf.refs <= 0 {
+		delete(b.buffers, key)
+	}
+}
+
+// Get the number and total size of the buffers in memory
+func (b *BlobStore) BufferStats() (int, int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var size int64
+	for _, buf := range b.buffers {
+		size += int64(len(buf.data))
+	}
+	return len(b.buffers), size
+}
+
+// Get the number and total size of the blobs on disk
+func (b *BlobStore) DiskStats() (int, int64) {
+	items, _ := ioutil.ReadDir(BlobFolder())
+	var size int64
+	for _, item := range items {
+		size += item.Size()
+	}
+	return len(items), size
+}
+
+// Open a backup in the backup folder, following it to its blob if it's a pointer
+func OpenStored(file string) (io.ReadCloser, error) {
+	if key, ok := readPointer(file); ok {
+		return blobs.Open(key)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	if !config.doEncryption {
+		return f, nil
+	}
+	r, err := DecryptReader(f, config.key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{r, f}, nil
+}
+
+// Point an object's backup at the shared buffer for its contents
+func (a *ServiceObject) setBackup(contents []byte) {
+	a.releaseBuffer()
+	a.blob = BlobKey(contents)
+	a.Backup = blobs.Share(a.blob, contents)
+	a.buffered = true
+}
+
+// Let go of an object's shared buffer
+func (a *ServiceObject) releaseBuffer() {
+	if a.buffered {
+		blobs.Release(a.blob)
+		a.buffered = false
+	}
+	a.Backup = nil
+}
+
+// Write the pointer to an object's blob (and the blob, if it's new)
+func (a *ServiceObject) writePointer(file string) bool {
+	if !blobs.Ref(file, a.blob, a.Backup) {
+		return false
+	}
+	contents := []byte(blobPointer + a.blob)
+	if config.doEncryption {
+		contents = encrypt(contents, config.key)
+	}
+	// The pointer carries the file's permisssions and attributes, same as the old backups did
+	return WriteFileAtomic(file, contents, a.Mode, a.Owner, a.Group, a.xattrs)
+}
+
+// Check if another object protects the same path (i.e. sshd and
+// sshd_backup both protect /usr/sbin/sshd). The caller must hold isFreeing.
+func (a *ServiceObject) PathInUse() bool {
+	inUse := false
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if obj != a && obj.Path == a.Path {
+			inUse = true
+		}
+	})
+	return inUse
+}
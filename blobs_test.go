@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Use a fresh backup folder and blob index for a test. Returns a
+// folder for the files being protected.
+func tempBackupFolder(t *testing.T) string {
+	t.Helper()
+	resetSettings()
+	dir, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.backupLocation = filepath.Join(dir, ".bandaid")
+	os.MkdirAll(config.backupLocation, 0700)
+	os.MkdirAll(filepath.Join(dir, "files"), 0755)
+	blobs = BlobStore{buffers: map[string]*sharedBuffer{}}
+	t.Cleanup(func() {
+		blobs = BlobStore{buffers: map[string]*sharedBuffer{}}
+		os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "files")
+}
+
+func TestSharedBlobSurvivesFree(t *testing.T) {
+	for _, lowMemory := range []bool{false, true} {
+		name := "in memory"
+		if lowMemory {
+			name = "low memory"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := tempBackupFolder(t)
+			config.lowMemory = lowMemory
+			config.memThreshold = 1
+			contents := []byte("the same contents in two places\n")
+			a := &ServiceObject{Name: "a", Path: filepath.Join(dir, "a")}
+			b := &ServiceObject{Name: "b", Path: filepath.Join(dir, "b")}
+			for _, obj := range []*ServiceObject{a, b} {
+				if err := ioutil.WriteFile(obj.Path, contents, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if !obj.InitSO() {
+					t.Fatalf("couldn't initialize %s", obj.Name)
+				}
+				obj.InitBackup()
+			}
+			if a.blob == "" || a.blob != b.blob {
+				t.Fatalf("a and b don't share a blob (%q, %q)", a.blob, b.blob)
+			}
+			blob := BlobPath(a.blob)
+			if count, _ := blobs.DiskStats(); count != 1 {
+				t.Fatalf("%d blobs on disk, want 1", count)
+			}
+			if !lowMemory && &a.Backup[0] != &b.Backup[0] {
+				t.Errorf("a and b don't share a buffer")
+			}
+
+			isFreeing.Lock()
+			a.FreeBackup()
+			isFreeing.Unlock()
+			if FileExists(GetConfigName(a.Path)) {
+				t.Errorf("a's backup is still there")
+			}
+			if !FileExists(blob) {
+				t.Fatalf("the blob was deleted while b still points at it")
+			}
+			if got, ok := b.ReadBackup(); !ok || string(got) != string(contents) {
+				t.Errorf("b's backup is %q, want %q", got, contents)
+			}
+			r, err := OpenStored(GetConfigName(b.Path))
+			if err != nil {
+				t.Fatalf("b's backup can't be opened: %v", err)
+			}
+			got, _ := ioutil.ReadAll(r)
+			r.Close()
+			if string(got) != string(contents) {
+				t.Errorf("b's stored backup is %q, want %q", got, contents)
+			}
+			wantBuffers := 1
+			if lowMemory {
+				wantBuffers = 0
+			}
+			if count, _ := blobs.BufferStats(); count != wantBuffers {
+				t.Errorf("%d buffers in memory, want %d", count, wantBuffers)
+			}
+
+			// The index is rebuilt from the backup folder on a restart. b's
+			// backup and both histories still point at the blob.
+			blobs = BlobStore{buffers: map[string]*sharedBuffer{}}
+			isFreeing.Lock()
+			b.FreeBackup()
+			isFreeing.Unlock()
+			if !FileExists(blob) {
+				t.Errorf("the blob was deleted while past generations still point at it")
+			}
+		})
+	}
+}
+
+func TestBlobRefs(t *testing.T) {
+	tempBackupFolder(t)
+	contents := []byte("contents")
+	key := BlobKey(contents)
+	first := ConcatenatePath(config.backupLocation, "first")
+	second := ConcatenatePath(config.backupLocation, "second")
+	for _, file := range []string{first, second} {
+		if !blobs.Ref(file, key, contents) {
+			t.Fatalf("couldn't reference the blob from %s", file)
+		}
+	}
+	// Referencing it again from the same file doesn't count twice
+	blobs.Ref(first, key, contents)
+	blobs.Unref(first)
+	if !FileExists(BlobPath(key)) {
+		t.Fatalf("the blob was deleted with a reference left")
+	}
+	// Pointing a file somewhere else lets go of the old blob
+	other := []byte("other contents")
+	blobs.Ref(second, BlobKey(other), other)
+	if FileExists(BlobPath(key)) {
+		t.Errorf("the blob is still there with no references")
+	}
+	blobs.Unref(second)
+	if count, _ := blobs.DiskStats(); count != 0 {
+		t.Errorf("%d blobs left on disk, want 0", count)
+	}
+	// Unknown files are ignored
+	blobs.Unref(ConcatenatePath(config.backupLocation, "never"))
+}
+
+func TestSharedBuffers(t *testing.T) {
+	tempBackupFolder(t)
+	first := blobs.Share("k", []byte("contents"))
+	second := blobs.Share("k", []byte("contents"))
+	if &first[0] != &second[0] {
+		t.Errorf("the same key got two buffers")
+	}
+	blobs.Release("k")
+	if count, _ := blobs.BufferStats(); count != 1 {
+		t.Errorf("the buffer was freed while it was still shared")
+	}
+	blobs.Release("k")
+	if count, _ := blobs.BufferStats(); count != 0 {
+		t.Errorf("%d buffers left, want 0", count)
+	}
+	// Releasing too often is harmless
+	blobs.Release("k")
+}
+
+func TestLowMemoryStreamsIntoStore(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		name := "plain"
+		if encrypt {
+			name = "encrypted"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := tempBackupFolder(t)
+			config.doEncryption = encrypt
+			config.lowMemory = true
+			config.memThreshold = 16
+			contents := []byte("much more than sixteen bytes of contents\n")
+			a := &ServiceObject{Name: "a", Path: filepath.Join(dir, "a")}
+			if err := ioutil.WriteFile(a.Path, contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if !a.InitSO() {
+				t.Fatalf("couldn't initialize a")
+			}
+			a.InitBackup()
+			// Nothing was ever buffered
+			if !a.streamed || a.Backup != nil {
+				t.Fatalf("a wasn't streamed")
+			}
+			if count, _ := blobs.BufferStats(); count != 0 {
+				t.Errorf("%d buffers in memory, want 0", count)
+			}
+			if a.BackupSize() != int64(len(contents)) {
+				t.Errorf("size is %d, want %d", a.BackupSize(), len(contents))
+			}
+			if sum, _ := a.GetSHA(); a.Checksum != sum {
+				t.Errorf("checksum is %s, want %s", a.Checksum, sum)
+			}
+			if encrypt && a.blob != BlobKey(contents) {
+				t.Errorf("blob key is %s, want %s", a.blob, BlobKey(contents))
+			}
+			if got, ok := a.ReadBackup(); !ok || string(got) != string(contents) {
+				t.Errorf("backup is %q, want %q", got, contents)
+			}
+			r, err := OpenStored(GetConfigName(a.Path))
+			if err != nil {
+				t.Fatalf("the backup can't be opened: %v", err)
+			}
+			got, _ := ioutil.ReadAll(r)
+			r.Close()
+			if string(got) != string(contents) {
+				t.Errorf("stored backup is %q, want %q", got, contents)
+			}
+			// Reading the backup back streams it too
+			b := &ServiceObject{Name: "b", Path: a.Path}
+			if !b.ReadState(GetConfigName(a.Path), true) || !b.streamed || b.blob != a.blob {
+				t.Errorf("the stored backup wasn't streamed back to the same blob")
+			}
+			if count, _ := blobs.DiskStats(); count != 1 {
+				t.Errorf("%d blobs on disk, want 1", count)
+			}
+		})
+	}
+}
@@ -1,86 +1,144 @@
 package main
 
 import (
-	"bytes"
-	"os"
-	"os/exec"
-	"path"
+	"io/fs"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"unsafe"
 )
 
+// Inode flags, as shown by lsattr
 const (
-	chattrCmd = "chattr"
-	lsattrCmd = "lsattr"
+	FS_SECRM_FL        = 0x00000001 // s: secure deletion
+	FS_UNRM_FL         = 0x00000002 // u: undelete
+	FS_COMPR_FL        = 0x00000004 // c: compress
+	FS_SYNC_FL         = 0x00000008 // S: synchronous updates
+	FS_IMMUTABLE_FL    = 0x00000010 // i: immutable
+	FS_APPEND_FL       = 0x00000020 // a: append only
+	FS_NODUMP_FL       = 0x00000040 // d: no dump
+	FS_NOATIME_FL      = 0x00000080 // A: no atime updates
+	FS_JOURNAL_DATA_FL = 0x00004000 // j: data journaling
+	FS_NOTAIL_FL       = 0x00008000 // t: no tail merging
+	FS_DIRSYNC_FL      = 0x00010000 // D: synchronous directory updates
+	FS_TOPDIR_FL       = 0x00020000 // T: top of directory hierarchy
+	FS_EXTENT_FL       = 0x00080000 // e: uses extents
+	FS_NOCOW_FL        = 0x00800000 // C: no copy on write
+	FS_PROJINHERIT_FL  = 0x20000000 // P: project hierarchy
+	FS_CASEFOLD_FL     = 0x40000000 // F: casefolded
 )
 
-// Add the immutable attribute to a file
-func AddImmutable(path string) bool {
-	// Get the path for the chattr
-	chattrBin := which(chattrCmd)
-	// Make sure file exists
-	if _, err := os.Stat(path); err == nil {
-		// Chattr the file
-		cmd := exec.Command(chattrBin, "+i", path)
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		if err = cmd.Run(); err != nil {
-			return false
+// Flags that stop us from rewriting or replacing a file
+const blockingFlags = FS_IMMUTABLE_FL | FS_APPEND_FL
+
+// Flags in the order lsattr prints them
+var flagLetters = []struct {
+	flag   uint32
+	letter byte
+}{
+	{FS_SECRM_FL, 's'},
+	{FS_UNRM_FL, 'u'},
+	{FS_SYNC_FL, 'S'},
+	{FS_DIRSYNC_FL, 'D'},
+	{FS_IMMUTABLE_FL, 'i'},
+	{FS_APPEND_FL, 'a'},
+	{FS_NODUMP_FL, 'd'},
+	{FS_NOATIME_FL, 'A'},
+	{FS_COMPR_FL, 'c'},
+	{FS_JOURNAL_DATA_FL, 'j'},
+	{FS_NOTAIL_FL, 't'},
+	{FS_TOPDIR_FL, 'T'},
+	{FS_EXTENT_FL, 'e'},
+	{FS_NOCOW_FL, 'C'},
+	{FS_CASEFOLD_FL, 'F'},
+	{FS_PROJINHERIT_FL, 'P'},
+}
+
+// Run an inode flag ioctl on a path. Symlinks are never followed,
+// since flags can't be set on a link itself.
+func flagsIoctl(path string, req uintptr, flags *int32) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(flags)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Get the inode flags of a file
+func GetFlags(path string) (uint32, error) {
+	var flags int32
+	err := flagsIoctl(path, fsIocGetFlags, &flags)
+	return uint32(flags), err
+}
+
+// Set the inode flags of a file
+func SetFlags(path string, flags uint32) error {
+	value := int32(flags)
+	return flagsIoctl(path, fsIocSetFlags, &value)
+}
+
+// Format inode flags the same way lsattr does
+func FlagString(flags uint32) string {
+	var str strings.Builder
+	for _, f := range flagLetters {
+		if flags&f.flag != 0 {
+			str.WriteByte(f.letter)
+		} else {
+			str.WriteByte('-')
 		}
 	}
+	return str.String()
+}
 
-	return true
+// Clear any flags that would stop us from writing to a path. Returns
+// the flags that were set beforehand and whether anything was cleared.
+func ClearBlockingFlags(path string) (uint32, bool) {
+	flags, err := GetFlags(path)
+	if err != nil || flags&blockingFlags == 0 {
+		return flags, false
+	}
+	return flags, SetFlags(path, flags&^blockingFlags) == nil
 }
 
-// Remove the immutable attribute from a file
-func RemoveImmutable(path string) bool {
-	chattrBin := which(chattrCmd)
-	if _, err := os.Stat(path); err == nil {
-		cmd := exec.Command(chattrBin, "-i", path)
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		if err = cmd.Run(); err != nil {
-			return false
+// Clear blocking flags on a path and everything below it, so it can be removed
+func UnblockTree(path string) {
+	filepath.WalkDir(path, func(sub string, d fs.DirEntry, err error) error {
+		if err == nil {
+			ClearBlockingFlags(sub)
 		}
+		return nil
+	})
+}
+
+// Add the immutable attribute to a file
+func AddImmutable(path string) bool {
+	flags, err := GetFlags(path)
+	if err != nil {
+		return false
 	}
+	return SetFlags(path, flags|FS_IMMUTABLE_FL) == nil
+}
 
-	return true
+// Remove the immutable attribute from a file
+func RemoveImmutable(path string) bool {
+	flags, err := GetFlags(path)
+	if err != nil {
+		return false
+	}
+	return SetFlags(path, flags&^FS_IMMUTABLE_FL) == nil
 }
 
 // See if a file is immutable or not
 func IsImmutable(path string) bool {
-	lsattrBin := which(lsattrCmd)
-	if _, err := os.Stat(path); err != nil {
-		return true
-	}
-	op, err := exec.Command(lsattrBin, "-d", path).CombinedOutput()
+	flags, err := GetFlags(path)
 	if err != nil {
 		// Cannot get path status, return true so that immutable bit is not reverted
 		return true
 	}
-	// 'lsattr -d' output is a single line with 2 fields separated by space; 1st one
-	// is list of applicable attrs and 2nd field is the path itself.Sample output below.
-	// lsattr -d /mnt/vol2
-	// ----i--------e-- /mnt/vol2
-	attrs := strings.Split(string(op), " ")
-	if len(attrs) != 2 {
-		// Cannot get path status, return true so that immutable bit is not reverted
-		// fmt.Errorf("Invalid lsattr output %v", string(op))
-		return true
-	}
-	if strings.Contains(attrs[0], "i") {
-		// fmt.Println("Path %v already set to immutable", path)
-		return true
-	}
-
-	return false
-}
-
-func which(bin string) string {
-	pathList := []string{"/usr/bin", "/sbin", "/usr/sbin", "/usr/local/bin"}
-	for _, p := range pathList {
-		if _, err := os.Stat(path.Join(p, bin)); err == nil {
-			return path.Join(p, bin)
-		}
-	}
-	return bin
+	return flags&FS_IMMUTABLE_FL != 0
 }
@@ -0,0 +1,13 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le && !ppc && !ppc64 && !ppc64le && !sparc64
+// +build !mips,!mipsle,!mips64,!mips64le,!ppc,!ppc64,!ppc64le,!sparc64
+
+package main
+
+import "unsafe"
+
+// ioctl numbers for reading and writing inode flags (see ioctl_iflags(2)).
+// They're _IOR/_IOW('f', n, long), so the size depends on the word size.
+const (
+	fsIocGetFlags = 2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+	fsIocSetFlags = 1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2
+)
@@ -0,0 +1,13 @@
+//go:build mips || mipsle || mips64 || mips64le || ppc || ppc64 || ppc64le || sparc64
+// +build mips mipsle mips64 mips64le ppc ppc64 ppc64le sparc64
+
+package main
+
+import "unsafe"
+
+// Same as chattr_ioc.go, but these architectures put the read and
+// write bits of an ioctl number in a different place
+const (
+	fsIocGetFlags = 2<<29 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+	fsIocSetFlags = 4<<29 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2
+)
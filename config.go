@@ -4,19 +4,43 @@ import "time"
 
 // Define the config struct
 type Config struct {
-	delay           time.Duration // Delay interval for main checker
-	icmpDelay       time.Duration // Delay interval for ICMP checker
-	configFile      string        // Location of the config file
-	backupLocation  string        // Folder to store the backups in. Default is .bandaid
-	key             []byte        // AES key to be used for encryption
-	outputEnabled   bool
-	loadFromConfig  bool
-	upkeep          bool // Toggle for maintaining of services
-	doBackup        bool
-	checkPerms      bool // Toggle for checking permissions and attributes of files
-	doEncryption    bool
-	ipChairs        bool
-	ipChairsConsole bool // Toggle ipChairsConsole. Used in utils caret() function
+	delay            time.Duration // Delay interval for main checker
+	icmpDelay        time.Duration // Delay interval for ICMP checker
+	configFile       string        // Location of the config file
+	backupLocation   string        // Folder to store the backups in. Default is .bandaid
+	key              []byte        // AES key to be used for encryption
+	outputEnabled    bool
+	loadFromConfig   bool
+	upkeep           bool // Toggle for maintaining of services
+	doBackup         bool
+	checkPerms       bool // Toggle for checking permissions and attributes of files
+	doEncryption     bool
+	ipChairs         bool
+	ipChairsConsole  bool          // Toggle ipChairsConsole. Used in utils caret() function
+	watch            bool          // Toggle inotify watching of protected files
+	safetyDelay      time.Duration // Delay interval for the main checker while inotify is active
+	workers          int           // Max number of files to verify concurrently
+	timing           bool          // Toggle printing a timing report after every sweep
+	rehashEvery      int           // Force a full hash every n checks, even if the stat is unchanged. 0 to never force
+	forensics        bool          // Toggle capturing tampered files before restoring them
+	showDiff         bool          // Toggle printing a diff of tampered files
+	lockdown         bool          // Toggle making protected files immutable after every restore
+	flapThreshold    int           // Number of restores within flapWindow before a file is flapping. 0 to disable
+	flapWindow       time.Duration // Sliding window used to detect flapping
+	flapDelay        time.Duration // Delay interval for checking flapping files (interval action)
+	flapActions      []string      // Escalation actions for flapping files (alert, interval, lock, kill)
+	generations      int           // Default number of past baselines kept for each file
+	lowMemory        bool          // Toggle keeping large backups on disk only
+	memThreshold     int64         // Backups larger than this are dropped from memory in low memory mode
+	priorityPaths    []string      // Files (and folders) checked every priorityDelay ms
+	priorityDelay    time.Duration // Delay interval for priority files
+	jitter           int           // Percent that check intervals are randomized by
+	forensicMaxSize  int64         // Max number of bytes captured from a single tampered file
+	forensicMaxTotal int64         // Max total size of the forensics folder
+	forensicKeep     int           // Max number of samples kept for each path
+	autoReload       bool          // Toggle reloading the config file whenever it changes
+	reloadDelay      time.Duration // How often the config file is checked for changes
+	autoSave         bool          // Toggle saving the config file after every change made from the REPL
 }
 
 // Default config. This can be exported into a .json file and modified as needed.
@@ -0,0 +1,246 @@
+/*
+diff.go- Unified diffs between a file's backup and its
+tampered state, so we can see at a glance what red team
+changed before it gets reverted
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	diffContext  = 3       // Lines of context around each change
+	diffMaxSize  = 1 << 20 // Files larger than this only get a summary
+	diffMaxEdits = 1000    // Give up on the diff past this many changed lines
+)
+
+// A single line in a diff. kind is ' ', '-' or '+'
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// Print what changed between an object's backup and the file on disk
+func PrintDiff(obj *ServiceObject) {
+	if obj.isDir || !FileExists(obj.Path) {
+		return
+	}
+	if obj.isLink || IsLink(obj.Path) {
+		PrintLinkChange(obj)
+		return
+	}
+	f, err := os.Open(obj.Path)
+	if err != nil {
+		return
+	}
+	current, _ := ioutil.ReadAll(io.LimitReader(f, diffMaxSize+1))
+	f.Close()
+	if len(current) > diffMaxSize || obj.BackupSize() > diffMaxSize || !IsText(current) {
+		PrintDiffSummary(obj)
+		return
+	}
+	backup, ok := obj.ReadBackup()
+	if !ok || !IsText(backup) {
+		PrintDiffSummary(obj)
+		return
+	}
+	ops, ok := DiffLines(SplitLines(string(backup)), SplitLines(string(current)))
+	if !ok {
+		Warnf("Too many changes to show a diff.\n")
+		PrintDiffSummary(obj)
+		return
+	}
+	fmt.Print(UnifiedDiff(obj.Path, ops))
+}
+
+// Print a size and checksum comparison for files that can't be diffed
+func PrintDiffSummary(obj *ServiceObject) {
+	var size int64
+	if stat, err := os.Stat(obj.Path); err == nil {
+		size = stat.Size()
+	}
+	sha, _ := obj.GetSHA()
+	fmt.Printf(
+		"Binary file changed:\n  backup:  %d bytes, %s\n  on disk: %d bytes, %s\n",
+		obj.BackupSize(), obj.BackupSHA(),
+		size, sha,
+	)
+}
+
+// Print how a symlink changed, or what replaced it
+func PrintLinkChange(obj *ServiceObject) {
+	before := "regular file"
+	if obj.isLink {
+		before = "symlink to " + obj.Target
+	}
+	after := "regular file"
+	if target, err := os.Readlink(obj.Path); err == nil {
+		after = "symlink to " + target
+	}
+	fmt.Printf("  backup:  %s\n  on disk: %s\n", before, after)
+}
+
+// Split file contents into lines, keeping the newlines
+// so a missing one at the end of the file shows up
+func SplitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Compute the shortest edit script between two sets of lines using
+// Myers' algorithm. Returns false if there are more than
+// diffMaxEdits changes.
+func DiffLines(a, b []string) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds the furthest x for each diagonal k before round d,
+	// for k in [-d-1, d+1]
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > diffMaxEdits {
+			return nil, false
+		}
+		snap := make([]int, 2*d+3)
+		copy(snap, v[off-d-1:off+d+2])
+		trace = append(trace, snap)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	// Walk back through the trace to recover the edits
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snap := trace[d]
+		get := func(k int) int { return snap[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+// Format an edit script as a unified diff with colored output
+func UnifiedDiff(path string, ops []diffOp) string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("--- %s (backup)\n+++ %s (on disk)\n", path, path))
+	// Line numbers in the old and new file before each op
+	aLines := make([]int, len(ops)+1)
+	bLines := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLines[i+1], bLines[i+1] = aLines[i], bLines[i]
+		if op.kind != '+' {
+			aLines[i+1]++
+		}
+		if op.kind != '-' {
+			bLines[i+1]++
+		}
+	}
+	i := 0
+	for i < len(ops) {
+		// Find the next change
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk while the next change is close enough
+		// that the context would overlap
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			} else if j-end > 2*diffContext {
+				break
+			}
+		}
+		end += diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		aStart, aLen := aLines[start]+1, aLines[end]-aLines[start]
+		bStart, bLen := bLines[start]+1, bLines[end]-bLines[start]
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		out.WriteString(fmt.Sprintf("%s@@ -%d,%d +%d,%d @@%s\n", colors.cyan, aStart, aLen, bStart, bLen, colors.reset))
+		for _, op := range ops[start:end] {
+			line := op.line
+			newline := strings.HasSuffix(line, "\n")
+			line = strings.TrimSuffix(line, "\n")
+			switch op.kind {
+			case '-':
+				out.WriteString(colors.red + "-" + line + colors.reset + "\n")
+			case '+':
+				out.WriteString(colors.green + "+" + line + colors.reset + "\n")
+			default:
+				out.WriteString(" " + line + "\n")
+			}
+			if !newline {
+				out.WriteString("\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Number the lines of a file, i.e. "line 1\nline 2\n"
+func numberedLines(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	return b.String()
+}
+
+// Replace line i (counting from 1) of a numbered file
+func replaceLine(s string, i int, line string) string {
+	lines := SplitLines(s)
+	lines[i-1] = line
+	return strings.Join(lines, "")
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		edits int
+	}{
+		{"identical", "a\nb\n", "a\nb\n", 0},
+		{"both empty", "", "", 0},
+		{"empty before", "", "a\nb\n", 2},
+		{"empty after", "a\nb\n", "", 2},
+		{"no newline at end", "a\nb\n", "a\nb", 2},
+		{"all different", "a\nb\nc\n", "x\ny\n", 5},
+		{"one changed", numberedLines(10), replaceLine(numberedLines(10), 5, "five\n"), 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops, ok := DiffLines(SplitLines(test.a), SplitLines(test.b))
+			if !ok {
+				t.Fatalf("DiffLines gave up")
+			}
+			// The script has to turn a into b, and be the shortest one
+			var before, after strings.Builder
+			edits := 0
+			for _, op := range ops {
+				if op.kind != '+' {
+					before.WriteString(op.line)
+				}
+				if op.kind != '-' {
+					after.WriteString(op.line)
+				}
+				if op.kind != ' ' {
+					edits++
+				}
+			}
+			if before.String() != test.a || after.String() != test.b {
+				t.Errorf("script gives %q -> %q, want %q -> %q", before.String(), after.String(), test.a, test.b)
+			}
+			if edits != test.edits {
+				t.Errorf("got %d edits, want %d", edits, test.edits)
+			}
+		})
+	}
+}
+
+func TestDiffLinesMaxEdits(t *testing.T) {
+	var a, b []string
+	for i := 0; i <= diffMaxEdits; i++ {
+		a = append(a, fmt.Sprintf("a%d\n", i))
+		b = append(b, fmt.Sprintf("b%d\n", i))
+	}
+	if _, ok := DiffLines(a, b); ok {
+		t.Errorf("DiffLines should give up past %d edits", diffMaxEdits)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	saved := colors
+	colors = Colors{}
+	defer func() { colors = saved }()
+	header := "--- f (backup)\n+++ f (on disk)\n"
+	twenty := numberedLines(20)
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"identical", "a\n", "a\n", ""},
+		{"empty before", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"empty after", "a\nb\n", "", "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{
+			"no newline at end",
+			"a\nb\n", "a\nb",
+			"@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			"newline added at end",
+			"a", "a\n",
+			"@@ -1,1 +1,1 @@\n-a\n\\ No newline at end of file\n+a\n",
+		},
+		{"all different", "a\nb\n", "c\nd\n", "@@ -1,2 +1,2 @@\n-a\n-b\n+c\n+d\n"},
+		{
+			// Changes 6 lines apart share their context, so they're one hunk
+			"hunks merged",
+			twenty, replaceLine(replaceLine(twenty, 5, "five\n"), 12, "twelve\n"),
+			"@@ -2,14 +2,14 @@\n line 2\n line 3\n line 4\n-line 5\n+five\n line 6\n line 7\n line 8\n" +
+				" line 9\n line 10\n line 11\n-line 12\n+twelve\n line 13\n line 14\n line 15\n",
+		},
+		{
+			// 7 lines apart is too far, so they get a hunk each
+			"hunks split",
+			twenty, replaceLine(replaceLine(twenty, 4, "four\n"), 12, "twelve\n"),
+			"@@ -1,7 +1,7 @@\n line 1\n line 2\n line 3\n-line 4\n+four\n line 5\n line 6\n line 7\n" +
+				"@@ -9,7 +9,7 @@\n line 9\n line 10\n line 11\n-line 12\n+twelve\n line 13\n line 14\n line 15\n",
+		},
+		{
+			// Context is cut off at the end of the file
+			"change at end",
+			numberedLines(5), numberedLines(5) + "line 6\n",
+			"@@ -3,3 +3,4 @@\n line 3\n line 4\n line 5\n+line 6\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops, ok := DiffLines(SplitLines(test.a), SplitLines(test.b))
+			if !ok {
+				t.Fatalf("DiffLines gave up")
+			}
+			got := UnifiedDiff("f", ops)
+			if got != header+test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, header+test.want)
+			}
+		})
+	}
+}
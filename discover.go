@@ -0,0 +1,311 @@
+/*
+discover.go- Generating a starting config for a box. bandaid discover
+looks at the systemd services that are enabled or running, what they
+run and the config they read, along with the files attackers usually
+go after and any web roots, and writes a config.json for review. Like
+validate, it runs without the key or the backup store.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Units that are part of the base system and aren't worth protecting
+var boringUnits []string = []string{
+	"systemd-", "getty@", "serial-getty@", "user@", "user-runtime-dir@", "dbus",
+	"polkit", "e2scrub", "binfmt-support", "console-setup", "keyboard-setup",
+	"plymouth", "lvm2", "udisks2", "ModemManager", "NetworkManager-wait-online",
+	"accounts-daemon", "snapd", "packagekit", "fwupd", "upower", "emergency",
+	"rescue", "kmod", "ifupdown", "networking", "unattended-upgrades",
+}
+
+// Files that are worth protecting on any box
+var criticalFiles []string = []string{
+	"/etc/passwd", "/etc/shadow", "/etc/group", "/etc/gshadow", "/etc/sudoers",
+	"/etc/crontab", "/etc/hosts", "/etc/resolv.conf", "/etc/nsswitch.conf",
+	"/etc/ld.so.preload", "/etc/login.defs", "/root/.ssh/authorized_keys",
+	"/root/.bashrc", "/bin/bash", "/bin/sh", "/usr/bin/sudo", "/bin/su", "/usr/bin/passwd",
+}
+
+// Folders that are worth protecting on any box
+var criticalDirs []string = []string{"/etc/pam.d", "/etc/sudoers.d", "/etc/cron.d", "/etc/profile.d"}
+
+// Files and folders that only exist on some distros, by family
+var distroFiles map[string][]string = map[string][]string{
+	"debian": {"/etc/apt/sources.list", "/etc/network/interfaces", "/etc/default/useradd"},
+	"rhel":   {"/etc/yum.conf", "/etc/dnf/dnf.conf", "/etc/sysconfig/network", "/etc/selinux/config"},
+	"arch":   {"/etc/pacman.conf"},
+	"alpine": {"/etc/apk/repositories", "/etc/network/interfaces"},
+	"suse":   {"/etc/zypp/zypp.conf", "/etc/sysconfig/network/config"},
+}
+var distroDirs map[string][]string = map[string][]string{
+	"debian": {"/var/spool/cron/crontabs", "/etc/apt/sources.list.d"},
+	"rhel":   {"/var/spool/cron", "/etc/yum.repos.d"},
+	"arch":   {"/var/spool/cron"},
+	"alpine": {"/etc/crontabs"},
+	"suse":   {"/var/spool/cron/tabs", "/etc/zypp/repos.d"},
+}
+
+// Default web roots, and the web server configs that can point somewhere else
+var webRoots []string = []string{"/var/www/html", "/usr/share/nginx/html", "/srv/www", "/srv/http", "/var/www/localhost/htdocs"}
+var webConfigs []string = []string{
+	"/etc/apache2/sites-enabled/*", "/etc/apache2/apache2.conf",
+	"/etc/httpd/conf/httpd.conf", "/etc/httpd/conf.d/*.conf",
+	"/etc/nginx/nginx.conf", "/etc/nginx/sites-enabled/*", "/etc/nginx/conf.d/*.conf",
+}
+
+// Work out which family of distro we're on from os-release
+func DistroFamily(release map[string]string) string {
+	ids := strings.Fields(release["ID"] + " " + release["ID_LIKE"])
+	for _, id := range ids {
+		switch id {
+		case "debian", "ubuntu", "kali", "raspbian", "linuxmint":
+			return "debian"
+		case "rhel", "centos", "fedora", "rocky", "almalinux", "ol", "amzn":
+			return "rhel"
+		case "arch", "manjaro":
+			return "arch"
+		case "alpine":
+			return "alpine"
+		case "suse", "opensuse", "sles":
+			return "suse"
+		}
+	}
+	return ""
+}
+
+// Find the web roots set in the web server configs (DocumentRoot for
+// apache, root for nginx)
+func FindWebRoots() []string {
+	var roots []string
+	for _, pattern := range webConfigs {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			f, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+				if len(fields) == 2 && (fields[0] == "DocumentRoot" || fields[0] == "root") {
+					root := filepath.Clean(strings.Trim(fields[1], "\"'"))
+					if filepath.IsAbs(root) && !contains(roots, root) {
+						roots = append(roots, root)
+					}
+				}
+			}
+			f.Close()
+		}
+	}
+	for _, root := range webRoots {
+		if !contains(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// Check if a unit is part of the base system
+func isBoringUnit(name string) bool {
+	for _, prefix := range boringUnits {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Make a name unique among the names that have been used
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", name, i)
+	}
+	used[unique] = true
+	return unique
+}
+
+// Build a config for this box. Anything worth mentioning is written
+// to report.
+func Discover(report func(string, ...interface{})) Services {
+	discovered := Services{Services: []Service{}, Files: []ServiceObject{}, Directories: []Directory{}}
+	names := map[string]bool{}
+	// Every path in other_files, so nothing is listed twice
+	claimed := map[string]bool{}
+	addFile := func(name string, path string) {
+		if claimed[path] || !FileExists(path) || IsDir(path) {
+			return
+		}
+		claimed[path] = true
+		discovered.Files = append(discovered.Files, ServiceObject{Name: uniqueName(name, names), Path: path})
+	}
+	addDir := func(name string, path string, newFiles string) {
+		path = filepath.Clean(path)
+		if !IsDir(path) {
+			return
+		}
+		for _, dir := range discovered.Directories {
+			if dir.Path == path {
+				return
+			}
+		}
+		discovered.Directories = append(discovered.Directories, Directory{Name: uniqueName(name, names), Path: path, NewFiles: newFiles})
+	}
+	release := ReadOSRelease()
+	family := DistroFamily(release)
+	distro := release["PRETTY_NAME"]
+	if distro == "" {
+		distro = "unknown distro"
+	}
+	if family != "" {
+		distro += " (" + family + ")"
+	}
+	report("Distro: %s\n", distro)
+
+	report("\n---Services---\n")
+	for _, name := range ListServices() {
+		if isBoringUnit(name) {
+			continue
+		}
+		unit, ok := LoadUnit(name)
+		if !ok {
+			report("%s: skipped (no unit file)\n", name)
+			continue
+		}
+		if unit.Binary == "" || !FileExists(unit.Binary) {
+			report("%s: skipped (couldn't find what it runs)\n", name)
+			continue
+		}
+		serviceName := strings.TrimSuffix(name, ".service")
+		config, extras := unit.Resolve()
+		if config == "" || unit.IsTemplate() {
+			// A service needs all three, and upkeep can't restart a template
+			// by its unit file, so protect what we found on its own
+			if config == "" {
+				report("%s: no config found, binary and unit added to other_files\n", name)
+			} else {
+				report("%s: template unit, binary, unit and config added to other_files\n", name)
+				addFile(serviceName+"_config", config)
+			}
+			addFile(serviceName+"_binary", unit.Binary)
+			addFile(serviceName+"_unit", unit.Path)
+		} else {
+			report("%s: %s, %s, %s\n", name, unit.Binary, unit.Path, config)
+			discovered.Services = append(discovered.Services, Service{
+				Name:    uniqueName(serviceName, names),
+				Binary:  &ServiceObject{Path: unit.Binary},
+				Service: &ServiceObject{Path: unit.Path},
+				Config:  &ServiceObject{Path: config},
+			})
+		}
+		// Anything else that changes how the service runs
+		for _, path := range extras {
+			report("%s: also reads %s\n", name, path)
+			addFile(serviceName+"_"+filepath.Base(path), path)
+		}
+	}
+	if len(discovered.Services)+len(discovered.Files) == 0 {
+		report("None found\n")
+	}
+
+	report("\n---Critical files---\n")
+	paths := append(append([]string{}, criticalFiles...), distroFiles[family]...)
+	keys, _ := filepath.Glob("/home/*/.ssh/authorized_keys")
+	paths = append(paths, keys...)
+	for _, path := range paths {
+		if !FileExists(path) {
+			continue
+		}
+		report("%s\n", path)
+		name := filepath.Base(path)
+		if strings.HasSuffix(path, "/.ssh/authorized_keys") {
+			name = filepath.Base(filepath.Dir(filepath.Dir(path))) + "_authorized_keys"
+		}
+		addFile(name, path)
+	}
+	for _, path := range append(append([]string{}, criticalDirs...), distroDirs[family]...) {
+		if IsDir(path) {
+			report("%s/\n", path)
+			addDir(strings.TrimPrefix(strings.ReplaceAll(path, "/", "_"), "_"), path, newFilesAlert)
+		}
+	}
+
+	report("\n---Web roots---\n")
+	found := false
+	for _, root := range FindWebRoots() {
+		if IsDir(root) {
+			report("%s/\n", root)
+			// Uploads and caches change all the time, so only report new files.
+			// Switch new_files to quarantine to move web shells out as well.
+			addDir("webroot", root, newFilesAlert)
+			found = true
+		}
+	}
+	if !found {
+		report("None found\n")
+	}
+	return discovered
+}
+
+// Format a discovered config like the config file
+func FormatConfig(discovered Services) ([]byte, error) {
+	contents, err := json.MarshalIndent(discovered, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(contents)
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// Handle the discover subcommand, which writes a config for this box to
+// a file (or stdout) and exits before anything else is set up
+func RunDiscover() {
+	file := ""
+	if len(os.Args) > 2 && !strings.HasPrefix(os.Args[2], "-") {
+		file = os.Args[2]
+	}
+	// The config goes to stdout if there's no file, so keep the report out of it
+	report := func(s string, params ...interface{}) {
+		fmt.Fprintf(os.Stderr, s, params...)
+	}
+	if file != "" {
+		report = func(s string, params ...interface{}) {
+			fmt.Printf(s, params...)
+		}
+		if FileExists(file) {
+			Errorf("Error: %s already exists\n", file)
+			os.Exit(-1)
+		}
+	}
+	discovered := Discover(report)
+	contents, err := FormatConfig(discovered)
+	if err != nil {
+		Errorf("Error: could not build config: %v\n", err)
+		os.Exit(-1)
+	}
+	summary := fmt.Sprintf("\nFound %d services, %d files and %d directories.\n", len(discovered.Services), len(discovered.Files), len(discovered.Directories))
+	if file == "" {
+		os.Stdout.Write(contents)
+		report("%s", summary)
+		os.Exit(0)
+	}
+	if err := ioutil.WriteFile(file, contents, 0600); err != nil {
+		Errorf("Error: could not write %s: %v\n", file, err)
+		os.Exit(-1)
+	}
+	report("%s", summary)
+	fmt.Printf("Wrote %s. Review it, then check it with ./bandaid validate %s\n", file, file)
+	os.Exit(0)
+}
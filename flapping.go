@@ -0,0 +1,191 @@
+/*
+flapping.go- Detection of files that red team keeps rewriting
+(i.e. a loop writing /etc/passwd every 200ms). Once a file is
+restored too many times within a window it is marked as
+flapping, its output is silenced, and the configured
+escalation actions are taken.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Escalation actions for flapping objects
+const (
+	flapAlert    = "alert"    // Print a single alert instead of every restore
+	flapInterval = "interval" // Check the object every config.flapDelay ms (see CheckInterval)
+	flapLock     = "lock"     // Make the file immutable
+	flapKill     = "kill"     // Kill any process writing to the file
+)
+
+var flapActions []string = []string{
+	flapAlert,
+	flapInterval,
+	flapLock,
+	flapKill,
+}
+
+// Drop restores that have fallen out of the flapping window
+func pruneRestores(restores []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-config.flapWindow * time.Millisecond)
+	i := 0
+	for i < len(restores) && restores[i].Before(cutoff) {
+		i++
+	}
+	return restores[i:]
+}
+
+// Check if an escalation action is enabled
+func FlapAction(action string) bool {
+	return contains(config.flapActions, action)
+}
+
+// Record a restore, and escalate if the object has started flapping.
+// attr is whoever made the change, if known. The caller must hold isFreeing.
+func (a *ServiceObject) RecordRestore(label string, attr *Attribution) {
+	now := time.Now()
+	a.restores = append(pruneRestores(a.restores, now), now)
+	if !a.flapping && config.flapThreshold > 0 && len(a.restores) >= config.flapThreshold {
+		a.flapping = true
+		a.flapRestores = 0
+		if config.outputEnabled {
+			Errorf("\n%s is flapping: restored %d times in %d ms. Escalating (%s)...\n", label, len(a.restores), config.flapWindow, strings.Join(config.flapActions, ", "))
+		}
+		if FlapAction(flapInterval) {
+			a.CheckSoon()
+		}
+	}
+	if !a.flapping {
+		return
+	}
+	a.flapRestores++
+	if FlapAction(flapLock) && !a.locked && !a.isDir && !a.isLink {
+		a.locked = true
+		if a.applyFlags() {
+			Errorf("Locked %s (chattr +i).\n", a.Path)
+		}
+	}
+	// A new writer may have started since the last restore, so look every time
+	if FlapAction(flapKill) {
+		a.KillWriters(attr)
+	}
+}
+
+// Clear the flapping state once a full window has gone by without a
+// restore. Returns true if anything was printed. The caller must hold isFreeing.
+func (a *ServiceObject) UpdateFlapping(label string) bool {
+	if len(a.restores) == 0 {
+		return false
+	}
+	a.restores = pruneRestores(a.restores, time.Now())
+	if !a.flapping || len(a.restores) > 0 {
+		return false
+	}
+	a.flapping = false
+	if config.outputEnabled {
+		Warnf("\n%s is no longer flapping (%d restores while flapping).\n", label, a.flapRestores)
+		return true
+	}
+	return false
+}
+
+// Kill every process that has the object's file open for writing,
+// along with the process that made the last change (if it's still running).
+// init, bandaid itself, anything it was started from and kernel threads
+// are never killed.
+func (a *ServiceObject) KillWriters(attr *Attribution) {
+	spared := map[int]bool{1: true, os.Getpid(): true}
+	for _, parent := range GetProcChain(os.Getppid()) {
+		spared[parent.Pid] = true
+	}
+	pids := FindWriters(a.Path)
+	if attr != nil && attr.Alive() && !containsInt(pids, attr.Process.Pid) {
+		pids = append(pids, attr.Process.Pid)
+	}
+	for _, pid := range pids {
+		if pid <= 1 || spared[pid] {
+			continue
+		}
+		if IsKernelThread(pid) {
+			continue
+		}
+		info, _ := GetProcInfo(pid)
+		if err := syscall.Kill(pid, syscall.SIGKILL); err == nil {
+			Errorf("Killed %s\n", info)
+		}
+	}
+}
+
+// Get a tag to show next to an object in list and checksums output
+func (a *ServiceObject) StatusTag() string {
+	var tags []string
+	if a.flapping {
+		tags = append(tags, "flapping")
+	}
+	if a.locked {
+		tags = append(tags, "locked")
+	}
+	if a.Policy != policyRestore && a.Policy != "" {
+		tags = append(tags, a.Policy+" only")
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(tags, ", ") + "]"
+}
+
+// Notice when flapping objects have calmed down. RunBandaid takes care
+// of checking them faster, if the interval action is enabled.
+func RunFlapping() {
+	for {
+		time.Sleep(config.flapDelay * time.Millisecond)
+		printed := false
+		isFreeing.Lock()
+		ForEachObject(func(obj *ServiceObject, label string) {
+			if !obj.flapping {
+				return
+			}
+			if obj.UpdateFlapping(label) {
+				printed = true
+			}
+		})
+		isFreeing.Unlock()
+		if printed {
+			caret()
+		}
+	}
+}
+
+// Print flapping objects and settings
+func PrintFlapping() {
+	fmt.Printf(
+		"Threshold: %d restores in %d ms\nActions: %s\nFast check interval: %d ms\n",
+		config.flapThreshold, config.flapWindow, strings.Join(config.flapActions, ","), config.flapDelay,
+	)
+	Warnf("---Flapping---\n")
+	isFreeing.Lock()
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if obj.flapping || obj.locked {
+			fmt.Printf("%s: %d recent restores%s\n", label, len(obj.restores), obj.StatusTag())
+		}
+	})
+	isFreeing.Unlock()
+}
+
+// Parse a comma separated list of escalation actions
+func ParseFlapActions(str string) ([]string, bool) {
+	var actions []string
+	for _, action := range strings.Split(str, ",") {
+		if !contains(flapActions, action) {
+			return nil, false
+		}
+		actions = append(actions, action)
+	}
+	return actions, true
+}
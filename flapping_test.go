@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlappingEscalates(t *testing.T) {
+	resetSettings()
+	config.outputEnabled = false
+	config.flapThreshold = 3
+	config.flapWindow = 60000
+	config.flapActions = []string{flapAlert, flapInterval}
+	a := &ServiceObject{Name: "a", Path: "/nonexistent", due: time.Now().Add(time.Hour)}
+	isFreeing.Lock()
+	defer isFreeing.Unlock()
+
+	// Restores from before the window don't count
+	old := time.Now().Add(-2 * config.flapWindow * time.Millisecond)
+	a.restores = []time.Time{old, old, old}
+	for i := 1; i < config.flapThreshold; i++ {
+		a.RecordRestore("a", nil)
+		if a.flapping {
+			t.Fatalf("flapping after %d restores, want %d", i, config.flapThreshold)
+		}
+	}
+	if len(a.restores) != config.flapThreshold-1 {
+		t.Errorf("%d restores kept, want %d", len(a.restores), config.flapThreshold-1)
+	}
+	a.RecordRestore("a", nil)
+	if !a.flapping {
+		t.Fatalf("not flapping after %d restores", config.flapThreshold)
+	}
+	if !a.due.IsZero() {
+		t.Errorf("the interval action didn't check the object sooner")
+	}
+	if a.StatusTag() != " [flapping]" {
+		t.Errorf("status tag is %q, want [flapping]", a.StatusTag())
+	}
+	a.RecordRestore("a", nil)
+	if a.flapRestores != 2 {
+		t.Errorf("%d restores while flapping, want 2", a.flapRestores)
+	}
+
+	// Still flapping while restores are in the window
+	if a.UpdateFlapping("a"); !a.flapping {
+		t.Errorf("flapping was cleared with recent restores")
+	}
+	// and it calms down once a full window goes by without one
+	for i := range a.restores {
+		a.restores[i] = old
+	}
+	a.UpdateFlapping("a")
+	if a.flapping || len(a.restores) != 0 {
+		t.Errorf("flapping wasn't cleared after a quiet window")
+	}
+	// A zero threshold turns detection off
+	config.flapThreshold = 0
+	for i := 0; i < 5; i++ {
+		a.RecordRestore("a", nil)
+	}
+	if a.flapping {
+		t.Errorf("flapping with a zero threshold")
+	}
+}
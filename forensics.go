@@ -0,0 +1,272 @@
+/*
+forensics.go- Before a tampered file is restored, the
+attacker's version is captured (encrypted) so that we can
+see what red team changed after the round is over
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A captured copy of a tampered file
+type ForensicSample struct {
+	Path      string            `json:"path"`
+	Label     string            `json:"label"`
+	Time      time.Time         `json:"time"`
+	Kind      string            `json:"kind"` // content, perms or deleted
+	Mode      fs.FileMode       `json:"mode"`
+	Owner     int               `json:"owner"`
+	Group     int               `json:"group"`
+	Size      int64             `json:"size"`
+	Atime     time.Time         `json:"atime"`
+	Mtime     time.Time         `json:"mtime"`
+	Ctime     time.Time         `json:"ctime"`
+	Target    string            `json:"target"` // Where the path pointed, if it was a symlink
+	Xattrs    map[string][]byte `json:"xattrs"`
+	Checksum  string            `json:"checksum"` // SHA-256 of the whole tampered file
+	Truncated bool              `json:"truncated"`
+	Content   []byte            `json:"content"`
+	Process   *Attribution      `json:"process,omitempty"` // Who made the change, if known
+	file      string            // Name of the sample in the forensics folder
+}
+
+// Checksum of the last captured sample for each path, so a
+// flapping file doesn't get captured over and over again
+var lastSample = map[string]string{}
+var forensicsLock sync.Mutex
+
+// Get the folder that forensic samples are stored in. This
+// sits next to the backup folder rather than inside it.
+func ForensicsFolder() string {
+	return strings.TrimSuffix(config.backupLocation, "/") + ".forensics"
+}
+
+// Capture the current (tampered) state of an object before it is restored
+func CaptureForensics(obj *ServiceObject, label string, kind string, attr *Attribution) {
+	if !config.forensics {
+		return
+	}
+	sample := ForensicSample{
+		Path:    obj.Path,
+		Label:   label,
+		Time:    time.Now(),
+		Kind:    kind,
+		Process: attr,
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(obj.Path, &st); err != nil {
+		sample.Kind = "deleted"
+	} else {
+		sample.Owner = int(st.Uid)
+		sample.Group = int(st.Gid)
+		sample.Size = st.Size
+		sample.Atime = time.Unix(st.Atim.Unix())
+		sample.Mtime = time.Unix(st.Mtim.Unix())
+		sample.Ctime = time.Unix(st.Ctim.Unix())
+		if stat, err := os.Lstat(obj.Path); err == nil {
+			// Use the FileMode from os.Lstat so it prints like ls
+			sample.Mode = stat.Mode()
+		}
+		if sample.Mode&os.ModeSymlink != 0 {
+			// Don't capture whatever the link points at
+			sample.Target, _ = os.Readlink(obj.Path)
+			sample.Checksum = LinkSHA(sample.Target)
+		} else {
+			sample.Xattrs = GetXattrs(obj.Path)
+		}
+		if kind == "content" && !obj.isDir && sample.Target == "" {
+			sample.Checksum, _ = obj.GetSHA()
+			if f, err := os.Open(obj.Path); err == nil {
+				// Read one byte past the cap so we know if the sample was truncated
+				sample.Content, _ = ioutil.ReadAll(io.LimitReader(f, config.forensicMaxSize+1))
+				f.Close()
+				if int64(len(sample.Content)) > config.forensicMaxSize {
+					sample.Content = sample.Content[:config.forensicMaxSize]
+					sample.Truncated = true
+				}
+			}
+		}
+	}
+	forensicsLock.Lock()
+	defer forensicsLock.Unlock()
+	// Skip identical consecutive captures of the same file
+	key := sample.Kind + ":" + sample.Checksum
+	if sample.Kind == "perms" {
+		key += fmt.Sprintf(":%v:%d:%d", sample.Mode, sample.Owner, sample.Group)
+	}
+	if lastSample[obj.Path] == key {
+		return
+	}
+	lastSample[obj.Path] = key
+
+	folder := ForensicsFolder()
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return
+	}
+	contents, err := json.Marshal(sample)
+	if err != nil {
+		return
+	}
+	if config.doEncryption {
+		contents = encrypt(contents, config.key)
+	}
+	// Prefix with a fixed-width timestamp so the samples sort chronologically
+	name := fmt.Sprintf("%019d_%s", sample.Time.UnixNano(), strings.TrimPrefix(GetConfigName(obj.Path), config.backupLocation+"/"))
+	dest := ConcatenatePath(folder, name)
+	if writeFile(dest, contents) {
+		os.Chmod(dest, 0600)
+	}
+	PruneForensics()
+}
+
+// Enforce the per-path and total size limits on the forensics
+// folder by removing the oldest samples first. The caller must
+// hold forensicsLock.
+func PruneForensics() {
+	folder := ForensicsFolder()
+	items, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	// ReadDir sorts by name, so newest samples are last
+	perPath := map[string]int{}
+	var total int64
+	var kept []fs.FileInfo
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		parts := strings.SplitN(item.Name(), "_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		perPath[parts[1]]++
+		if config.forensicKeep > 0 && perPath[parts[1]] > config.forensicKeep {
+			os.Remove(ConcatenatePath(folder, item.Name()))
+			continue
+		}
+		total += item.Size()
+		kept = append(kept, item)
+	}
+	// kept is newest first; drop from the end until we're under the cap
+	for len(kept) > 0 && config.forensicMaxTotal > 0 && total > config.forensicMaxTotal {
+		oldest := kept[len(kept)-1]
+		os.Remove(ConcatenatePath(folder, oldest.Name()))
+		total -= oldest.Size()
+		kept = kept[:len(kept)-1]
+	}
+}
+
+// Load every captured sample, oldest first
+func LoadForensics() []ForensicSample {
+	var samples []ForensicSample
+	folder := ForensicsFolder()
+	items, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return samples
+	}
+	for _, item := range items {
+		contents, err := ioutil.ReadFile(ConcatenatePath(folder, item.Name()))
+		if err != nil {
+			continue
+		}
+		if config.doEncryption {
+			contents = decrypt(contents, config.key)
+		}
+		var sample ForensicSample
+		if json.Unmarshal(contents, &sample) != nil {
+			// Most likely encrypted with a different key
+			continue
+		}
+		sample.file = item.Name()
+		samples = append(samples, sample)
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].file < samples[j].file
+	})
+	return samples
+}
+
+// Handle the forensics REPL command
+func ForensicsCommand(args []string) {
+	forensicsLock.Lock()
+	samples := LoadForensics()
+	forensicsLock.Unlock()
+	if len(args) == 1 || args[1] == "list" {
+		if len(samples) == 0 {
+			fmt.Println("No forensic samples captured.")
+			return
+		}
+		Warnf("---Forensic samples---\n")
+		for i, sample := range samples {
+			fmt.Printf("%d: %s %s %s (%d bytes)\n", i+1, sample.Time.Format("2006-01-02 15:04:05"), sample.Kind, sample.Path, sample.Size)
+		}
+		return
+	}
+	if args[1] != "view" || len(args) != 3 {
+		Errorf("Error: usage: forensics [list|view [n]]\n")
+		return
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 1 || n > len(samples) {
+		Errorf("Error: no sample %s\n", args[2])
+		return
+	}
+	sample := samples[n-1]
+	fmt.Printf(
+		"Path: %s (%s)\nCaptured: %s\nKind: %s\nMode: %s\nOwner: %s (%d)\nGroup: %d\nSize: %d\nAccessed: %s\nModified: %s\nChanged: %s\nChecksum: %s\n",
+		sample.Path, sample.Label,
+		sample.Time.Format(time.RFC3339),
+		sample.Kind,
+		sample.Mode,
+		LookupUser(sample.Owner), sample.Owner,
+		sample.Group,
+		sample.Size,
+		sample.Atime.Format(time.RFC3339),
+		sample.Mtime.Format(time.RFC3339),
+		sample.Ctime.Format(time.RFC3339),
+		sample.Checksum,
+	)
+	if sample.Target != "" {
+		fmt.Printf("Symlink to: %s\n", sample.Target)
+	}
+	for _, name := range XattrNames(sample.Xattrs) {
+		fmt.Printf("Xattr %s: %q\n", name, sample.Xattrs[name])
+	}
+	if sample.Process != nil {
+		fmt.Printf("%s at %s (via %s)\n", sample.Process.Event, sample.Process.Time.Format(time.RFC3339), sample.Process.Source)
+		fmt.Printf("Process: %s\n", sample.Process.Process)
+		for _, parent := range sample.Process.Parents {
+			fmt.Printf("  from %s\n", parent)
+		}
+	}
+	if len(sample.Content) == 0 {
+		return
+	}
+	Warnf("---Content---\n")
+	if IsText(sample.Content) {
+		fmt.Println(string(sample.Content))
+	} else {
+		// Binary files get a hex dump of the start of the file
+		limit := len(sample.Content)
+		if limit > 512 {
+			limit = 512
+		}
+		fmt.Print(hex.Dump(sample.Content[:limit]))
+	}
+	if sample.Truncated {
+		Warnf("(truncated at %d bytes)\n", len(sample.Content))
+	}
+}
@@ -0,0 +1,338 @@
+/*
+history.go- Past baselines of every protected file. Each time
+a file's baseline changes (added, accepted, rolled back) a new
+generation is written to the backup folder, so an accepted bad
+version can be undone.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A single past baseline of a file. The contents are in the blob
+// store, so listing the history doesn't read them all.
+type Generation struct {
+	Number   int               `json:"generation"`
+	Time     time.Time         `json:"time"`
+	Checksum string            `json:"checksum"`
+	Mode     fs.FileMode       `json:"mode"`
+	Owner    int               `json:"owner"`
+	Group    int               `json:"group"`
+	Target   string            `json:"target"` // Where the path pointed, if it was a symlink
+	Xattrs   map[string][]byte `json:"xattrs"`
+	Flags    uint32            `json:"flags"`
+	HasFlags bool              `json:"has_flags"`
+	Size     int               `json:"size"`
+	Blob     string            `json:"blob,omitempty"` // Older generations kept their contents next to the metadata
+}
+
+// Get the folder that holds every generation of a path
+func HistoryFolder(path string) string {
+	return ConcatenatePath(ConcatenatePath(config.backupLocation, "history"), strings.TrimPrefix(GetConfigName(path), config.backupLocation+"/"))
+}
+
+// Get the number of generations kept for an object
+func (a *ServiceObject) Retention() int {
+	n := config.generations
+	if a.Generations > 0 {
+		n = a.Generations
+	}
+	if n < 1 {
+		// The current baseline is always kept
+		n = 1
+	}
+	return n
+}
+
+// Read and decrypt a file in the history folder
+func readHistoryFile(path string) ([]byte, bool) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	if config.doEncryption {
+		contents = decrypt(contents, config.key)
+	}
+	return contents, true
+}
+
+// Encrypt and write a file in the history folder
+func writeHistoryFile(path string, contents []byte) bool {
+	if config.doEncryption {
+		contents = encrypt(contents, config.key)
+	}
+	return WriteFileAtomic(path, contents, 0600, os.Getuid(), os.Getgid(), nil)
+}
+
+// Load the metadata of every generation of an object, oldest first
+func (a *ServiceObject) LoadHistory() []Generation {
+	var history []Generation
+	folder := HistoryFolder(a.Path)
+	items, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return history
+	}
+	for _, item := range items {
+		if !strings.HasSuffix(item.Name(), ".json") {
+			continue
+		}
+		contents, ok := readHistoryFile(ConcatenatePath(folder, item.Name()))
+		if !ok {
+			continue
+		}
+		var gen Generation
+		if json.Unmarshal(contents, &gen) == nil {
+			history = append(history, gen)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Number < history[j].Number
+	})
+	return history
+}
+
+// Check if a generation is the same as an object's current baseline,
+// given the checksum of its backup
+func (a *ServiceObject) sameAs(gen Generation, checksum string) bool {
+	return gen.Checksum == checksum &&
+		gen.Mode == a.Mode &&
+		gen.Owner == a.Owner &&
+		gen.Group == a.Group &&
+		gen.Target == a.Target &&
+		gen.Flags == a.flags &&
+		XattrsEqual(gen.Xattrs, a.xattrs)
+}
+
+// Record the current baseline of an object as a new generation,
+// unless it's the same as the latest one
+func (a *ServiceObject) SaveGeneration() bool {
+	if a.isDir {
+		return true
+	}
+	// The checksum may not be set yet while the object is being
+	// initialized, so hash the backup itself
+	checksum := a.BackupSHA()
+	history := a.LoadHistory()
+	number := 1
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		if a.sameAs(latest, checksum) {
+			return true
+		}
+		number = latest.Number + 1
+	}
+	gen := Generation{
+		Number:   number,
+		Time:     time.Now(),
+		Checksum: checksum,
+		Mode:     a.Mode,
+		Owner:    a.Owner,
+		Group:    a.Group,
+		Target:   a.Target,
+		Xattrs:   a.xattrs,
+		Flags:    a.flags,
+		HasFlags: a.hasFlags,
+		Size:     int(a.BackupSize()),
+	}
+	if !a.isLink {
+		gen.Blob = a.blob
+	}
+	folder := HistoryFolder(a.Path)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return false
+	}
+	meta, err := json.Marshal(gen)
+	if err != nil {
+		return false
+	}
+	name := ConcatenatePath(folder, fmt.Sprintf("%06d.json", number))
+	// Reference the blob first, so a generation never exists without it
+	if !a.isLink && !blobs.Ref(name, gen.Blob, a.Backup) {
+		return false
+	}
+	if !writeHistoryFile(name, meta) {
+		return false
+	}
+	a.PruneHistory()
+	return true
+}
+
+// Remove the oldest generations past the object's retention
+func (a *ServiceObject) PruneHistory() {
+	history := a.LoadHistory()
+	folder := HistoryFolder(a.Path)
+	for len(history) > a.Retention() {
+		name := ConcatenatePath(folder, fmt.Sprintf("%06d", history[0].Number))
+		os.Remove(name + ".json")
+		os.Remove(name)
+		blobs.Unref(name + ".json")
+		history = history[1:]
+	}
+}
+
+// Read the contents of a generation of path
+func (gen Generation) Read(path string) ([]byte, bool) {
+	if gen.Blob == "" {
+		return readHistoryFile(ConcatenatePath(HistoryFolder(path), fmt.Sprintf("%06d", gen.Number)))
+	}
+	r, err := blobs.Open(gen.Blob)
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	return contents, err == nil
+}
+
+// Make a past generation the object's baseline again, and restore it.
+// The caller must hold isFreeing.
+func (a *ServiceObject) Rollback(number int) bool {
+	var gen *Generation
+	history := a.LoadHistory()
+	for i := range history {
+		if history[i].Number == number {
+			gen = &history[i]
+			break
+		}
+	}
+	if gen == nil {
+		Errorf("Error: %s has no generation %d\n", a.Path, number)
+		return false
+	}
+	if gen.Target == "" {
+		contents, ok := gen.Read(a.Path)
+		if !ok {
+			Errorf("Error: could not read generation %d of %s\n", number, a.Path)
+			return false
+		}
+		a.setBackup(contents)
+	} else {
+		a.releaseBuffer()
+		a.blob = ""
+		a.Backup = []byte(gen.Target)
+	}
+	a.streamed = false
+	a.Checksum = gen.Checksum
+	a.Mode = gen.Mode
+	a.Owner = gen.Owner
+	a.Group = gen.Group
+	a.Target = gen.Target
+	a.isLink = gen.Target != ""
+	a.xattrs = gen.Xattrs
+	a.flags = gen.Flags
+	a.hasFlags = gen.HasFlags
+	a.stat = fileStat{}
+	a.checks = 0
+	a.restores = nil
+	a.flapping = false
+	a.alerted = ""
+	a.alertedPerms = ""
+	a.seenStat = fileStat{}
+	if config.doBackup && !a.WriteStore() {
+		Errorf("Error: could not write the backup of %s\n", a.Path)
+	}
+	ok := a.writeBackup()
+	a.DropBackup()
+	return ok
+}
+
+// Print every generation of an object
+func (a *ServiceObject) PrintHistory() {
+	history := a.LoadHistory()
+	checksum := a.BackupSHA()
+	// A rollback copies an old generation, so only mark the newest match
+	current := -1
+	for i, gen := range history {
+		if a.sameAs(gen, checksum) {
+			current = i
+		}
+	}
+	Warnf("(%s) %d of %d generations\n", a.Path, len(history), a.Retention())
+	for i, gen := range history {
+		tag := ""
+		if i == current {
+			tag = " [current]"
+		}
+		short := gen.Checksum
+		if len(short) > 12 {
+			short = short[:12]
+		}
+		what := fmt.Sprintf("%d bytes", gen.Size)
+		if gen.Target != "" {
+			what = "-> " + gen.Target
+		}
+		fmt.Printf(
+			"%d: %s %s %s %s:%d %s%s\n",
+			gen.Number, gen.Time.Format("2006-01-02 15:04:05"), short,
+			gen.Mode, LookupUser(gen.Owner), gen.Group, what, tag,
+		)
+	}
+}
+
+// Handle the history REPL command. The caller must hold isFreeing.
+func HistoryCommand(args []string) {
+	if len(args) == 1 {
+		// Summary of every object with more than one generation
+		ForEachObject(func(obj *ServiceObject, label string) {
+			if obj.isDir {
+				return
+			}
+			if n := len(obj.LoadHistory()); n > 1 {
+				fmt.Printf("%s: %d generations\n", label, n)
+			}
+		})
+		return
+	}
+	objs := FindObjects(args[1])
+	if len(objs) == 0 {
+		Warnf("%s does not exist\n", args[1])
+		return
+	}
+	for _, obj := range objs {
+		if !obj.isDir {
+			obj.PrintHistory()
+		}
+	}
+}
+
+// Handle the rollback REPL command. The caller must hold isFreeing.
+func RollbackCommand(args []string) {
+	if len(args) != 3 {
+		Errorf("Error: usage: rollback [name|file] [generation]\n")
+		return
+	}
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		Errorf("Error: Invalid generation\n")
+		return
+	}
+	var objs []*ServiceObject
+	for _, obj := range FindObjects(args[1]) {
+		if !obj.isDir {
+			objs = append(objs, obj)
+		}
+	}
+	if len(objs) == 0 {
+		Warnf("%s does not exist\n", args[1])
+		return
+	} else if len(objs) > 1 {
+		// Generations are numbered per file
+		Errorf("Error: %s matches %d files. Use the path of a single file.\n", args[1], len(objs))
+		return
+	}
+	if objs[0].Rollback(number) {
+		fmt.Printf("Rolled %s back to generation %d.\n", objs[0].Path, number)
+	} else {
+		Errorf("Error restoring %s.\n", objs[0].Path)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	saved := colors
+	colors = Colors{}
+	defer func() { colors = saved }()
+	for _, lowMemory := range []bool{false, true} {
+		name := "in memory"
+		if lowMemory {
+			name = "low memory"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := tempBackupFolder(t)
+			config.outputEnabled = false
+			config.lowMemory = lowMemory
+			config.memThreshold = 1
+			config.generations = 5
+			a := &ServiceObject{Name: "a", Path: filepath.Join(dir, "a")}
+			versions := []struct {
+				contents string
+				mode     os.FileMode
+			}{
+				{"first\n", 0644},
+				{"second\n", 0600},
+				{"third\n", 0640},
+			}
+			isFreeing.Lock()
+			defer isFreeing.Unlock()
+			for i, v := range versions {
+				if err := ioutil.WriteFile(a.Path, []byte(v.contents), v.mode); err != nil {
+					t.Fatal(err)
+				}
+				os.Chmod(a.Path, v.mode)
+				if i == 0 {
+					if !a.InitSO() {
+						t.Fatal("couldn't initialize a")
+					}
+					a.InitBackup()
+				} else if !a.Accept() {
+					t.Fatalf("couldn't accept version %d", i+1)
+				}
+			}
+			history := a.LoadHistory()
+			if len(history) != len(versions) {
+				t.Fatalf("%d generations, want %d", len(history), len(versions))
+			}
+
+			if !a.Rollback(1) {
+				t.Fatal("couldn't roll back to generation 1")
+			}
+			contents, _ := ioutil.ReadFile(a.Path)
+			if string(contents) != versions[0].contents {
+				t.Errorf("file is %q, want %q", contents, versions[0].contents)
+			}
+			if info, _ := os.Stat(a.Path); info.Mode().Perm() != versions[0].mode {
+				t.Errorf("mode is %v, want %v", info.Mode().Perm(), versions[0].mode)
+			}
+			// Generation 1 is the baseline now
+			if got, ok := a.ReadBackup(); !ok || string(got) != versions[0].contents {
+				t.Errorf("baseline is %q, want %q", got, versions[0].contents)
+			}
+			if !a.CheckFile() {
+				t.Errorf("the rolled back file doesn't match its checksum")
+			}
+			if history := a.LoadHistory(); history[len(history)-1].Checksum != history[0].Checksum {
+				t.Errorf("the rollback wasn't recorded as the latest generation")
+			}
+			if a.Rollback(99) {
+				t.Errorf("rolled back to a generation that doesn't exist")
+			}
+		})
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	saved := colors
+	colors = Colors{}
+	defer func() { colors = saved }()
+	dir := tempBackupFolder(t)
+	config.outputEnabled = false
+	config.generations = 2
+	a := &ServiceObject{Name: "a", Path: filepath.Join(dir, "a")}
+	isFreeing.Lock()
+	defer isFreeing.Unlock()
+	for i, contents := range []string{"1", "2", "3", "4"} {
+		ioutil.WriteFile(a.Path, []byte(contents), 0644)
+		if i == 0 {
+			a.InitSO()
+			a.InitBackup()
+		} else {
+			a.Accept()
+		}
+	}
+	history := a.LoadHistory()
+	if len(history) != 2 || history[0].Number != 3 || history[1].Number != 4 {
+		t.Errorf("kept %+v, want generations 3 and 4", history)
+	}
+	if a.Rollback(1) {
+		t.Errorf("rolled back to a pruned generation")
+	}
+}
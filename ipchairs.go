@@ -187,6 +187,9 @@ func (a *IpChairs) Enter() {
 		case "enable":
 			// TODO make the enable/disable start and stop the goroutine
 			a.config.enabled = true
+			if !config.ipChairs {
+				Warnf("IpChairs was turned off at startup. Restart bandaid without -c to apply the rules.\n")
+			}
 		case "disable":
 			a.config.enabled = false
 		case "status":
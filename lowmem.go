@@ -0,0 +1,207 @@
+/*
+lowmem.go- Low memory mode. Backups over a size threshold are
+dropped from memory once they've been written to the backup
+folder, and restores stream them back out of it. This keeps
+large web roots and binaries from eating all of the RAM on
+small VMs.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+var errBackupChecksum = errors.New("backup doesn't match its checksum")
+
+// Check if an object's backup should only be kept on disk
+func (a *ServiceObject) shouldStream() bool {
+	return a.streamsAt(a.BackupSize())
+}
+
+// Check if an object's backup would only be kept on disk at a given size
+func (a *ServiceObject) streamsAt(size int64) bool {
+	// Without the backup folder there's nowhere to stream from
+	return config.lowMemory && config.doBackup && !a.isDir && !a.isLink && size > config.memThreshold
+}
+
+// Drop an object's backup from memory, if low memory mode says so.
+// It must already have been written to the backup folder.
+func (a *ServiceObject) DropBackup() {
+	if a.streamed || !a.shouldStream() {
+		return
+	}
+	a.size = int64(len(a.Backup))
+	// The blob stays on disk, and the buffer is freed once no other object shares it
+	a.releaseBuffer()
+	a.streamed = true
+}
+
+// Load a dropped backup back into memory
+func (a *ServiceObject) LoadBackup() bool {
+	if !a.streamed {
+		return true
+	}
+	contents, ok := a.ReadBackup()
+	if !ok {
+		return false
+	}
+	a.setBackup(contents)
+	a.streamed = false
+	a.size = 0
+	return true
+}
+
+// Get the size of an object's backup, wherever it is
+func (a *ServiceObject) BackupSize() int64 {
+	if a.streamed {
+		return a.size
+	}
+	return int64(len(a.Backup))
+}
+
+// Open an object's backup for reading, from memory or from the backup
+// folder. Backups read from the folder are checked against the checksum
+// as they're read, so a tampered backup never gets restored.
+func (a *ServiceObject) OpenBackup() (io.ReadCloser, error) {
+	if !a.streamed {
+		return ioutil.NopCloser(bytes.NewReader(a.Backup)), nil
+	}
+	r, err := blobs.Open(a.blob)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyReader{r: r, c: r, hash: sha256.New(), want: a.Checksum}, nil
+}
+
+// Read an object's whole backup, for things that need it all at once (i.e. diffs)
+func (a *ServiceObject) ReadBackup() ([]byte, bool) {
+	if !a.streamed {
+		return a.Backup, true
+	}
+	r, err := a.OpenBackup()
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	return contents, err == nil
+}
+
+// Hashes a backup as it's read and fails at the end if it doesn't match
+type verifyReader struct {
+	r    io.Reader
+	c    io.Closer
+	hash hash.Hash
+	want string
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+		return n, errBackupChecksum
+	}
+	return n, err
+}
+
+func (v *verifyReader) Close() error {
+	return v.c.Close()
+}
+
+// Drop or load every backup to match the current low memory settings.
+// The caller must hold isFreeing.
+func ApplyMemoryMode() {
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if obj.shouldStream() {
+			obj.DropBackup()
+		} else if obj.streamed && !obj.LoadBackup() {
+			Errorf("Error: could not load the backup of %s\n", obj.Path)
+		}
+	})
+	// Hand the dropped backups back to the OS right away
+	debug.FreeOSMemory()
+}
+
+// Print how much memory backups are using
+func PrintMem() {
+	var inMemory, streamed int64
+	var inMemoryCount, streamedCount int
+	isFreeing.Lock()
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if obj.isDir {
+			return
+		}
+		if obj.streamed {
+			streamed += obj.size
+			streamedCount++
+		} else {
+			inMemory += int64(len(obj.Backup))
+			inMemoryCount++
+		}
+	})
+	isFreeing.Unlock()
+	// Objects with the same contents share a buffer, so count each one once
+	buffers, shared := blobs.BufferStats()
+	blobCount, blobSize := blobs.DiskStats()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	mode := "off"
+	if config.lowMemory {
+		mode = fmt.Sprintf("on (backups over %s stay on disk)", FormatSize(config.memThreshold))
+	}
+	fmt.Printf(
+		"Low memory mode: %s\nBackups in memory: %d files, %s (%d buffers, %s after deduplication)\nBackups on disk only: %d files, %s\nBlob store: %d blobs, %s\nHeap in use: %s (%s from the OS)\n",
+		mode,
+		inMemoryCount, FormatSize(inMemory), buffers, FormatSize(shared),
+		streamedCount, FormatSize(streamed),
+		blobCount, FormatSize(blobSize),
+		FormatSize(int64(stats.HeapInuse)), FormatSize(int64(stats.Sys)),
+	)
+}
+
+// Handle the mem REPL command
+func MemCommand(args []string) {
+	if len(args) == 1 {
+		PrintMem()
+		return
+	}
+	switch args[1] {
+	case "on":
+		if !config.doBackup {
+			Errorf("Error: low memory mode needs the backup folder\n")
+			return
+		}
+		config.lowMemory = true
+	case "off":
+		config.lowMemory = false
+	case "threshold":
+		if len(args) != 3 {
+			fmt.Printf("Threshold is %d bytes.\n", config.memThreshold)
+			return
+		}
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || n < 0 {
+			Errorf("Error: Invalid argument\n")
+			return
+		}
+		config.memThreshold = n
+	default:
+		Errorf("Error: invalid argument\n")
+		return
+	}
+	isFreeing.Lock()
+	ApplyMemoryMode()
+	isFreeing.Unlock()
+	PrintMem()
+}
@@ -14,7 +14,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -46,6 +48,13 @@ func main() {
 			}
 	*/
 	HandleArgs()
+	// Subcommands run without the key, the backup store or root
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		RunValidate()
+	}
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		RunDiscover()
+	}
 	CreateNil()
 	InitConfigFolder()
 	// TODO encrypt the files stored in memory as well
@@ -53,15 +62,26 @@ func main() {
 	InitBackups()
 	fmt.Println()
 	PrintChecksums()
-	Warnf("\nIpChairs is disabled by default. Run the ipchairs command to configure.\n")
+	if !ipchairs.config.enabled {
+		Warnf("\nIpChairs is disabled by default. Run the ipchairs command to configure.\n")
+	}
 	fmt.Printf("\n%sBandaid is active.%s\n", colors.yellow, colors.reset)
+	// Register all protected paths with inotify
+	InitWatcher()
+	// Mark them with fanotify too, so we know who changed what
+	InitAttribution()
 	// Start the main process
 	go RunBandaid()
+	// Notice when flapping objects calm down
+	go RunFlapping()
 	// Fixing ICMP is its own function since it has its own delay
 	go FixICMP()
-	// Initialize the IpChairs object and run it
-	InitIpChairs()
-	go ipchairs.Start()
+	// Pick up changes to the config file
+	go WatchConfig()
+	// Run IpChairs (it's initialized with the settings)
+	if config.ipChairs {
+		go ipchairs.Start()
+	}
 	InputCommand()
 }
 
@@ -69,30 +89,61 @@ func main() {
 func HandleArgs() {
 	// Initialize default config
 	config = Config{
-		delay:           1000,
-		icmpDelay:       10,
-		configFile:      "config.json",
-		backupLocation:  ".bandaid",
-		key:             GetPass("changeme"),
-		outputEnabled:   true,
-		loadFromConfig:  true,
-		upkeep:          true,
-		doBackup:        true,
-		checkPerms:      true,
-		doEncryption:    true,
-		ipChairs:        true,
-		ipChairsConsole: false,
-	}
-	// If there are no command line arguments, we return after setting the default config
-	if len(os.Args) <= 1 {
-		return
+		delay:            1000,
+		icmpDelay:        10,
+		configFile:       "config.json",
+		backupLocation:   ".bandaid",
+		key:              GetPass("changeme"),
+		outputEnabled:    true,
+		loadFromConfig:   true,
+		upkeep:           true,
+		doBackup:         true,
+		checkPerms:       true,
+		doEncryption:     true,
+		ipChairs:         true,
+		ipChairsConsole:  false,
+		watch:            true,
+		safetyDelay:      30000,
+		workers:          runtime.NumCPU(),
+		timing:           false,
+		rehashEvery:      10,
+		forensics:        true,
+		showDiff:         true,
+		lockdown:         false,
+		flapThreshold:    5,
+		flapWindow:       10000,
+		flapDelay:        100,
+		flapActions:      []string{flapAlert},
+		generations:      5,
+		lowMemory:        false,
+		memThreshold:     256 << 10,
+		priorityPaths:    defaultPriorityPaths,
+		priorityDelay:    100,
+		jitter:           20,
+		forensicMaxSize:  1 << 20,
+		forensicMaxTotal: 64 << 20,
+		forensicKeep:     10,
+		autoReload:       true,
+		reloadDelay:      2000,
+		autoSave:         false,
 	}
-	for i, arg := range os.Args[1:] {
+	InitIpChairs()
+	InitSettings()
+	// Flags win over everything else, so they're collected first and applied last
+	var overrides []flagSetting
+	configFlag := false
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
 		switch arg {
 		case "-h", "--help":
 			fmt.Printf( //TODO add optional encryption
 				colors.green + "Bandaid v1.3: Made by Mikayla Burke\n" + colors.reset +
 					"Usage: ./bandaid [args]\n" +
+					"       ./bandaid validate [file] [args]\n" +
+					"       ./bandaid discover [file]\n" +
+					"\nSubcommands:\n" +
+					"validate [file]			Check the config file and exit (non-zero if it has errors)\n" +
+					"discover [file]			Write a config for this box's services, critical files and web roots\n" +
 					"\nCommands:\n" +
 					"-h | --help			Display help\n" +
 					"-c | --no-ipchairs		Disable IpChairs\n" +
@@ -106,39 +157,81 @@ func HandleArgs() {
 					"-p | --no-perms			Disable permission checking (faster)\n" +
 					"-d | --delay [n]		Set interval to n\n" +
 					"-i | --icmpdelay [n]		Set ICMP delay to n\n" +
+					"-w | --no-watch			Disable inotify watching (poll only)\n" +
+					"-s | --safety [n]		Set safety-net polling interval to n while watching\n" +
+					"-j | --workers [n]		Verify up to n files concurrently\n" +
+					"-x | --rehash [n]		Fully rehash unchanged files every n checks\n" +
+					"-F | --no-forensics		Don't capture tampered files before restoring\n" +
+					"-l | --lockdown			Make protected files immutable (chattr +i)\n" +
+					"-t | --flap-threshold [n]	Mark files restored n times in the flap window as flapping\n" +
+					"-W | --flap-window [n]		Set the flap window to n\n" +
+					"-a | --flap-actions [list]	Escalation for flapping files (alert,interval,lock,kill)\n" +
+					"-g | --generations [n]		Keep n past baselines of each file\n" +
+					"-m | --low-memory		Keep large backups on disk only and stream restores\n" +
+					"-M | --mem-threshold [n]	Backups over n bytes stay on disk in low memory mode\n" +
+					"-P | --priority [n]		Check priority files (passwd, shadow, etc.) every n ms\n" +
+					"-J | --jitter [n]		Randomize check intervals by up to n percent\n" +
+					"-R | --no-reload		Don't reload the config file when it changes (SIGHUP still works)\n" +
+					"-S | --autosave		Save changes made from the console to the config file\n" +
+					"\nEvery setting can also be set in the settings section of the config file, or\n" +
+					"with a BANDAID_<SETTING> environment variable (BANDAID_CONFIG for the config file).\n" +
+					"Flags override the environment, which overrides the config file.\n" +
 					"\n",
 			)
 			os.Exit(0)
-		case "-c", "--no-ipchairs":
-			config.ipChairs = false
-		case "-n", "--no-backup":
-			config.doBackup = false
-		case "-e", "--no-encrypt":
-			config.doEncryption = false
-		case "-r", "--no-restore":
-			config.loadFromConfig = false
-		case "-q", "--quiet":
-			config.outputEnabled = false
-		case "-p", "--no-perms":
-			config.checkPerms = false
-		case "-u", "--upkeep":
-			config.upkeep = false
 		case "-f", "--configfile":
-			if i <= len(os.Args)-2 {
-				config.configFile = os.Args[i+2]
+			if i+1 < len(os.Args) {
+				i++
+				config.configFile = os.Args[i]
+				configFlag = true
 			} else {
 				Errorf("Error: must provide a config file location to use with --configfile\n")
 				os.Exit(-1)
 			}
-		case "-b", "--backup":
-			if i <= len(os.Args)-2 {
-				config.backupLocation = os.Args[i+2]
-			} else {
-				Errorf("Error: must provide a config file location to use with --configfile\n")
-				os.Exit(-1)
+		default:
+			for _, flag := range flagSettings {
+				if arg != flag.short && arg != flag.long {
+					continue
+				}
+				if flag.value == "" {
+					if i+1 >= len(os.Args) {
+						Errorf("Error: must provide a value to use with %s\n", arg)
+						os.Exit(-1)
+					}
+					i++
+					flag.value = os.Args[i]
+				}
+				flag.short = arg
+				overrides = append(overrides, flag)
 			}
 		}
 	}
+	if path, ok := os.LookupEnv("BANDAID_CONFIG"); ok && !configFlag {
+		config.configFile = path
+	}
+	// validate checks the settings itself, and discover doesn't need them
+	if len(os.Args) > 1 && (os.Args[1] == "validate" || os.Args[1] == "discover") {
+		return
+	}
+	// The rest of the config file is loaded by InitConfig
+	if configBytes, err := ioutil.ReadFile(config.configFile); err == nil {
+		_, problems := ApplyFileSettings(configBytes, false)
+		if len(problems) > 0 {
+			for _, problem := range problems {
+				Errorf("Config error: %s\n", problem)
+			}
+			os.Exit(-1)
+		}
+	}
+	if !ApplyEnvSettings() {
+		os.Exit(-1)
+	}
+	for _, flag := range overrides {
+		if !FindSetting(flag.setting).Set(flag.value, sourceFlag) {
+			Errorf("Error: invalid value for %s\n", flag.short)
+			os.Exit(-1)
+		}
+	}
 }
 
 // Main function to handle user input
@@ -149,6 +242,7 @@ func InputCommand() {
 		rawCmd, _ := reader.ReadString('\n')
 		cmd := trim(rawCmd)
 		args := strings.Split(cmd, " ")
+		before := SettingValues()
 		switch args[0] {
 		case "exit":
 			os.Exit(0)
@@ -158,16 +252,36 @@ func InputCommand() {
 					"list\n" +
 					"checksums\n" +
 					"addservice [name] [binary_path] [service_path] [config_path]\n" +
+					"addservice [name] [unit]\n" +
 					"addfile [name] [file]\n" +
-					"addfolder [name] [path]\n" +
+					"addfolder [name] [path] [alert|quarantine|delete] [option=value]...\n" +
 					"free [name|file]\n" +
+					"accept [name|file]\n" +
+					"history [name|file]\n" +
+					"rollback [name|file] [generation]\n" +
+					"mem [on|off|threshold [bytes]]\n" +
 					"icmpInterval [milliseconds]\n" +
-					"interval [milliseconds]\n" +
+					"interval [name|file] [milliseconds|default]\n" +
+					"schedule [priority|jitter|add|remove] [value]\n" +
 					"ipchairs\n" +
 					"quiet\n" +
 					"verbose\n" +
 					"upkeep [on|off]\n" +
 					"perms [on|off]\n" +
+					"watch [on|off]\n" +
+					"workers [n]\n" +
+					"timing [on|off]\n" +
+					"rehash [n]\n" +
+					"forensics [list|view [n]]\n" +
+					"diff [on|off]\n" +
+					"lockdown [on|off]\n" +
+					"flapping [threshold|window|interval|actions] [value]\n" +
+					"unlock [name|file]\n" +
+					"policy [name|file] [restore|alert|perms|content]\n" +
+					"reload [auto [on|off]]\n" +
+					"validate [file]\n" +
+					"save [path|auto [on|off]]\n" +
+					"settings [name] [value]\n" +
 					"help\n" +
 					"exit\n",
 			)
@@ -182,43 +296,65 @@ func InputCommand() {
 			for _, service := range master.Services {
 				fmt.Printf("(%s)\n", service.Name)
 				for _, name := range serviceNames {
-					fmt.Printf("%s: %s\n", name, service.getAttr(name).Path)
+					fmt.Printf("%s: %s%s\n", name, service.getAttr(name).Path, service.getAttr(name).StatusTag())
 				}
 				fmt.Println()
 			}
 			Warnf("\n---Directories---\n")
 			for _, dir := range master.Directories {
-				fmt.Printf("(%s)\n", dir.Name)
+				fmt.Printf("(%s) new files: %s\n", dir.Name, dir.NewFiles)
+				if filters := dir.Filters(); filters != "" {
+					fmt.Printf("filters: %s\n", filters)
+				}
 				for _, file := range dir.files {
 					if file.isDir {
 						fmt.Println(file.Path + "/*")
+					} else if file.isLink {
+						fmt.Println(file.Path + " -> " + file.Target + file.StatusTag())
 					} else {
-						fmt.Println(file.Path)
+						fmt.Println(file.Path + file.StatusTag())
 					}
 				}
 				fmt.Println()
 			}
 			Warnf("\n---Files---\n")
 			for _, file := range master.Files {
-				fmt.Printf("%s: %s\n", file.Name, file.Path)
+				if file.isLink {
+					fmt.Printf("%s: %s -> %s%s\n", file.Name, file.Path, file.Target, file.StatusTag())
+				} else {
+					fmt.Printf("%s: %s%s\n", file.Name, file.Path, file.StatusTag())
+				}
 			}
 		case "checksums":
 			PrintChecksums()
 		case "interval":
+			if len(args) == 3 {
+				// The interval of a single object or directory
+				isFreeing.Lock()
+				IntervalCommand(args[1], args[2])
+				isFreeing.Unlock()
+				break
+			}
 			if len(args) != 2 {
 				Errorf("Error: Invalid number of arguments provided\n")
 				break
 			}
 			if args[1] == "default" {
 				config.delay = 1000
+				fmt.Printf("Interval set to %d.\n", config.delay)
+				RequestSweep()
+				break
 			}
 			i, err := strconv.Atoi(args[1])
-			if err != nil {
+			if err != nil || i < 1 {
 				Errorf("Error: Invalid argument\n")
 			} else {
 				config.delay = time.Duration(i)
 				fmt.Printf("Interval set to %d.\n", i)
+				RequestSweep()
 			}
+		case "schedule":
+			ScheduleCommand(args)
 		case "icmpInterval":
 			if len(args) != 2 {
 				Errorf("Error: Invalid number of arguments provided\n")
@@ -240,7 +376,9 @@ func InputCommand() {
 					Errorf("%s: file not found\n", args[2])
 					break
 				}
+				isFreeing.Lock()
 				if CheckName(args[1]) {
+					isFreeing.Unlock()
 					Errorf("Error: %s already exists\n", args[1])
 					break
 				}
@@ -249,46 +387,66 @@ func InputCommand() {
 					Name: args[1],
 					Path: args[2],
 				}
-				if !file.InitSO() {
-					break
+				if file.InitSO() {
+					file.InitBackup()
+					master.Files = append(master.Files, file)
+					fmt.Printf("Added %s\n", args[1])
 				}
-				file.InitBackup()
-				master.Files = append(master.Files, file)
-				fmt.Printf("Added %s\n", args[1])
+				isFreeing.Unlock()
 			} else {
 				Errorf("Error: Wrong number of arguments provided\n")
 			}
 		case "addfolder":
-			if len(args) == 3 {
+			if len(args) >= 3 {
 				// Create the directory object and initialize it
 				newDir := Directory{
-					Name:        args[1],
-					Path:        args[2],
-					isRecursive: true,
+					Name: args[1],
+					Path: args[2],
 				}
-				if !newDir.InitDir() {
-					Errorf("%s: folder not found\n", args[2])
+				// The new file policy can be given on its own, and everything
+				// else as option=value (include, exclude, max_depth, recursive, max_size)
+				valid := true
+				for _, arg := range args[3:] {
+					if contains(newFilesPolicies, arg) {
+						newDir.NewFiles = arg
+					} else if !newDir.ParseOption(arg) {
+						Errorf("Error: invalid option (%s). New file policy must be one of %s\n", arg, strings.Join(newFilesPolicies, ", "))
+						valid = false
+						break
+					}
+				}
+				if !valid {
 					break
 				}
-				master.Directories = append(master.Directories, newDir)
-				fmt.Println("Folder added")
+				isFreeing.Lock()
+				if newDir.InitDir() {
+					master.Directories = append(master.Directories, newDir)
+					fmt.Println("Folder added")
+				} else {
+					Errorf("%s: folder not found\n", args[2])
+				}
+				isFreeing.Unlock()
 			} else {
 				Errorf("Error: Wrong number of arguments provided\n")
 			}
 		case "addservice":
-			if len(args) == 5 {
+			if len(args) == 3 {
+				AddUnitCommand(args[1], args[2])
+			} else if len(args) == 5 {
 				brk := false
 				for _, arg := range args[2:] {
 					if !FileExists(arg) {
 						brk = true
-						Errorf("%s: file not found\n", args[2])
+						Errorf("%s: file not found\n", arg)
 						break
 					}
 				}
 				if brk {
 					break
 				}
+				isFreeing.Lock()
 				if CheckName(args[1]) {
+					isFreeing.Unlock()
 					Errorf("Error: %s already exists\n", args[1])
 					break
 				}
@@ -309,15 +467,16 @@ func InputCommand() {
 					Service: &service,
 					Config:  &config,
 				}
-				if !serv.Init() {
+				if serv.Init() {
+					for _, name := range serviceNames {
+						serv.getAttr(name).InitBackup()
+					}
+					master.Services = append(master.Services, serv)
+					fmt.Printf("Added %s\n", args[1])
+				} else {
 					Errorf("Error: Couldn't initialize service\n")
-					break
 				}
-				for _, name := range serviceNames {
-					serv.getAttr(name).InitBackup()
-				}
-				master.Services = append(master.Services, serv)
-				fmt.Printf("Added %s\n", args[1])
+				isFreeing.Unlock()
 			} else {
 				Errorf("Error: Wrong number of arguments provided\n")
 			}
@@ -326,6 +485,7 @@ func InputCommand() {
 				var removeList []int
 				var fileRemoveList []int
 				var dirRemoveList []int
+				isFreeing.Lock()
 				// Create a list for each type of object containing
 				// which objects should be removed, then remove
 				// them all at the end.
@@ -334,6 +494,7 @@ func InputCommand() {
 						for e, service := range master.Services {
 							if service.Name == arg {
 								removeList = append(removeList, e)
+								freedNames = append(freedNames, service.Name)
 								fmt.Printf("Removed %s\n", arg)
 								break
 							}
@@ -341,6 +502,7 @@ func InputCommand() {
 						for e, file := range master.Files {
 							if file.Name == arg || file.Path == arg {
 								fileRemoveList = append(fileRemoveList, e)
+								freedNames = append(freedNames, file.Name)
 								fmt.Printf("Removed %s\n", arg)
 								break
 							}
@@ -348,6 +510,7 @@ func InputCommand() {
 						for e, dir := range master.Directories {
 							if dir.Name == arg || dir.Path == arg {
 								dirRemoveList = append(dirRemoveList, e)
+								freedNames = append(freedNames, dir.Name)
 								fmt.Printf("Removed %s\n", arg)
 								break
 							}
@@ -356,6 +519,10 @@ func InputCommand() {
 						Warnf("%s does not exist\n", arg)
 					}
 				}
+				// Remove from the back so the other indexes don't move
+				sort.Sort(sort.Reverse(sort.IntSlice(removeList)))
+				sort.Sort(sort.Reverse(sort.IntSlice(fileRemoveList)))
+				sort.Sort(sort.Reverse(sort.IntSlice(dirRemoveList)))
 				for _, i := range removeList {
 					master.Services = removeService(master.Services, i)
 				}
@@ -365,9 +532,34 @@ func InputCommand() {
 				for _, i := range dirRemoveList {
 					master.Directories = removeDirectory(master.Directories, i)
 				}
+				isFreeing.Unlock()
 			} else {
 				Errorf("Error: Not enough arguments\n")
 			}
+		case "accept":
+			if len(args) < 2 {
+				Errorf("Error: Not enough arguments\n")
+				break
+			}
+			isFreeing.Lock()
+			for _, arg := range args[1:] {
+				AcceptCommand(arg)
+			}
+			isFreeing.Unlock()
+		case "mem":
+			MemCommand(args)
+		case "policy":
+			isFreeing.Lock()
+			PolicyCommand(args)
+			isFreeing.Unlock()
+		case "history":
+			isFreeing.Lock()
+			HistoryCommand(args)
+			isFreeing.Unlock()
+		case "rollback":
+			isFreeing.Lock()
+			RollbackCommand(args)
+			isFreeing.Unlock()
 		case "upkeep":
 			if len(args) != 2 {
 				Errorf("Error: invalid number of arguments\n")
@@ -394,10 +586,196 @@ func InputCommand() {
 			default:
 				Errorf("Error: invalid argument")
 			}
+		case "settings":
+			SettingsCommand(args)
+		case "save":
+			SaveCommand(args)
+		case "validate":
+			file := config.configFile
+			if len(args) > 1 {
+				file = args[1]
+			}
+			ValidateConfig(file)
+		case "reload":
+			if len(args) == 1 {
+				ReloadConfig()
+				break
+			}
+			if args[1] != "auto" || len(args) > 3 {
+				Errorf("Error: invalid argument\n")
+				break
+			}
+			if len(args) == 2 {
+				if config.autoReload {
+					fmt.Printf("%s is reloaded whenever it changes.\n", config.configFile)
+				} else {
+					fmt.Printf("%s is only reloaded on SIGHUP or the reload command.\n", config.configFile)
+				}
+				break
+			}
+			switch args[2] {
+			case "on":
+				config.autoReload = true
+			case "off":
+				config.autoReload = false
+			default:
+				Errorf("Error: invalid argument\n")
+			}
+		case "watch":
+			if len(args) == 1 {
+				watcher.PrintStatus()
+				attributor.PrintStatus()
+				break
+			}
+			switch args[1] {
+			case "on":
+				config.watch = true
+				if !watcher.Enabled() {
+					InitWatcher()
+				}
+			case "off":
+				config.watch = false
+			default:
+				Errorf("Error: invalid argument\n")
+			}
+		case "workers":
+			if len(args) == 1 {
+				fmt.Printf("Using %d workers.\n", config.workers)
+				break
+			}
+			if args[1] == "default" {
+				config.workers = runtime.NumCPU()
+				fmt.Printf("Workers set to %d.\n", config.workers)
+				break
+			}
+			i, err := strconv.Atoi(args[1])
+			if err != nil || i < 1 {
+				Errorf("Error: Invalid argument\n")
+			} else {
+				config.workers = i
+				fmt.Printf("Workers set to %d.\n", i)
+			}
+		case "timing":
+			if len(args) == 1 {
+				PrintLastSweep()
+				break
+			}
+			switch args[1] {
+			case "on":
+				config.timing = true
+			case "off":
+				config.timing = false
+			default:
+				Errorf("Error: invalid argument\n")
+			}
+		case "rehash":
+			if len(args) == 1 {
+				fmt.Printf("Unchanged files are fully rehashed every %d checks.\n", config.rehashEvery)
+				break
+			}
+			if args[1] == "default" {
+				config.rehashEvery = 10
+				fmt.Printf("Rehash set to %d.\n", config.rehashEvery)
+				break
+			}
+			i, err := strconv.Atoi(args[1])
+			if err != nil || i < 0 {
+				Errorf("Error: Invalid argument\n")
+			} else {
+				config.rehashEvery = i
+				fmt.Printf("Rehash set to %d.\n", i)
+			}
+		case "forensics":
+			ForensicsCommand(args)
+		case "flapping":
+			if len(args) == 1 {
+				PrintFlapping()
+				break
+			}
+			if len(args) != 3 {
+				Errorf("Error: invalid number of arguments\n")
+				break
+			}
+			if args[1] == "actions" {
+				actions, ok := ParseFlapActions(args[2])
+				if !ok {
+					Errorf("Error: actions must be a comma separated list of %s\n", strings.Join(flapActions, ", "))
+					break
+				}
+				config.flapActions = actions
+				break
+			}
+			i, err := strconv.Atoi(args[2])
+			if err != nil || i < 0 {
+				Errorf("Error: Invalid argument\n")
+				break
+			}
+			switch args[1] {
+			case "threshold":
+				config.flapThreshold = i
+			case "window":
+				config.flapWindow = time.Duration(i)
+			case "interval":
+				config.flapDelay = time.Duration(i)
+			default:
+				Errorf("Error: invalid argument\n")
+			}
+		case "unlock":
+			if len(args) != 2 {
+				Errorf("Error: invalid number of arguments\n")
+				break
+			}
+			isFreeing.Lock()
+			objs := FindObjects(args[1])
+			for _, obj := range objs {
+				if obj.locked {
+					obj.locked = false
+					obj.applyFlags()
+					fmt.Printf("Unlocked %s\n", obj.Path)
+				}
+			}
+			isFreeing.Unlock()
+			if len(objs) == 0 {
+				Warnf("%s does not exist\n", args[1])
+			}
+		case "lockdown":
+			if len(args) != 2 {
+				Errorf("Error: invalid number of arguments\n")
+				break
+			}
+			// Files are locked (or unlocked) on the next permissions check
+			switch args[1] {
+			case "on":
+				config.lockdown = true
+			case "off":
+				config.lockdown = false
+			default:
+				Errorf("Error: invalid argument\n")
+			}
+		case "diff":
+			if len(args) != 2 {
+				Errorf("Error: invalid number of arguments\n")
+				break
+			}
+			switch args[1] {
+			case "on":
+				config.showDiff = true
+			case "off":
+				config.showDiff = false
+			default:
+				Errorf("Error: invalid argument\n")
+			}
 		case "":
 		default:
 			Errorf("Unknown command\n")
 		}
+		// Pick up any paths that were added or freed
+		watcher.Sync()
+		attributor.Sync()
+		MarkConsoleSettings(before)
+		if config.autoSave && contains(configCommands, args[0]) {
+			SaveConfig(config.configFile)
+		}
 		caret()
 	}
 }
@@ -406,126 +784,212 @@ func InputCommand() {
 func PrintChecksums() {
 	Warnf("---Services---\n")
 	for _, service := range master.Services {
-		fmt.Printf("(%s)\nConfig checksum: %s\nBinary checksum: %s\nService checksum: %s\n\n", service.Name, service.Config.Checksum, service.Binary.Checksum, service.Service.Checksum)
+		fmt.Printf(
+			"(%s)\nConfig checksum: %s%s\nBinary checksum: %s%s\nService checksum: %s%s\n\n",
+			service.Name,
+			service.Config.Checksum, service.Config.StatusTag(),
+			service.Binary.Checksum, service.Binary.StatusTag(),
+			service.Service.Checksum, service.Service.StatusTag(),
+		)
 	}
 	Warnf("---Files nested in directories---\n")
 	for _, dir := range master.Directories {
 		for _, file := range dir.files {
 			if !file.isDir {
-				fmt.Printf("%s: %s\n", file.Path, file.Checksum)
+				fmt.Printf("%s: %s%s\n", file.Path, file.Checksum, file.StatusTag())
 			}
 		}
 	}
 	Warnf("\n---Files---\n")
 	for _, file := range master.Files {
-		fmt.Printf("%s: %s\n", file.Path, file.Checksum)
+		fmt.Printf("%s: %s%s\n", file.Path, file.Checksum, file.StatusTag())
 	}
 }
 
-// Main run function for bandaid
+// Main run function for bandaid. Each pass checks whichever objects are
+// due, and every config.delay ms (config.safetyDelay while inotify is
+// active) it also keeps services running and looks for new files.
 func RunBandaid() {
+	// Checks between two full passes are reported together as one sweep
+	sweep := SweepStats{start: time.Now()}
+	var nextFull time.Time
+	all := true
 	for {
-		// Keep a record of whether or not any changes were made
-		change := false
+		start := time.Now()
+		// Keep a record of whether or not any output was printed.
+		// Restores of flapping objects are silent.
+		printed := false
+		changes := 0
 		// Lock the mutex to make sure we don't read files while they're being freed
 		isFreeing.Lock()
-		for _, service := range master.Services {
-			for _, name := range serviceNames {
-				// First check each file's checksum. This also checks for file deletions
-				if !service.getAttr(name).CheckFile() {
-					if config.outputEnabled {
-						fmt.Printf("\nError on checksum for %s %s. Rewriting...\n", service.Name, strings.ToLower(name))
-						if service.getAttr(name).writeBackup() {
-							fmt.Println("Backup succeeded.")
-						} else {
-							fmt.Println("Backup failed.")
-						}
-					} else {
-						service.getAttr(name).writeBackup()
-					}
-					change = true
-					// If the checksum was fine, also check the permissions (if enabled)
-				} else if !service.getAttr(name).CheckPerms() && config.checkPerms {
-					if service.getAttr(name).WritePerms() {
-						fmt.Println("Permissions restored.")
-					} else {
-						fmt.Println("Error restoring permissions.")
-					}
-					change = true
-				}
-			}
-			if config.upkeep {
-				// Get the service name using the path
-				serv := GetTail(service.Service.Path, "/")
-				// Check to see if the service is running; if not, restart
-				if !CheckCtl(serv) {
-					fmt.Printf("\nService %s has stopped. Restarting...\n", service.Name)
-					cmd := exec.Command("systemctl", "start", serv)
-					cmd.Run()
-					change = true
-				}
+		full := all || !nextFull.After(start)
+		// Hash everything that's due concurrently first, then handle
+		// the results in order so that output isn't interleaved
+		jobs := CollectDueJobs(start, all)
+		workers := VerifyAll(jobs)
+		verified := time.Now()
+		for _, job := range jobs {
+			verbose := job.obj.verbose()
+			if HandleResult(job.obj, job.label, job.ok) {
+				changes++
+				printed = printed || verbose
 			}
+			// Scheduled after handling, so an object that just started
+			// flapping is already on the faster interval
+			job.obj.Reschedule(time.Now())
 		}
-
-		// Next, check all files
-		for _, file := range master.Files {
-			if !file.CheckFile() {
-				if config.outputEnabled {
-					fmt.Printf("\nError on checksum for %s (%s). Rewriting...\n", file.Name, file.Path)
-					if file.writeBackup() {
-						fmt.Println("Backup succeeded.")
-					} else {
-						fmt.Println("Backup failed.")
+		if full {
+			if config.upkeep {
+				for _, service := range master.Services {
+					// Get the service name using the path
+					serv := GetTail(service.Service.Path, "/")
+					// Check to see if the service is running; if not, restart
+					if !CheckCtl(serv) {
+						fmt.Printf("\nService %s has stopped. Restarting...\n", service.Name)
+						cmd := exec.Command("systemctl", "start", serv)
+						cmd.Run()
+						changes++
+						printed = true
 					}
-				} else {
-					file.writeBackup()
 				}
-				change = true
-			} else if !file.CheckPerms() && config.checkPerms {
-				if file.WritePerms() {
-					fmt.Println("Permissions restored.")
-				} else {
-					fmt.Println("Error restoring permissions.")
-				}
-				change = true
 			}
-		}
-
-		// Check every file in each directory (recursively)
-		for _, dir := range master.Directories {
-			// The Directory struct stores each file's path,
-			// so no need to do recursive iteration
-			for _, file := range dir.files {
-				if !file.CheckFile() {
-					if config.outputEnabled {
-						fmt.Printf("\nError on checksum for %s. Rewriting...\n", file.Path)
-						if file.writeBackup() {
-							fmt.Println("Backup succeeded.")
-						} else {
-							fmt.Println("Backup failed.")
-						}
-					} else {
-						file.writeBackup()
-					}
-					change = true
-				} else if !file.CheckPerms() && config.checkPerms {
-					if file.WritePerms() {
-						fmt.Println("Permissions restored.")
-					} else {
-						fmt.Println("Error restoring permissions.")
-					}
-					change = true
+			// Finally, look for anything added to the protected directories
+			for i := range master.Directories {
+				if master.Directories[i].CheckNewFiles() {
+					changes++
+					printed = true
 				}
 			}
+			nextFull = start.Add(Jitter(DefaultInterval()) * time.Millisecond)
 		}
+		next := NextDue(nextFull)
 		// Unlock the mutex
 		isFreeing.Unlock()
+		sweep.objects += len(jobs)
+		sweep.changes += changes
+		if workers > sweep.workers {
+			sweep.workers = workers
+		}
+		sweep.verify += verified.Sub(start)
+		sweep.total += time.Since(start)
 		// If there was a change made, then we need to caret()
 		// because of the change output
-		if change {
+		if printed {
 			caret()
 		}
-		time.Sleep(config.delay * time.Millisecond)
+		if full {
+			sweep.restore = sweep.total - sweep.verify
+			ReportSweep(sweep)
+			sweep = SweepStats{start: time.Now()}
+		}
+		// Re-arm any watches lost to deletions
+		if full || changes > 0 {
+			watcher.Sync()
+			attributor.Sync()
+		}
+		all = false
+		select {
+		case <-time.After(time.Until(next)):
+		case <-sweepNow:
+			all = true
+		case <-wakeScheduler:
+		}
+	}
+}
+
+// Check a single object for modifications and restore it if needed.
+// Returns true if a change was made. The caller must hold isFreeing.
+func CheckObject(obj *ServiceObject, label string) bool {
+	// First check the file's checksum. This also checks for file deletions
+	return HandleResult(obj, label, obj.CheckFile())
+}
+
+// Restore an object given the result of its CheckFile. Returns
+// true if a change was made. The caller must hold isFreeing.
+func HandleResult(obj *ServiceObject, label string, ok bool) bool {
+	// Forget about restores that have fallen out of the flapping window
+	obj.UpdateFlapping(label)
+	if ok {
+		// Back to its baseline, so the next change gets reported again
+		obj.alerted = ""
+		obj.seenStat = fileStat{}
+	}
+	if obj.Policy == policyAlert {
+		// Nothing is restored, so content and permissions are reported separately
+		reported := !ok && obj.AlertChange(label)
+		if obj.checksPerms() {
+			if change := obj.PermsChange(); change != "" {
+				reported = obj.AlertPerms(label, change) || reported
+			} else {
+				obj.alertedPerms = ""
+			}
+		}
+		return reported
+	} else if !ok {
+		attr := attributor.Take(obj.Path)
+		// Keep a copy of red team's version before we overwrite it
+		CaptureForensics(obj, label, "content", attr)
+		if obj.verbose() {
+			fmt.Printf("\nError on checksum for %s. Rewriting...\n", label)
+			if attr != nil {
+				attr.Print()
+			}
+			if config.showDiff {
+				PrintDiff(obj)
+			}
+			if obj.writeBackup() {
+				fmt.Println("Backup succeeded.")
+			} else {
+				fmt.Println("Backup failed.")
+			}
+		} else {
+			obj.writeBackup()
+		}
+		obj.RecordRestore(label, attr)
+		return true
+		// If the checksum was fine, also check the permissions (if enabled)
+	} else if obj.checksPerms() {
+		change := obj.PermsChange()
+		if change == "" {
+			return false
+		}
+		verbose := obj.verbose()
+		if verbose {
+			fmt.Printf("\n%s. Restoring...\n", change)
+		}
+		attr := attributor.Take(obj.Path)
+		CaptureForensics(obj, label, "perms", attr)
+		if verbose && attr != nil {
+			attr.Print()
+		}
+		if obj.WritePerms() {
+			if verbose {
+				fmt.Println("Permissions restored.")
+			}
+		} else if verbose {
+			fmt.Println("Error restoring permissions.")
+		}
+		obj.RecordRestore(label, attr)
+		return true
+	}
+	return false
+}
+
+// Call fn for every protected object in master, along with the
+// label used for it in output. The caller must hold isFreeing.
+func ForEachObject(fn func(obj *ServiceObject, label string)) {
+	for _, service := range master.Services {
+		for _, name := range serviceNames {
+			fn(service.getAttr(name), service.Name+" "+strings.ToLower(name))
+		}
+	}
+	for i := range master.Files {
+		fn(&master.Files[i], fmt.Sprintf("%s (%s)", master.Files[i].Name, master.Files[i].Path))
+	}
+	for _, dir := range master.Directories {
+		for _, file := range dir.files {
+			fn(file, file.Path)
+		}
 	}
 }
 
@@ -564,6 +1028,53 @@ func InitBackups() {
 	}
 }
 
+// Parse the contents of a config file, checking for anything that
+// would stop it from loading. Returns every problem that was found.
+func ParseConfig(configBytes []byte) (Services, []string) {
+	var parsed Services
+	if err := json.Unmarshal(configBytes, &parsed); err != nil {
+		return parsed, []string{JSONError(configBytes, err)}
+	}
+	return parsed, CheckConfig(parsed)
+}
+
+// Check a parsed config for names and paths that would stop it from loading
+func CheckConfig(parsed Services) []string {
+	var problems []string
+	var names []string
+	checkName := func(name string, kind string) {
+		if name == "" {
+			problems = append(problems, fmt.Sprintf("%s with no name", kind))
+		} else if contains(names, name) {
+			problems = append(problems, fmt.Sprintf("Duplicate name (%s)", name))
+		} else {
+			names = append(names, name)
+		}
+	}
+	for _, service := range parsed.Services {
+		checkName(service.Name, "Service")
+		// locations isn't set up until the service is initialized
+		for i, obj := range []*ServiceObject{service.Binary, service.Service, service.Config} {
+			if obj == nil || obj.Path == "" {
+				problems = append(problems, fmt.Sprintf("Service %s has no %s path", service.Name, strings.ToLower(serviceNames[i])))
+			}
+		}
+	}
+	for _, file := range parsed.Files {
+		checkName(file.Name, "File")
+		if file.Path == "" {
+			problems = append(problems, fmt.Sprintf("File %s has no path", file.Name))
+		}
+	}
+	for _, dir := range parsed.Directories {
+		checkName(dir.Name, "Directory")
+		if dir.Path == "" {
+			problems = append(problems, fmt.Sprintf("Directory %s has no path", dir.Name))
+		}
+	}
+	return problems
+}
+
 // Initialize the global config
 func InitConfig() Services {
 	configFile, err := os.Open(config.configFile)
@@ -583,9 +1094,13 @@ func InitConfig() Services {
 		configBytes, _ = ioutil.ReadAll(configFile)
 		defer configFile.Close()
 	}
-	var names []string
-	var master Services
-	json.Unmarshal(configBytes, &master)
+	master, problems := ParseConfig(configBytes)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			Errorf("Config error: %s\n", problem)
+		}
+		os.Exit(-1)
+	}
 	// Create a list of services, files and directories to not include
 	var removeList []int
 	var fileRemoveList []int
@@ -594,33 +1109,16 @@ func InitConfig() Services {
 	for i := range master.Services {
 		if !master.Services[i].Init() {
 			removeList = append(removeList, i)
-		} else if contains(names, master.Services[i].Name) {
-			fmt.Printf("Config error: Duplicate name (%s)\n", master.Services[i].Name)
-			os.Exit(-1)
-		} else {
-			names = append(names, master.Services[i].Name)
 		}
 	}
 	for i := range master.Files {
 		if !master.Files[i].InitSO() {
 			fileRemoveList = append(fileRemoveList, i)
-		} else if contains(names, master.Files[i].Name) {
-			Errorf("Config error: Duplicate name (%s)\n", master.Files[i].Name)
-			os.Exit(-1)
-		} else {
-			names = append(names, master.Files[i].Name)
 		}
 	}
 	for i := range master.Directories {
-		if contains(names, master.Directories[i].Name) {
-			Errorf("Config error: Duplicate name (%s)\n", master.Directories[i].Name)
-			os.Exit(-1)
-		} else {
-			if master.Directories[i].InitDir() {
-				names = append(names, master.Directories[i].Name)
-			} else {
-				dirRemoveList = append(dirRemoveList, i)
-			}
+		if !master.Directories[i].InitDir() {
+			dirRemoveList = append(dirRemoveList, i)
 		}
 	}
 
@@ -694,6 +1192,73 @@ func CheckName(name string) bool {
 	return exists
 }
 
+// Make the current state of a service, file or directory (or a single
+// file in a directory) its new baseline. The caller must hold isFreeing.
+func AcceptCommand(arg string) {
+	for i := range master.Directories {
+		dir := &master.Directories[i]
+		if dir.Name == arg || dir.Path == filepath.Clean(arg) {
+			accepted, added, removed := dir.Accept()
+			fmt.Printf("Accepted %d files in %s (%d added, %d removed)\n", accepted, dir.Name, added, removed)
+			return
+		}
+	}
+	objs := FindObjects(arg)
+	if len(objs) == 0 {
+		// A new file in a protected directory joins its baseline
+		path, _ := filepath.Abs(arg)
+		for i := range master.Directories {
+			if master.Directories[i].Adopt(path) {
+				fmt.Printf("Added %s to %s\n", arg, master.Directories[i].Name)
+				return
+			}
+		}
+		Warnf("%s does not exist\n", arg)
+		return
+	}
+	for _, obj := range objs {
+		if obj.Accept() {
+			fmt.Printf("Accepted %s\n", obj.Path)
+		} else {
+			Errorf("Error: could not accept %s\n", obj.Path)
+		}
+	}
+}
+
+// Find every object matching a name or path: all three files of a
+// service, a single file, every file in a directory, or any protected
+// file by its path. The caller must hold isFreeing.
+func FindObjects(arg string) []*ServiceObject {
+	var objs []*ServiceObject
+	for _, service := range master.Services {
+		if service.Name == arg {
+			for _, name := range serviceNames {
+				objs = append(objs, service.getAttr(name))
+			}
+		}
+	}
+	for i := range master.Files {
+		if master.Files[i].Name == arg || master.Files[i].Path == arg {
+			objs = append(objs, &master.Files[i])
+		}
+	}
+	for _, dir := range master.Directories {
+		if dir.Name == arg || dir.Path == arg {
+			objs = append(objs, dir.files...)
+		}
+	}
+	if len(objs) > 0 {
+		return objs
+	}
+	// Fall back to matching service members and directory contents by path
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if obj.Path == arg {
+			objs = append(objs, obj)
+		}
+	})
+	return objs
+}
+
 // Check to see if a file's path already exists in the global master
 func CheckPath(path string) bool {
 	exists := false
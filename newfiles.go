@@ -0,0 +1,245 @@
+/*
+newfiles.go- Detection of files and folders that show up
+inside a protected directory after it was added, i.e. a
+webshell dropped into /var/www/html
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Policies for new files in a protected directory
+const (
+	newFilesAlert      = "alert"      // Only report the new file
+	newFilesQuarantine = "quarantine" // Move the new file into the backup store
+	newFilesDelete     = "delete"     // Delete the new file
+)
+
+// The most of a single file that's kept in quarantine
+const quarantineMaxSize = 16 << 20
+
+var newFilesPolicies []string = []string{
+	newFilesAlert,
+	newFilesQuarantine,
+	newFilesDelete,
+}
+
+// Walk a protected directory and return every path that isn't
+// part of its snapshot. New folders are returned as a whole
+// rather than descending into them, and anything outside the
+// directory's filters is ignored.
+func (a *Directory) FindNewFiles() []string {
+	var found []string
+	var walk func(path string)
+	walk = func(path string) {
+		items, _ := ioutil.ReadDir(path)
+		for _, item := range items {
+			subPath := ConcatenatePath(path, item.Name())
+			if !a.InScope(subPath, item) {
+				continue
+			}
+			if !a.known[subPath] {
+				found = append(found, subPath)
+			} else if item.IsDir() {
+				walk(subPath)
+			}
+		}
+	}
+	walk(a.Path)
+	return found
+}
+
+// Find and handle new files according to the directory's policy.
+// Returns true if anything was printed. The caller must hold isFreeing.
+func (a *Directory) CheckNewFiles() bool {
+	found := a.FindNewFiles()
+	change := false
+	alerted := map[string]bool{}
+	for _, path := range found {
+		if a.HandleNewFile(path) {
+			change = true
+		}
+		if a.alerted[path] {
+			alerted[path] = true
+		}
+	}
+	// Forget about alerted files that have since been removed
+	a.alerted = alerted
+	return change
+}
+
+// Handle a single new file according to the directory's policy.
+// Returns true if anything was printed. The caller must hold isFreeing.
+func (a *Directory) HandleNewFile(path string) bool {
+	if a.known[path] || a.alerted[path] {
+		return false
+	}
+	stat, err := os.Lstat(path)
+	if err != nil {
+		// Already gone
+		return false
+	}
+	// The watcher hands us every new path, filtered or not
+	if !a.InScope(path, stat) {
+		return false
+	}
+	owner := "unknown"
+	if inf, ok := stat.Sys().(*syscall.Stat_t); ok {
+		owner = LookupUser(int(inf.Uid))
+	}
+	kind := "file"
+	if stat.IsDir() {
+		kind = "folder"
+	}
+	if config.outputEnabled {
+		Warnf("\nNew %s in %s: %s (owner %s, mode %s)\n", kind, a.Name, path, owner, stat.Mode())
+		if attr := attributor.Take(path); attr != nil {
+			attr.Print()
+		}
+	}
+	switch a.NewFiles {
+	case newFilesQuarantine:
+		if Quarantine(path) {
+			if config.outputEnabled {
+				fmt.Printf("Quarantined %s.\n", path)
+			}
+		} else {
+			// It's left where it is, so don't try again on every check
+			Errorf("Error quarantining %s. Leaving it in place.\n", path)
+			a.markAlerted(path)
+		}
+	case newFilesDelete:
+		UnblockTree(path)
+		if err := os.RemoveAll(path); err == nil {
+			if config.outputEnabled {
+				fmt.Printf("Deleted %s.\n", path)
+			}
+		} else {
+			Errorf("Error deleting %s: %v\n", path, err)
+			a.markAlerted(path)
+		}
+	default:
+		// Only report each new file once
+		a.markAlerted(path)
+	}
+	return config.outputEnabled
+}
+
+// Remember that a new file was reported and left in place
+func (a *Directory) markAlerted(path string) {
+	if a.alerted == nil {
+		a.alerted = map[string]bool{}
+	}
+	a.alerted[path] = true
+}
+
+// Move a file (or every file in a folder) into the quarantine area
+// of the backup store, encrypted if encryption is enabled. Only regular
+// files are read, and only up to quarantineMaxSize. Links and special
+// files (i.e. a FIFO, which would block the read) are recorded by what
+// they are instead.
+func Quarantine(path string) bool {
+	folder := ConcatenatePath(config.backupLocation, "quarantine")
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return false
+	}
+	stamp := time.Now().Format("20060102-150405")
+	ok := true
+	filepath.WalkDir(path, func(sub string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		// WalkDir doesn't follow links, so this is the entry itself
+		stat, err := d.Info()
+		if err != nil {
+			ok = false
+			return nil
+		}
+		var contents []byte
+		suffix := ""
+		switch {
+		case stat.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(sub)
+			contents = []byte(fmt.Sprintf("%s -> %s\n", stat.Mode(), target))
+			suffix = ".info"
+		case !stat.Mode().IsRegular():
+			contents = []byte(fmt.Sprintf("%s (not read)\n", stat.Mode()))
+			suffix = ".info"
+		default:
+			var truncated bool
+			contents, truncated, err = readQuarantined(sub)
+			if err != nil {
+				ok = false
+				return nil
+			}
+			if truncated {
+				suffix = ".truncated"
+			}
+		}
+		if config.doEncryption {
+			contents = encrypt(contents, config.key)
+		}
+		// Name the sample after its original path, the same way backups are
+		name := stamp + "_" + strings.TrimPrefix(GetConfigName(sub), config.backupLocation+"/") + suffix
+		dest := ConcatenatePath(folder, name)
+		if !writeFile(dest, contents) {
+			ok = false
+		}
+		// Make sure nothing in quarantine can be executed
+		os.Chmod(dest, 0600)
+		return nil
+	})
+	if !ok {
+		return false
+	}
+	UnblockTree(path)
+	return os.RemoveAll(path) == nil
+}
+
+// Read a regular file for quarantine, up to quarantineMaxSize. The file
+// is opened without following links or blocking, and checked again once
+// it's open in case it was swapped for something else. Returns true if
+// the contents were cut off.
+func readQuarantined(path string) ([]byte, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !stat.Mode().IsRegular() {
+		return []byte(fmt.Sprintf("%s (not read)\n", stat.Mode())), false, nil
+	}
+	// Read one byte past the cap so we know if it was truncated
+	contents, err := ioutil.ReadAll(io.LimitReader(f, quarantineMaxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(contents) > quarantineMaxSize {
+		return contents[:quarantineMaxSize], true, nil
+	}
+	return contents, false, nil
+}
+
+// Get the username for a uid, falling back to the uid itself
+func LookupUser(uid int) string {
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	dir := tempBackupFolder(t)
+	config.doEncryption = false
+	drop := filepath.Join(dir, "drop")
+	os.MkdirAll(drop, 0755)
+	ioutil.WriteFile(filepath.Join(drop, "shell.php"), []byte("<?php system($_GET['c']); ?>"), 0644)
+	if err := syscall.Mkfifo(filepath.Join(drop, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("/dev/zero", filepath.Join(drop, "zero"))
+	os.Symlink(filepath.Join(dir, "nowhere"), filepath.Join(drop, "dangling"))
+
+	done := make(chan bool)
+	go func() { done <- Quarantine(drop) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("Quarantine failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Quarantine blocked")
+	}
+	if FileExists(drop) {
+		t.Errorf("%s is still there", drop)
+	}
+	items, _ := ioutil.ReadDir(ConcatenatePath(config.backupLocation, "quarantine"))
+	samples := map[string]string{}
+	for _, item := range items {
+		contents, _ := ioutil.ReadFile(ConcatenatePath(ConcatenatePath(config.backupLocation, "quarantine"), item.Name()))
+		// Samples are named <stamp>_<backup name>
+		name := item.Name()[strings.Index(item.Name(), "_")+1:]
+		samples[name] = string(contents)
+	}
+	sample := func(name string, suffix string) string {
+		return strings.TrimPrefix(GetConfigName(filepath.Join(drop, name)), config.backupLocation+"/") + suffix
+	}
+	if got := samples[sample("shell.php", "")]; got != "<?php system($_GET['c']); ?>" {
+		t.Errorf("shell.php sample is %q", got)
+	}
+	if got := samples[sample("zero", ".info")]; !strings.HasSuffix(got, "-> /dev/zero\n") {
+		t.Errorf("zero sample is %q, want the link's target", got)
+	}
+	if got := samples[sample("dangling", ".info")]; !strings.Contains(got, "nowhere") {
+		t.Errorf("dangling sample is %q, want the link's target", got)
+	}
+	if got := samples[sample("fifo", ".info")]; !strings.HasPrefix(got, "p") {
+		t.Errorf("fifo sample is %q, want its mode", got)
+	}
+	if len(samples) != 4 {
+		t.Errorf("got %d samples, want 4", len(samples))
+	}
+}
+
+func TestQuarantineTruncates(t *testing.T) {
+	dir := tempBackupFolder(t)
+	config.doEncryption = false
+	big := filepath.Join(dir, "big")
+	f, _ := os.Create(big)
+	f.Truncate(quarantineMaxSize + 10)
+	f.Close()
+	if !Quarantine(big) {
+		t.Fatalf("Quarantine failed")
+	}
+	items, _ := ioutil.ReadDir(ConcatenatePath(config.backupLocation, "quarantine"))
+	if len(items) != 1 || !strings.HasSuffix(items[0].Name(), ".truncated") || items[0].Size() != quarantineMaxSize {
+		t.Errorf("got %v, want one truncated sample of %d bytes", items, quarantineMaxSize)
+	}
+}
+
+func TestFailedQuarantineIsOnlyReportedOnce(t *testing.T) {
+	dir := tempBackupFolder(t)
+	saved := colors
+	colors = Colors{}
+	defer func() { colors = saved }()
+	// Nothing can be written to the quarantine folder
+	os.RemoveAll(config.backupLocation)
+	ioutil.WriteFile(config.backupLocation, nil, 0600)
+	path := filepath.Join(dir, "new")
+	ioutil.WriteFile(path, []byte("x"), 0644)
+	d := &Directory{Name: "files", Path: dir, NewFiles: newFilesQuarantine}
+	d.HandleNewFile(path)
+	if !FileExists(path) || !d.alerted[path] {
+		t.Fatalf("a file that couldn't be quarantined should be left and remembered")
+	}
+	if d.HandleNewFile(path) {
+		t.Errorf("the failure was reported again")
+	}
+	// It's forgotten once it's gone, so a new file there is handled again
+	os.Remove(path)
+	d.CheckNewFiles()
+	if d.alerted[path] {
+		t.Errorf("a removed file is still remembered")
+	}
+}
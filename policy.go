@@ -0,0 +1,161 @@
+/*
+policy.go- What bandaid does when a protected object changes.
+By default everything is restored, but volatile files can be
+monitored without touching them (alert), or only have part of
+their state enforced (perms or content).
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Enforcement policies for protected objects
+const (
+	policyRestore = "restore" // Restore any change
+	policyAlert   = "alert"   // Report changes, but leave the file alone
+	policyPerms   = "perms"   // Enforce mode, owner, flags and xattrs, but allow content changes
+	policyContent = "content" // Enforce the contents, but allow permission changes
+)
+
+var policies []string = []string{
+	policyRestore,
+	policyAlert,
+	policyPerms,
+	policyContent,
+}
+
+// Check if changes to an object's contents are acted on
+func (a *ServiceObject) checksContent() bool {
+	return a.Policy != policyPerms
+}
+
+// Check if changes to an object's permissions are acted on
+func (a *ServiceObject) checksPerms() bool {
+	return config.checkPerms && a.Policy != policyContent
+}
+
+// Fill in the default policy, or replace an invalid one
+func (a *ServiceObject) CheckPolicy(label string) {
+	if a.Policy == "" {
+		a.Policy = policyRestore
+	} else if !contains(policies, a.Policy) {
+		Warnf("Invalid policy (%s) for %s. Using %s.\n", a.Policy, label, policyRestore)
+		a.Policy = policyRestore
+	}
+}
+
+// Change an object's policy. Changes that were only reported
+// are forgotten, so they're acted on under the new policy.
+func (a *ServiceObject) SetPolicy(policy string) {
+	a.Policy = policy
+	a.alerted = ""
+	a.alertedPerms = ""
+	a.seenStat = fileStat{}
+	a.stat = fileStat{}
+}
+
+// Report a content change to an object under the alert policy. Each
+// change is only reported once. Returns true if it was reported.
+// The caller must hold isFreeing.
+func (a *ServiceObject) AlertChange(label string) bool {
+	if a.seen == a.alerted {
+		return false
+	}
+	a.alerted = a.seen
+	attr := attributor.Take(a.Path)
+	CaptureForensics(a, label, "content", attr)
+	if !a.verbose() {
+		return true
+	}
+	switch a.seen {
+	case "deleted":
+		Warnf("\n%s was deleted (alert only, not restoring)\n", label)
+	case "type":
+		Warnf("\n%s was replaced (alert only, not restoring)\n", label)
+	default:
+		Warnf("\n%s was modified (alert only, not restoring)\n", label)
+	}
+	if attr != nil {
+		attr.Print()
+	}
+	if config.showDiff && a.seen != "deleted" {
+		PrintDiff(a)
+	}
+	return true
+}
+
+// Report a permission change to an object under the alert policy,
+// once per change. Returns true if it was reported.
+func (a *ServiceObject) AlertPerms(label string, change string) bool {
+	if change == a.alertedPerms {
+		return false
+	}
+	a.alertedPerms = change
+	attr := attributor.Take(a.Path)
+	CaptureForensics(a, label, "perms", attr)
+	if a.verbose() {
+		Warnf("\n%s (alert only, not restoring)\n", change)
+		if attr != nil {
+			attr.Print()
+		}
+	}
+	return true
+}
+
+// Handle the policy REPL command. The caller must hold isFreeing.
+func PolicyCommand(args []string) {
+	if len(args) == 1 {
+		// Everything that isn't simply restored
+		for _, dir := range master.Directories {
+			if dir.Policy != policyRestore {
+				fmt.Printf("%s/*: %s\n", dir.Path, dir.Policy)
+			}
+		}
+		ForEachObject(func(obj *ServiceObject, label string) {
+			if obj.Policy != policyRestore {
+				fmt.Printf("%s: %s\n", label, obj.Policy)
+			}
+		})
+		return
+	}
+	if len(args) == 3 && !contains(policies, args[2]) {
+		Errorf("Error: policy must be one of %s\n", strings.Join(policies, ", "))
+		return
+	} else if len(args) > 3 {
+		Errorf("Error: invalid number of arguments\n")
+		return
+	}
+	// A directory's policy also covers files added to it later
+	for i := range master.Directories {
+		dir := &master.Directories[i]
+		if dir.Name == args[1] || dir.Path == filepath.Clean(args[1]) {
+			if len(args) == 3 {
+				dir.Policy = args[2]
+				dir.ApplyOptions()
+				RequestSweep()
+			}
+			fmt.Printf("%s: %s\n", dir.Name, dir.Policy)
+			return
+		}
+	}
+	objs := FindObjects(args[1])
+	if len(objs) == 0 {
+		Warnf("%s does not exist\n", args[1])
+		return
+	}
+	for _, obj := range objs {
+		if len(args) == 3 {
+			obj.SetPolicy(args[2])
+			obj.ownPolicy = true
+		}
+		fmt.Printf("%s: %s\n", obj.Path, obj.Policy)
+	}
+	// Anything that was only being reported may need restoring now
+	if len(args) == 3 {
+		RequestSweep()
+	}
+}
@@ -0,0 +1,166 @@
+/*
+procs.go- Helpers for finding and describing processes
+by walking /proc
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Details about a running (or recently running) process
+type ProcInfo struct {
+	Pid     int    `json:"pid"`
+	Ppid    int    `json:"ppid"`
+	Uid     int    `json:"uid"`
+	Exe     string `json:"exe"`
+	Cmdline string `json:"cmdline"`
+}
+
+// Get the details of a process from /proc. Returns false if it has already exited.
+func GetProcInfo(pid int) (ProcInfo, bool) {
+	info := ProcInfo{Pid: pid}
+	base := "/proc/" + strconv.Itoa(pid)
+	status, err := os.Open(base + "/status")
+	if err != nil {
+		return info, false
+	}
+	defer status.Close()
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "PPid:":
+			info.Ppid, _ = strconv.Atoi(fields[1])
+		case "Uid:":
+			// Real, effective, saved, filesystem. We want the effective uid.
+			if len(fields) > 2 {
+				info.Uid, _ = strconv.Atoi(fields[2])
+			}
+		}
+	}
+	info.Exe, _ = os.Readlink(base + "/exe")
+	cmdline, _ := ioutil.ReadFile(base + "/cmdline")
+	info.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	return info, true
+}
+
+// Get a process and its ancestors, up to (but not including) init
+func GetProcChain(pid int) []ProcInfo {
+	var chain []ProcInfo
+	seen := map[int]bool{}
+	for pid > 1 && !seen[pid] {
+		seen[pid] = true
+		info, ok := GetProcInfo(pid)
+		if !ok {
+			break
+		}
+		chain = append(chain, info)
+		pid = info.Ppid
+	}
+	return chain
+}
+
+// Set in /proc/[pid]/stat flags for kernel threads
+const pfKthread = 0x00200000
+
+// Check if a pid is a kernel thread (kthreadd or one of its children)
+func IsKernelThread(pid int) bool {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The command name can contain spaces and parentheses, so start after it
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return false
+	}
+	// state, ppid, pgrp, session, tty_nr, tpgid, flags
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 7 {
+		return false
+	}
+	flags, _ := strconv.ParseUint(fields[6], 10, 64)
+	return flags&pfKthread != 0
+}
+
+// Format a process for output
+func (a ProcInfo) String() string {
+	exe := a.Exe
+	if exe == "" {
+		exe = "?"
+	}
+	// Some command lines are huge (i.e. bash -c with a whole script)
+	cmdline := a.Cmdline
+	if len(cmdline) > 200 {
+		cmdline = cmdline[:200] + "..."
+	}
+	if cmdline == "" {
+		return fmt.Sprintf("pid %d (%s) uid %s", a.Pid, exe, LookupUser(a.Uid))
+	}
+	return fmt.Sprintf("pid %d (%s) uid %s: %s", a.Pid, exe, LookupUser(a.Uid), cmdline)
+}
+
+// Find every process that has a path open for writing, by scanning
+// /proc/*/fd. This only catches writers that hold the file open
+// while we're looking.
+func FindWriters(path string) []int {
+	var pids []int
+	self := os.Getpid()
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return pids
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		fdDir := "/proc/" + proc.Name() + "/fd"
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(fdDir + "/" + fd.Name())
+			if err != nil || strings.TrimSuffix(target, " (deleted)") != path {
+				continue
+			}
+			if IsWriteFd(pid, fd.Name()) {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
+
+// Check /proc/[pid]/fdinfo to see if a file descriptor was opened for writing
+func IsWriteFd(pid int, fd string) bool {
+	info, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, fd))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(info), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "flags:" {
+			// Flags are printed in octal
+			flags, err := strconv.ParseInt(fields[1], 8, 64)
+			if err != nil {
+				return false
+			}
+			return flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0
+		}
+	}
+	return false
+}
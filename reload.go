@@ -0,0 +1,460 @@
+/*
+reload.go- Hot reloading of the config file. Changes to config.json
+are picked up without restarting bandaid (and re-entering the key):
+added objects are initialized, removed ones are freed, and objects
+whose paths didn't change keep their baselines and just get their
+new options. Invalid configs are rejected without touching anything.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Only one reload (or save) at a time, whether it came from the watcher, SIGHUP or the REPL
+var reloadLock sync.Mutex
+
+// Stat of the config file the last time we read or wrote it. Guarded by reloadLock.
+var configStat fileStat
+
+// What a reload changed, for the summary
+type ReloadSummary struct {
+	added     []string
+	removed   []string
+	updated   []string
+	failed    []string
+	unchanged int
+}
+
+// Read and check the config file, then make master match it.
+// Returns false if the config was rejected.
+func ReloadConfig() bool {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	configStat, _ = GetStat(config.configFile)
+	configBytes, err := ioutil.ReadFile(config.configFile)
+	if err != nil {
+		Errorf("Error: could not read %s. Keeping the current config.\n", config.configFile)
+		return false
+	}
+	parsed, problems := ParseConfig(configBytes)
+	problems = append(problems, CheckFileSettings(configBytes)...)
+	if len(problems) > 0 {
+		Errorf("Error: %s is invalid. Keeping the current config.\n", config.configFile)
+		for _, problem := range problems {
+			Errorf("  %s\n", problem)
+		}
+		return false
+	}
+	isFreeing.Lock()
+	summary := Reconcile(parsed)
+	isFreeing.Unlock()
+	// Settings from the environment, flags or the console still win
+	changed, _ := ApplyFileSettings(configBytes, true)
+	if len(changed) > 0 {
+		summary.updated = append(summary.updated, fmt.Sprintf("settings (%s)", strings.Join(changed, ", ")))
+	}
+	// Pick up the new objects right away
+	watcher.Sync()
+	attributor.Sync()
+	RequestSweep()
+	summary.Print()
+	return true
+}
+
+// Make master match a parsed config. Objects are matched by name, and
+// then by path, so an object that was only renamed keeps its baseline.
+// The caller must hold isFreeing.
+func Reconcile(parsed Services) ReloadSummary {
+	var summary ReloadSummary
+	var services []Service
+	var files []ServiceObject
+	var dirs []Directory
+	var addServices []Service
+	var addFiles []ServiceObject
+	var addDirs []Directory
+	// Match up everything that's still there. Anything that moved
+	// is removed and added again, since its baseline is for the old path.
+	serviceMatches, keptServices := matchObjects(len(parsed.Services), len(master.Services),
+		func(i, j int) bool { return parsed.Services[i].Name == master.Services[j].Name },
+		func(i, j int) bool {
+			old, next := &master.Services[j], &parsed.Services[i]
+			return old.Binary.Path == next.Binary.Path && old.Service.Path == next.Service.Path && old.Config.Path == next.Config.Path
+		},
+	)
+	fileMatches, keptFiles := matchObjects(len(parsed.Files), len(master.Files),
+		func(i, j int) bool { return parsed.Files[i].Name == master.Files[j].Name },
+		func(i, j int) bool { return parsed.Files[i].Path == master.Files[j].Path },
+	)
+	dirMatches, keptDirs := matchObjects(len(parsed.Directories), len(master.Directories),
+		func(i, j int) bool { return parsed.Directories[i].Name == master.Directories[j].Name },
+		func(i, j int) bool { return filepath.Clean(parsed.Directories[i].Path) == master.Directories[j].Path },
+	)
+	for i := range parsed.Services {
+		next := &parsed.Services[i]
+		if serviceMatches[i] < 0 {
+			addServices = append(addServices, *next)
+			continue
+		}
+		old := &master.Services[serviceMatches[i]]
+		var changes []string
+		if old.Name != next.Name {
+			changes = append(changes, "renamed from "+old.Name)
+			old.Name = next.Name
+		}
+		for j, name := range serviceNames {
+			member := []*ServiceObject{next.Binary, next.Service, next.Config}[j]
+			changes = append(changes, old.getAttr(name).UpdateOptions(member, next.Name)...)
+		}
+		summary.noteUpdate("service "+next.Name, changes)
+		services = append(services, *old)
+	}
+	for i := range parsed.Files {
+		next := &parsed.Files[i]
+		if fileMatches[i] < 0 {
+			addFiles = append(addFiles, *next)
+			continue
+		}
+		old := &master.Files[fileMatches[i]]
+		var changes []string
+		if old.Name != next.Name {
+			changes = append(changes, "renamed from "+old.Name)
+			old.Name = next.Name
+		}
+		summary.noteUpdate("file "+next.Name, append(changes, old.UpdateOptions(next, next.Name)...))
+		files = append(files, *old)
+	}
+	for i := range parsed.Directories {
+		next := &parsed.Directories[i]
+		if dirMatches[i] < 0 {
+			addDirs = append(addDirs, *next)
+			continue
+		}
+		old := &master.Directories[dirMatches[i]]
+		var changes []string
+		if old.Name != next.Name {
+			changes = append(changes, "renamed from "+old.Name)
+			old.Name = next.Name
+		}
+		summary.noteUpdate("directory "+next.Name, append(changes, old.UpdateOptions(next)...))
+		dirs = append(dirs, *old)
+	}
+	// Free everything that's gone before adding anything, so a path
+	// that just moved between names isn't freed out from under its new object
+	for i := range master.Services {
+		if !keptServices[i] {
+			freeService(&master.Services[i])
+			summary.removed = append(summary.removed, "service "+master.Services[i].Name)
+		}
+	}
+	for i := range master.Files {
+		if !keptFiles[i] {
+			freeFile(&master.Files[i])
+			summary.removed = append(summary.removed, "file "+master.Files[i].Name)
+		}
+	}
+	for i := range master.Directories {
+		if !keptDirs[i] {
+			freeDirectory(&master.Directories[i])
+			summary.removed = append(summary.removed, "directory "+master.Directories[i].Name)
+		}
+	}
+	master.Services = services
+	master.Files = files
+	master.Directories = dirs
+	// Then initialize the new ones, the same way as at startup
+	for _, service := range addServices {
+		if !service.Init() {
+			summary.failed = append(summary.failed, "service "+service.Name)
+			continue
+		}
+		for _, name := range serviceNames {
+			service.getAttr(name).InitBackup()
+		}
+		master.Services = append(master.Services, service)
+		summary.added = append(summary.added, "service "+service.Name)
+	}
+	for _, file := range addFiles {
+		if !file.InitSO() {
+			summary.failed = append(summary.failed, "file "+file.Name)
+			continue
+		}
+		file.InitBackup()
+		master.Files = append(master.Files, file)
+		summary.added = append(summary.added, "file "+file.Name)
+	}
+	for _, dir := range addDirs {
+		if !dir.InitDir() {
+			summary.failed = append(summary.failed, "directory "+dir.Name)
+			continue
+		}
+		master.Directories = append(master.Directories, dir)
+		summary.added = append(summary.added, "directory "+dir.Name)
+	}
+	return summary
+}
+
+// Match the objects of a parsed config to the ones in master, by name
+// and path, then by path alone (so renaming an object keeps it). Returns
+// the index in master of each parsed object, or -1 if it's new, and the
+// set of indexes in master that were matched.
+func matchObjects(parsed int, current int, sameName func(i, j int) bool, samePath func(i, j int) bool) ([]int, map[int]bool) {
+	matches := make([]int, parsed)
+	kept := map[int]bool{}
+	for i := range matches {
+		matches[i] = -1
+	}
+	// Names first, so a rename doesn't take an object that's still there under its own name
+	for _, byName := range []bool{true, false} {
+		for i := range matches {
+			for j := 0; j < current && matches[i] < 0; j++ {
+				if !kept[j] && samePath(i, j) && (!byName || sameName(i, j)) {
+					matches[i] = j
+					kept[j] = true
+				}
+			}
+		}
+	}
+	return matches, kept
+}
+
+// Record an object that was kept, and whether its options changed
+func (a *ReloadSummary) noteUpdate(name string, changes []string) {
+	if len(changes) == 0 {
+		a.unchanged++
+		return
+	}
+	a.updated = append(a.updated, fmt.Sprintf("%s (%s)", name, joinUnique(changes)))
+}
+
+// Print what a reload did
+func (a ReloadSummary) Print() {
+	Warnf(
+		"\nReloaded %s: %d added, %d removed, %d updated, %d unchanged\n",
+		config.configFile, len(a.added), len(a.removed), len(a.updated), a.unchanged,
+	)
+	for _, name := range a.added {
+		fmt.Printf("  + %s\n", name)
+	}
+	for _, name := range a.removed {
+		fmt.Printf("  - %s\n", name)
+	}
+	for _, name := range a.updated {
+		fmt.Printf("  ~ %s\n", name)
+	}
+	for _, name := range a.failed {
+		Errorf("  ! %s could not be initialized\n", name)
+	}
+}
+
+// Apply the options of an object from a reloaded config. Returns the
+// names of the options that changed. The caller must hold isFreeing.
+func (a *ServiceObject) UpdateOptions(next *ServiceObject, label string) []string {
+	var changes []string
+	next.CheckPolicy(label)
+	if next.Policy != a.Policy {
+		a.SetPolicy(next.Policy)
+		changes = append(changes, "policy")
+	}
+	if next.Interval != a.Interval {
+		a.Interval = next.Interval
+		a.due = time.Time{}
+		changes = append(changes, "interval")
+	}
+	if next.Generations != a.Generations {
+		a.Generations = next.Generations
+		a.PruneHistory()
+		changes = append(changes, "generations")
+	}
+	return changes
+}
+
+// Apply the options of a directory from a reloaded config. Returns the
+// names of the options that changed. The caller must hold isFreeing.
+func (a *Directory) UpdateOptions(next *Directory) []string {
+	var changes []string
+	old := *a
+	newFiles := next.NewFiles
+	if newFiles == "" {
+		newFiles = newFilesAlert
+	}
+	if newFiles != a.NewFiles {
+		if contains(newFilesPolicies, newFiles) {
+			a.NewFiles = newFiles
+			changes = append(changes, "new_files")
+		} else {
+			Warnf("Invalid new_files policy (%s) for %s. Keeping %s.\n", newFiles, a.Name, a.NewFiles)
+		}
+	}
+	policy := next.Policy
+	if policy == "" {
+		policy = policyRestore
+	}
+	if policy != a.Policy {
+		if contains(policies, policy) {
+			a.Policy = policy
+			changes = append(changes, "policy")
+		} else {
+			Warnf("Invalid policy (%s) for %s. Keeping %s.\n", policy, a.Name, a.Policy)
+		}
+	}
+	if next.Interval != a.Interval {
+		a.Interval = next.Interval
+		changes = append(changes, "interval")
+	}
+	if next.Generations != a.Generations {
+		a.Generations = next.Generations
+		changes = append(changes, "generations")
+	}
+	if !reflect.DeepEqual(next.Include, a.Include) || !reflect.DeepEqual(next.Exclude, a.Exclude) ||
+		next.MaxDepth != a.MaxDepth || next.IsRecursive() != a.IsRecursive() || next.MaxSize != a.MaxSize {
+		a.Include = next.Include
+		a.Exclude = next.Exclude
+		a.MaxDepth = next.MaxDepth
+		a.Recursive = next.Recursive
+		a.MaxSize = next.MaxSize
+		a.CheckPatterns()
+		added, removed := a.Rescope(&old)
+		changes = append(changes, fmt.Sprintf("filters: %d added, %d removed", added, removed))
+	}
+	a.ApplyOptions()
+	for _, file := range a.files {
+		file.due = time.Time{}
+	}
+	return changes
+}
+
+// Check an item and every folder above it against a directory's filters,
+// since AddDir never descends into a folder that was filtered out
+func (a *Directory) InScopeTree(path string) bool {
+	for path != a.Path && path != "/" && path != "." {
+		// Anything that's missing is treated like it's there, so it still gets restored
+		if info, err := os.Lstat(path); err == nil && !a.InScope(path, info) {
+			return false
+		}
+		path = filepath.Dir(path)
+	}
+	return true
+}
+
+// Re-apply a directory's filters after they've changed. Files that are
+// filtered out now are dropped, and files that were filtered out before
+// are added with their current contents as the baseline. Anything else
+// that's new is still left to new file detection. Returns the number added and removed. The caller must hold isFreeing.
+func (a *Directory) Rescope(old *Directory) (int, int) {
+	var files []*ServiceObject
+	var dropped []*ServiceObject
+	for _, file := range a.files {
+		if file.Path == a.Path || a.InScopeTree(file.Path) {
+			files = append(files, file)
+		} else {
+			dropped = append(dropped, file)
+		}
+	}
+	for _, file := range dropped {
+		file.FreeBackup()
+	}
+	a.files = files
+	a.known = map[string]bool{}
+	for _, file := range a.files {
+		a.known[file.Path] = true
+	}
+	added := 0
+	for _, path := range a.FindNewFiles() {
+		if old.InScopeTree(path) {
+			continue
+		}
+		before := len(a.files)
+		a.files = a.AdoptPath(path, a.files)
+		for _, file := range a.files[before:] {
+			a.known[file.Path] = true
+		}
+		added += len(a.files) - before
+	}
+	return added, len(dropped)
+}
+
+// Find a service by name. The caller must hold isFreeing.
+func findService(name string) *Service {
+	for i := range master.Services {
+		if master.Services[i].Name == name {
+			return &master.Services[i]
+		}
+	}
+	return nil
+}
+
+// Find a file by name. The caller must hold isFreeing.
+func findFile(name string) *ServiceObject {
+	for i := range master.Files {
+		if master.Files[i].Name == name {
+			return &master.Files[i]
+		}
+	}
+	return nil
+}
+
+// Find a directory by name. The caller must hold isFreeing.
+func findDirectory(name string) *Directory {
+	for i := range master.Directories {
+		if master.Directories[i].Name == name {
+			return &master.Directories[i]
+		}
+	}
+	return nil
+}
+
+// Join a list of names, skipping duplicates
+func joinUnique(list []string) string {
+	var unique []string
+	for _, item := range list {
+		if !contains(unique, item) {
+			unique = append(unique, item)
+		}
+	}
+	return strings.Join(unique, ", ")
+}
+
+// Check if the config file changed since we last read or wrote it
+func configChanged() bool {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	current, err := GetStat(config.configFile)
+	return !err && current != configStat
+}
+
+// Reload whenever the config file changes or we get a SIGHUP
+func WatchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reloadLock.Lock()
+	configStat, _ = GetStat(config.configFile)
+	reloadLock.Unlock()
+	for {
+		select {
+		case <-hup:
+			Warnf("\nGot SIGHUP. Reloading %s...\n", config.configFile)
+			ReloadConfig()
+			caret()
+		case <-time.After(config.reloadDelay * time.Millisecond):
+			if !config.autoReload || !configChanged() {
+				continue
+			}
+			// Give editors a moment to finish writing
+			time.Sleep(100 * time.Millisecond)
+			Warnf("\n%s changed. Reloading...\n", config.configFile)
+			ReloadConfig()
+			caret()
+		}
+	}
+}
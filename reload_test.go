@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Start a test with nothing protected
+func resetMaster(t *testing.T) {
+	saved := master
+	master = Services{}
+	t.Cleanup(func() { master = saved })
+}
+
+// Get the baseline of an object as a string
+func baseline(t *testing.T, obj *ServiceObject) string {
+	t.Helper()
+	contents, ok := obj.ReadBackup()
+	if !ok {
+		t.Fatalf("couldn't read the baseline of %s", obj.Name)
+	}
+	return string(contents)
+}
+
+func TestReconcileRenameKeepsBaseline(t *testing.T) {
+	dir := tempBackupFolder(t)
+	resetMaster(t)
+	path := filepath.Join(dir, "passwd")
+	ioutil.WriteFile(path, []byte("original"), 0644)
+	isFreeing.Lock()
+	defer isFreeing.Unlock()
+	Reconcile(Services{Files: []ServiceObject{{Name: "passwd", Path: path}}})
+	if len(master.Files) != 1 {
+		t.Fatalf("got %d files, want 1", len(master.Files))
+	}
+
+	ioutil.WriteFile(path, []byte("tampered"), 0644)
+	summary := Reconcile(Services{Files: []ServiceObject{{Name: "etc_passwd", Path: path, Policy: policyAlert}}})
+	if len(summary.added) != 0 || len(summary.removed) != 0 || len(summary.updated) != 1 {
+		t.Errorf("got %+v, want only an update", summary)
+	}
+	if len(master.Files) != 1 || master.Files[0].Name != "etc_passwd" {
+		t.Fatalf("got %+v, want etc_passwd", master.Files)
+	}
+	file := &master.Files[0]
+	if file.Policy != policyAlert {
+		t.Errorf("policy is %s, want %s", file.Policy, policyAlert)
+	}
+	if got := baseline(t, file); got != "original" {
+		t.Errorf("baseline is %q after the rename, want the original", got)
+	}
+	if !FileExists(GetConfigName(path)) {
+		t.Errorf("the stored backup was removed")
+	}
+}
+
+func TestReconcileSwapNames(t *testing.T) {
+	dir := tempBackupFolder(t)
+	resetMaster(t)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	ioutil.WriteFile(a, []byte("a"), 0644)
+	ioutil.WriteFile(b, []byte("b"), 0644)
+	isFreeing.Lock()
+	defer isFreeing.Unlock()
+	Reconcile(Services{Files: []ServiceObject{{Name: "first", Path: a}, {Name: "second", Path: b}}})
+	ioutil.WriteFile(a, []byte("tampered"), 0644)
+	ioutil.WriteFile(b, []byte("tampered"), 0644)
+	Reconcile(Services{Files: []ServiceObject{{Name: "first", Path: b}, {Name: "second", Path: a}}})
+	if len(master.Files) != 2 {
+		t.Fatalf("got %d files, want 2", len(master.Files))
+	}
+	for _, file := range master.Files {
+		if got := baseline(t, &file); got != filepath.Base(file.Path) {
+			t.Errorf("%s (%s) has baseline %q", file.Name, file.Path, got)
+		}
+	}
+}
+
+func TestReconcileKeepsAddsAndRemoves(t *testing.T) {
+	dir := tempBackupFolder(t)
+	resetMaster(t)
+	config.outputEnabled = false
+	saved := colors
+	colors = Colors{}
+	defer func() { colors = saved }()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for _, name := range []string{"kept", "removed", "added", "moved", "moved2"} {
+		ioutil.WriteFile(path(name), []byte(name), 0644)
+	}
+	os.MkdirAll(path("www"), 0755)
+	ioutil.WriteFile(path("www/index.html"), []byte("index"), 0644)
+	isFreeing.Lock()
+	defer isFreeing.Unlock()
+	Reconcile(Services{
+		Files: []ServiceObject{
+			{Name: "kept", Path: path("kept")},
+			{Name: "removed", Path: path("removed")},
+			{Name: "moved", Path: path("moved")},
+		},
+		Directories: []Directory{{Name: "www", Path: path("www")}},
+	})
+	if len(master.Files) != 3 || len(master.Directories) != 1 {
+		t.Fatalf("got %d files and %d directories, want 3 and 1", len(master.Files), len(master.Directories))
+	}
+
+	ioutil.WriteFile(path("kept"), []byte("tampered"), 0644)
+	summary := Reconcile(Services{
+		Files: []ServiceObject{
+			{Name: "kept", Path: path("kept")},
+			{Name: "added", Path: path("added")},
+			// The same name on a new path is a new object
+			{Name: "moved", Path: path("moved2")},
+			{Name: "missing", Path: path("missing")},
+		},
+		Directories: []Directory{{Name: "www", Path: path("www"), Policy: policyAlert}},
+	})
+	checkMessages(t, "added", summary.added, []string{"file added", "file moved"})
+	checkMessages(t, "removed", summary.removed, []string{"file removed", "file moved"})
+	checkMessages(t, "updated", summary.updated, []string{"directory www"})
+	checkMessages(t, "failed", summary.failed, []string{"file missing"})
+	if summary.unchanged != 1 {
+		t.Errorf("%d unchanged, want 1", summary.unchanged)
+	}
+
+	files := map[string]*ServiceObject{}
+	for i := range master.Files {
+		files[master.Files[i].Name] = &master.Files[i]
+	}
+	if len(files) != 3 || files["kept"] == nil || files["added"] == nil || files["moved"] == nil {
+		t.Fatalf("got %+v, want kept, added and moved", master.Files)
+	}
+	if got := baseline(t, files["kept"]); got != "kept" {
+		t.Errorf("kept has baseline %q, want the original", got)
+	}
+	if got := baseline(t, files["added"]); got != "added" {
+		t.Errorf("added has baseline %q", got)
+	}
+	if files["moved"].Path != path("moved2") || baseline(t, files["moved"]) != "moved2" {
+		t.Errorf("moved wasn't set up on its new path")
+	}
+	for _, name := range []string{"removed", "moved"} {
+		if FileExists(GetConfigName(path(name))) {
+			t.Errorf("the backup of %s is still there", name)
+		}
+	}
+	for _, name := range []string{"kept", "added", "moved2"} {
+		if !FileExists(GetConfigName(path(name))) {
+			t.Errorf("%s has no backup", name)
+		}
+	}
+	if len(master.Directories) != 1 || master.Directories[0].Policy != policyAlert || len(master.Directories[0].files) != 2 {
+		t.Errorf("www wasn't kept with its new policy")
+	}
+
+	// Taking everything out frees it all
+	summary = Reconcile(Services{})
+	if len(summary.removed) != 4 || len(master.Files) != 0 || len(master.Directories) != 0 {
+		t.Errorf("removed %q, want everything", summary.removed)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+save.go- Writing the live protected set back to the config file.
+Anything added or freed from the REPL only lives in memory, so
+save (or autosave) puts master and the runtime settings back into
+config.json. Entries we don't manage, like services that were
+skipped because they aren't installed, are left where they were.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Names of objects removed with free since startup. Their entries are
+// dropped from the config file, while entries that were never loaded
+// (i.e. services that aren't installed) are kept.
+var freedNames []string
+
+// REPL commands that change something that's saved
+var configCommands []string = []string{
+	"addfile", "addfolder", "addservice", "free", "policy", "interval", "schedule",
+	"icmpInterval", "upkeep", "perms", "watch", "workers", "rehash", "diff",
+	"lockdown", "flapping", "mem", "settings", "quiet", "verbose", "timing",
+}
+
+// Get the config entry for an object, leaving out anything that's the default
+func (a *ServiceObject) configEntry(name string) *ServiceObject {
+	entry := &ServiceObject{
+		Name:        name,
+		Path:        a.Path,
+		Generations: a.Generations,
+		Interval:    a.Interval,
+	}
+	if a.Policy != policyRestore {
+		entry.Policy = a.Policy
+	}
+	return entry
+}
+
+// Get the config entry for a directory
+func (a *Directory) configEntry() Directory {
+	entry := Directory{
+		Name:        a.Name,
+		Path:        a.Path,
+		NewFiles:    a.NewFiles,
+		Generations: a.Generations,
+		Policy:      a.Policy,
+		Interval:    a.Interval,
+		Include:     a.Include,
+		Exclude:     a.Exclude,
+		MaxDepth:    a.MaxDepth,
+		Recursive:   a.Recursive,
+		MaxSize:     a.MaxSize,
+	}
+	if entry.Policy == policyRestore {
+		entry.Policy = ""
+	}
+	return entry
+}
+
+// Merge the entries for one section of the config file. Entries for
+// objects in master are replaced in place, freed ones are dropped,
+// and anything else is kept as is. New objects go at the end.
+func mergeSection(existing json.RawMessage, names []string, entries []interface{}) []interface{} {
+	var merged []interface{}
+	used := map[string]bool{}
+	var items []json.RawMessage
+	json.Unmarshal(existing, &items)
+	for _, item := range items {
+		var entry struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(item, &entry)
+		i := indexOf(names, entry.Name)
+		if i >= 0 && !used[entry.Name] {
+			merged = append(merged, entries[i])
+			used[entry.Name] = true
+		} else if i < 0 && !contains(freedNames, entry.Name) {
+			merged = append(merged, item)
+		}
+	}
+	for i, name := range names {
+		if !used[name] {
+			merged = append(merged, entries[i])
+		}
+	}
+	if merged == nil {
+		merged = []interface{}{}
+	}
+	return merged
+}
+
+// Get the index of a string in a slice, or -1 if it isn't in it
+func indexOf(arr []string, s string) int {
+	for i, item := range arr {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Build the contents of the config file from master, merged into the
+// existing file. The caller must hold isFreeing.
+func BuildConfig(existing []byte) ([]byte, error) {
+	sections := map[string]json.RawMessage{}
+	// Don't clobber a file we can't make sense of
+	if len(bytes.TrimSpace(existing)) > 0 {
+		if err := json.Unmarshal(existing, &sections); err != nil {
+			return nil, fmt.Errorf("the existing file is not valid json (%s)", JSONError(existing, err))
+		}
+	}
+	var names []string
+	var entries []interface{}
+	for _, service := range master.Services {
+		names = append(names, service.Name)
+		entries = append(entries, Service{
+			Name:    service.Name,
+			Binary:  service.Binary.configEntry(""),
+			Service: service.Service.configEntry(""),
+			Config:  service.Config.configEntry(""),
+		})
+	}
+	values := map[string]interface{}{
+		"services": mergeSection(sections["services"], names, entries),
+	}
+	names, entries = nil, nil
+	for i := range master.Files {
+		names = append(names, master.Files[i].Name)
+		entries = append(entries, master.Files[i].configEntry(master.Files[i].Name))
+	}
+	values["other_files"] = mergeSection(sections["other_files"], names, entries)
+	names, entries = nil, nil
+	for i := range master.Directories {
+		names = append(names, master.Directories[i].Name)
+		entries = append(entries, master.Directories[i].configEntry())
+	}
+	values["directories"] = mergeSection(sections["directories"], names, entries)
+	settings, err := SettingsJSON(sections["settings"])
+	if err != nil {
+		return nil, err
+	}
+	values["settings"] = settings
+	// Our sections go first, then anything else that was in the file
+	keys := append([]string{}, configSections...)
+	var others []string
+	for key := range sections {
+		if !contains(configSections, key) {
+			others = append(others, key)
+			values[key] = sections[key]
+		}
+	}
+	sort.Strings(others)
+	keys = append(keys, others...)
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for i, key := range keys {
+		value, err := json.MarshalIndent(values[key], "    ", "    ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "    %q: %s", key, value)
+		if i < len(keys)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// Write master and the runtime settings to a config file
+func SaveConfig(path string) bool {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	existing, _ := ioutil.ReadFile(path)
+	isFreeing.Lock()
+	contents, err := BuildConfig(existing)
+	services, files, dirs := len(master.Services), len(master.Files), len(master.Directories)
+	isFreeing.Unlock()
+	if err != nil {
+		Errorf("Error: could not save to %s: %v\n", path, err)
+		return false
+	}
+	// Keep the permissions of the file we're replacing
+	mode, owner, group := os.FileMode(0600), os.Getuid(), os.Getgid()
+	if stat, err := os.Stat(path); err == nil {
+		mode = stat.Mode().Perm()
+		if inf, ok := stat.Sys().(*syscall.Stat_t); ok {
+			owner, group = int(inf.Uid), int(inf.Gid)
+		}
+	}
+	if !WriteFileAtomic(path, contents, mode, owner, group, nil) {
+		Errorf("Error: could not write %s\n", path)
+		return false
+	}
+	// Don't reload the changes we just made
+	if filepath.Clean(path) == filepath.Clean(config.configFile) {
+		configStat, _ = GetStat(config.configFile)
+	}
+	fmt.Printf("Saved %d services, %d files and %d directories to %s.\n", services, files, dirs, path)
+	return true
+}
+
+// Handle the save REPL command
+func SaveCommand(args []string) {
+	if len(args) > 1 && args[1] == "auto" {
+		if len(args) == 2 {
+			if config.autoSave {
+				fmt.Printf("Changes are saved to %s automatically.\n", config.configFile)
+			} else {
+				fmt.Printf("Changes are only saved with the save command.\n")
+			}
+			return
+		}
+		switch args[2] {
+		case "on":
+			config.autoSave = true
+		case "off":
+			config.autoSave = false
+		default:
+			Errorf("Error: invalid argument\n")
+		}
+		return
+	}
+	if len(args) > 2 {
+		Errorf("Error: invalid number of arguments\n")
+		return
+	}
+	path := config.configFile
+	if len(args) == 2 {
+		path = args[1]
+	}
+	SaveConfig(path)
+}
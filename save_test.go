@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveRoundTrip(t *testing.T) {
+	dir := tempBackupFolder(t)
+	resetMaster(t)
+	config.outputEnabled = false
+	saved := freedNames
+	t.Cleanup(func() { freedNames = saved })
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for _, name := range []string{"passwd", "hosts"} {
+		ioutil.WriteFile(path(name), []byte(name), 0644)
+	}
+	os.MkdirAll(path("www"), 0755)
+	isFreeing.Lock()
+	Reconcile(Services{
+		Files: []ServiceObject{
+			{Name: "passwd", Path: path("passwd"), Policy: policyAlert, Interval: 250, Generations: 3},
+			{Name: "hosts", Path: path("hosts")},
+		},
+		Directories: []Directory{{
+			Name: "www", Path: path("www"), NewFiles: newFilesQuarantine,
+			Include: []string{"*.php"}, Exclude: []string{"cache"}, MaxDepth: 2, MaxSize: 1024,
+		}},
+	})
+	isFreeing.Unlock()
+	FindSetting("jitter").Set("35", sourceConsole)
+
+	// Entries we don't manage and unknown sections are kept, freed ones are dropped
+	file := path("config.json")
+	existing := `{
+		"services": [{"name": "notinstalled", "binary": {"path": "/a"}, "service": {"path": "/b"}, "config": {"path": "/c"}}],
+		"other_files": [{"name": "freed", "path": "/etc/freed"}, {"name": "hosts", "path": "` + path("hosts") + `"}],
+		"comment": "kept"
+	}`
+	ioutil.WriteFile(file, []byte(existing), 0640)
+	freedNames = []string{"freed"}
+	if !SaveConfig(file) {
+		t.Fatal("couldn't save")
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0640 {
+		t.Errorf("mode is %v, want 0640", info.Mode().Perm())
+	}
+
+	contents, _ := ioutil.ReadFile(file)
+	parsed, problems := ParseConfig(contents)
+	checkMessages(t, "problems", problems, nil)
+	_, errors, warnings := ParseConfigStrict(contents)
+	checkMessages(t, "errors", errors, nil)
+	checkMessages(t, "warnings", warnings, []string{"Unknown section (comment)"})
+	if len(parsed.Services) != 1 || parsed.Services[0].Name != "notinstalled" {
+		t.Errorf("services are %+v, want notinstalled", parsed.Services)
+	}
+	if len(parsed.Files) != 2 || parsed.Files[0].Name != "hosts" || parsed.Files[1].Name != "passwd" {
+		t.Fatalf("files are %+v, want hosts then passwd", parsed.Files)
+	}
+	passwd := parsed.Files[1]
+	if passwd.Path != path("passwd") || passwd.Policy != policyAlert || passwd.Interval != 250 || passwd.Generations != 3 {
+		t.Errorf("passwd is %+v", passwd)
+	}
+	if len(parsed.Directories) != 1 {
+		t.Fatalf("directories are %+v, want www", parsed.Directories)
+	}
+	www := parsed.Directories[0]
+	if www.NewFiles != newFilesQuarantine || strings.Join(www.Include, ",") != "*.php" ||
+		strings.Join(www.Exclude, ",") != "cache" || www.MaxDepth != 2 || www.MaxSize != 1024 {
+		t.Errorf("www is %+v", www)
+	}
+	if !strings.Contains(string(contents), `"comment": "kept"`) {
+		t.Errorf("the unknown section was dropped:\n%s", contents)
+	}
+
+	// Loading the saved file changes nothing
+	backupLocation := config.backupLocation
+	resetSettings()
+	config.backupLocation = backupLocation
+	config.outputEnabled = false
+	ApplyFileSettings(contents, false)
+	if s := FindSetting("jitter"); s.String() != "35" || s.source != sourceFile {
+		t.Errorf("jitter is %s (%s), want 35 (file)", s.String(), s.source)
+	}
+	parsed.Services = nil
+	isFreeing.Lock()
+	summary := Reconcile(parsed)
+	isFreeing.Unlock()
+	if len(summary.added)+len(summary.removed)+len(summary.updated)+len(summary.failed) != 0 || summary.unchanged != 3 {
+		t.Errorf("reloading the saved config changed %+v", summary)
+	}
+}
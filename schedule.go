@@ -0,0 +1,226 @@
+/*
+schedule.go- Per-object check intervals. Every object is checked
+on its own interval rather than all at once: priority files like
+/etc/shadow far more often than bulk web root contents. Each
+interval is randomized a bit, so red team can't time their
+changes to land right after a check.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files checked every config.priorityDelay ms unless they have their own
+// interval. Folders cover everything in them.
+var defaultPriorityPaths []string = []string{
+	"/etc/passwd",
+	"/etc/shadow",
+	"/etc/group",
+	"/etc/gshadow",
+	"/etc/sudoers",
+	"/etc/sudoers.d",
+	"/etc/ssh/sshd_config",
+	"/etc/pam.d",
+	"/root/.ssh/authorized_keys",
+}
+
+// Wakes RunBandaid up to reschedule, without forcing a full sweep
+var wakeScheduler = make(chan struct{}, 1)
+
+// Only used by RunBandaid
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// Check if a path is one of the priority paths, or inside one
+func IsPriority(path string) bool {
+	for _, priority := range config.priorityPaths {
+		priority = filepath.Clean(priority)
+		if path == priority || strings.HasPrefix(path, priority+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the default interval, which is longer while inotify is doing the work
+func DefaultInterval() time.Duration {
+	if watcher.Active() {
+		return config.safetyDelay
+	}
+	return config.delay
+}
+
+// Get how often an object is checked, in milliseconds
+func (a *ServiceObject) CheckInterval() time.Duration {
+	if a.flapping && FlapAction(flapInterval) {
+		return config.flapDelay
+	}
+	if a.Interval > 0 {
+		return time.Duration(a.Interval)
+	}
+	interval := DefaultInterval()
+	if IsPriority(a.Path) && config.priorityDelay < interval {
+		return config.priorityDelay
+	}
+	return interval
+}
+
+// Randomize an interval by up to config.jitter percent either way
+func Jitter(interval time.Duration) time.Duration {
+	if config.jitter <= 0 {
+		return interval
+	}
+	spread := float64(interval) * float64(config.jitter) / 100
+	return interval + time.Duration((jitterRand.Float64()*2-1)*spread)
+}
+
+// Set when an object is next due to be checked
+func (a *ServiceObject) Reschedule(now time.Time) {
+	a.due = now.Add(Jitter(a.CheckInterval()) * time.Millisecond)
+}
+
+// Check an object as soon as possible, i.e. once it starts flapping
+func (a *ServiceObject) CheckSoon() {
+	a.due = time.Time{}
+	select {
+	case wakeScheduler <- struct{}{}:
+	default:
+	}
+}
+
+// Build the list of jobs for every object that's due, in output order.
+// The caller must hold isFreeing.
+func CollectDueJobs(now time.Time, all bool) []*checkJob {
+	var jobs []*checkJob
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if all || !obj.due.After(now) {
+			jobs = append(jobs, &checkJob{obj: obj, label: label})
+		}
+	})
+	return jobs
+}
+
+// Get the time the next object is due. The caller must hold isFreeing.
+func NextDue(until time.Time) time.Time {
+	next := until
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if obj.due.Before(next) {
+			next = obj.due
+		}
+	})
+	return next
+}
+
+// Print the scheduling settings, and every object that isn't on the default interval
+func PrintSchedule() {
+	fmt.Printf(
+		"Default interval: %d ms\nPriority interval: %d ms\nJitter: %d%%\nPriority paths: %s\n",
+		DefaultInterval(), config.priorityDelay, config.jitter, strings.Join(config.priorityPaths, ", "),
+	)
+	type entry struct {
+		label    string
+		interval time.Duration
+	}
+	var entries []entry
+	isFreeing.Lock()
+	ForEachObject(func(obj *ServiceObject, label string) {
+		if interval := obj.CheckInterval(); interval != DefaultInterval() {
+			entries = append(entries, entry{label, interval})
+		}
+	})
+	isFreeing.Unlock()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].interval < entries[j].interval
+	})
+	Warnf("---Custom intervals---\n")
+	for _, e := range entries {
+		fmt.Printf("%s: %d ms\n", e.label, e.interval)
+	}
+}
+
+// Handle the schedule REPL command
+func ScheduleCommand(args []string) {
+	if len(args) == 1 {
+		PrintSchedule()
+		return
+	}
+	if len(args) != 3 {
+		Errorf("Error: invalid number of arguments\n")
+		return
+	}
+	switch args[1] {
+	case "priority":
+		i, err := strconv.Atoi(args[2])
+		if err != nil || i < 1 {
+			Errorf("Error: Invalid argument\n")
+			return
+		}
+		config.priorityDelay = time.Duration(i)
+	case "jitter":
+		i, err := strconv.Atoi(args[2])
+		if err != nil || i < 0 || i > 100 {
+			Errorf("Error: jitter must be a percentage from 0 to 100\n")
+			return
+		}
+		config.jitter = i
+	case "add":
+		config.priorityPaths = append(config.priorityPaths, filepath.Clean(args[2]))
+	case "remove":
+		var paths []string
+		for _, path := range config.priorityPaths {
+			if filepath.Clean(path) != filepath.Clean(args[2]) {
+				paths = append(paths, path)
+			}
+		}
+		config.priorityPaths = paths
+	default:
+		Errorf("Error: invalid argument\n")
+		return
+	}
+	// Pick up the new intervals right away
+	RequestSweep()
+}
+
+// Handle the interval REPL command for a single object (or every
+// file in a directory). The caller must hold isFreeing.
+func IntervalCommand(name string, value string) {
+	interval := 0
+	if value != "default" {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 1 {
+			Errorf("Error: Invalid argument\n")
+			return
+		}
+		interval = i
+	}
+	for i := range master.Directories {
+		dir := &master.Directories[i]
+		if dir.Name == name || dir.Path == filepath.Clean(name) {
+			// Files added to the directory later get it too
+			dir.Interval = interval
+			dir.ApplyOptions()
+			fmt.Printf("Interval for %s set to %s.\n", dir.Name, value)
+			RequestSweep()
+			return
+		}
+	}
+	objs := FindObjects(name)
+	if len(objs) == 0 {
+		Warnf("%s does not exist\n", name)
+		return
+	}
+	for _, obj := range objs {
+		obj.Interval = interval
+		// Going back to the default hands the file back to its directory
+		obj.ownInterval = interval != 0
+		fmt.Printf("Interval for %s set to %s.\n", obj.Path, value)
+	}
+	RequestSweep()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectDueJobs(t *testing.T) {
+	resetSettings()
+	resetMaster(t)
+	config.delay = 1000
+	config.priorityDelay = 100
+	config.jitter = 0
+	config.priorityPaths = []string{"/etc/shadow", "/etc/pam.d"}
+	master.Files = []ServiceObject{
+		{Name: "motd", Path: "/etc/motd"},
+		{Name: "shadow", Path: "/etc/shadow"},
+		{Name: "pam", Path: "/etc/pam.d/sshd"},
+		{Name: "fast", Path: "/etc/hosts", Interval: 50},
+		// Its own interval wins over being a priority path
+		{Name: "slow", Path: "/etc/pam.d/login", Interval: 5000},
+	}
+	now := time.Now()
+	isFreeing.Lock()
+	defer isFreeing.Unlock()
+	ForEachObject(func(obj *ServiceObject, label string) {
+		obj.Reschedule(now)
+	})
+	due := func(after time.Duration, all bool) []string {
+		var names []string
+		for _, job := range CollectDueJobs(now.Add(after*time.Millisecond), all) {
+			names = append(names, job.obj.Name)
+		}
+		return names
+	}
+	tests := []struct {
+		name  string
+		after time.Duration
+		all   bool
+		want  []string
+	}{
+		{"nothing is due yet", 10, false, nil},
+		{"own interval", 50, false, []string{"fast"}},
+		{"priority paths", 100, false, []string{"shadow", "pam", "fast"}},
+		{"default interval", 1000, false, []string{"motd", "shadow", "pam", "fast"}},
+		{"everything", 5000, false, []string{"motd", "shadow", "pam", "fast", "slow"}},
+		{"a full sweep takes everything", 0, true, []string{"motd", "shadow", "pam", "fast", "slow"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := due(test.after, test.all)
+			if len(got) != len(test.want) {
+				t.Fatalf("due: %q, want %q", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("due: %q, want %q", got, test.want)
+				}
+			}
+		})
+	}
+	if next := NextDue(now.Add(time.Hour)); !next.Equal(now.Add(50 * time.Millisecond)) {
+		t.Errorf("next due in %s, want 50ms", next.Sub(now))
+	}
+	// Checking an object soon puts it at the front
+	master.Files[0].CheckSoon()
+	if got := due(0, false); len(got) != 1 || got[0] != "motd" {
+		t.Errorf("due: %q, want [motd]", got)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	resetSettings()
+	config.jitter = 20
+	for i := 0; i < 1000; i++ {
+		if j := Jitter(1000); j < 800 || j > 1200 {
+			t.Fatalf("jittered 1000 to %d, want within 20%%", j)
+		}
+	}
+	config.jitter = 0
+	if j := Jitter(1000); j != 1000 {
+		t.Errorf("jittered 1000 to %d with no jitter", j)
+	}
+}
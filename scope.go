@@ -0,0 +1,190 @@
+/*
+scope.go- Which files under a protected directory are actually
+protected. Directories can skip cache folders, uploads and logs
+with include/exclude globs, a depth limit, a size limit, or by
+not descending into subfolders at all, so legitimate app writes
+don't get reverted.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Check if a directory descends into its subfolders
+func (a *Directory) IsRecursive() bool {
+	return a.Recursive == nil || *a.Recursive
+}
+
+// Get how many folders deep a directory is protected (0 for no limit).
+// A directory that isn't recursive only protects what's directly in it.
+func (a *Directory) Depth() int {
+	if !a.IsRecursive() {
+		return 1
+	}
+	return a.MaxDepth
+}
+
+// Check if a glob matches a path relative to the directory. Patterns
+// with a slash (uploads/*) are matched against the whole relative
+// path, and anything else (*.log, cache) against the name. A ** folder
+// in a pattern (uploads/**, **/cache) matches any number of folders.
+func globMatch(pattern string, rel string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if strings.Contains(pattern, "/") {
+		return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+	}
+	ok, _ := filepath.Match(pattern, filepath.Base(rel))
+	return ok
+}
+
+// Match a path against a pattern one folder at a time, so ** can
+// stand in for any number of them (including none)
+func matchSegments(pattern []string, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// Check if an item under a directory should be protected. info comes
+// from lstat, so symlinks are treated as files.
+func (a *Directory) InScope(path string, info os.FileInfo) bool {
+	rel, err := filepath.Rel(a.Path, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	if max := a.Depth(); max > 0 && strings.Count(rel, "/")+1 > max {
+		return false
+	}
+	for _, pattern := range a.Exclude {
+		if globMatch(pattern, rel) {
+			return false
+		}
+	}
+	// Folders are always walked, otherwise include: ["*.php"] would skip every subfolder
+	if info.IsDir() {
+		return true
+	}
+	if a.MaxSize > 0 && info.Size() > a.MaxSize {
+		return false
+	}
+	if len(a.Include) == 0 {
+		return true
+	}
+	for _, pattern := range a.Include {
+		if globMatch(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drop any patterns that aren't valid globs
+func (a *Directory) CheckPatterns() {
+	check := func(patterns []string, kind string) []string {
+		var valid []string
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				Warnf("Invalid %s pattern (%s) for %s. Ignoring it.\n", kind, pattern, a.Name)
+				continue
+			}
+			valid = append(valid, pattern)
+		}
+		return valid
+	}
+	a.Include = check(a.Include, "include")
+	a.Exclude = check(a.Exclude, "exclude")
+	if a.MaxDepth < 0 {
+		a.MaxDepth = 0
+	}
+	if a.MaxSize < 0 {
+		a.MaxSize = 0
+	}
+}
+
+// Describe a directory's filters for the list command
+func (a *Directory) Filters() string {
+	var filters []string
+	if len(a.Include) > 0 {
+		filters = append(filters, "include "+strings.Join(a.Include, ","))
+	}
+	if len(a.Exclude) > 0 {
+		filters = append(filters, "exclude "+strings.Join(a.Exclude, ","))
+	}
+	if !a.IsRecursive() {
+		filters = append(filters, "not recursive")
+	} else if a.MaxDepth > 0 {
+		filters = append(filters, fmt.Sprintf("max depth %d", a.MaxDepth))
+	}
+	if a.MaxSize > 0 {
+		filters = append(filters, "max size "+FormatSize(a.MaxSize))
+	}
+	return strings.Join(filters, ", ")
+}
+
+// Set a directory option from a key=value argument to addfolder
+func (a *Directory) ParseOption(arg string) bool {
+	split := strings.SplitN(arg, "=", 2)
+	if len(split) != 2 {
+		return false
+	}
+	key, value := split[0], split[1]
+	switch key {
+	case "new_files":
+		if !contains(newFilesPolicies, value) {
+			return false
+		}
+		a.NewFiles = value
+	case "include":
+		a.Include = append(a.Include, strings.Split(value, ",")...)
+	case "exclude":
+		a.Exclude = append(a.Exclude, strings.Split(value, ",")...)
+	case "max_depth":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return false
+		}
+		a.MaxDepth = n
+	case "recursive":
+		recursive, err := strconv.ParseBool(value)
+		if err != nil {
+			return false
+		}
+		a.Recursive = &recursive
+	case "max_size":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return false
+		}
+		a.MaxSize = n
+	case "generations":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return false
+		}
+		a.Generations = n
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Just enough of a FileInfo for InScope
+type fakeInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (a fakeInfo) Name() string       { return a.name }
+func (a fakeInfo) Size() int64        { return a.size }
+func (a fakeInfo) ModTime() time.Time { return time.Time{} }
+func (a fakeInfo) IsDir() bool        { return a.dir }
+func (a fakeInfo) Sys() interface{}   { return nil }
+func (a fakeInfo) Mode() os.FileMode {
+	if a.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		// No slash: matched against the name at any depth
+		{"*.log", "error.log", true},
+		{"*.log", "logs/error.log", true},
+		{"*.log", "error.log.1", false},
+		{"cache", "app/cache", true},
+		{"cache", "app/cache/x", false},
+		// A slash: matched against the whole path
+		{"uploads/*", "uploads/a.php", true},
+		{"uploads/*", "uploads/2024/a.php", false},
+		{"uploads/*", "app/uploads/a.php", false},
+		{"/uploads/*/", "uploads/a.php", true},
+		// ** matches any number of folders, including none
+		{"uploads/**", "uploads", true},
+		{"uploads/**", "uploads/a.php", true},
+		{"uploads/**", "uploads/2024/01/a.php", true},
+		{"uploads/**", "app/uploads/a.php", false},
+		{"**/cache", "cache", true},
+		{"**/cache", "a/b/cache", true},
+		{"**/cache", "a/b/cache/x", false},
+		{"**/*.php", "index.php", true},
+		{"**/*.php", "a/b/index.php", true},
+		{"**/*.php", "a/b/index.html", false},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"a/**/z", "a/b/c/y", false},
+		{"**", "anything/at/all", true},
+	}
+	for _, test := range tests {
+		if got := globMatch(test.pattern, test.rel); got != test.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", test.pattern, test.rel, got, test.want)
+		}
+	}
+}
+
+func TestInScope(t *testing.T) {
+	no := false
+	file := func(name string, size int64) fakeInfo { return fakeInfo{name: name, size: size} }
+	folder := func(name string) fakeInfo { return fakeInfo{name: name, dir: true} }
+	tests := []struct {
+		name string
+		dir  Directory
+		path string
+		info fakeInfo
+		want bool
+	}{
+		{"everything by default", Directory{}, "/w/a/b/c/d.php", file("d.php", 10), true},
+		{"the directory itself", Directory{}, "/w", folder("w"), false},
+		{"outside the directory", Directory{}, "/other/d.php", file("d.php", 10), false},
+		{"sibling with a shared prefix", Directory{}, "/w2/d.php", file("d.php", 10), false},
+
+		{"max depth, at the limit", Directory{MaxDepth: 2}, "/w/a/b.php", file("b.php", 1), true},
+		{"max depth, past the limit", Directory{MaxDepth: 2}, "/w/a/b/c.php", file("c.php", 1), false},
+		{"max depth, folder past the limit", Directory{MaxDepth: 1}, "/w/a/b", folder("b"), false},
+		{"not recursive, top level", Directory{Recursive: &no}, "/w/a.php", file("a.php", 1), true},
+		{"not recursive, subfolder", Directory{Recursive: &no}, "/w/a", folder("a"), true},
+		{"not recursive, in a subfolder", Directory{Recursive: &no}, "/w/a/b.php", file("b.php", 1), false},
+		{"not recursive beats max depth", Directory{Recursive: &no, MaxDepth: 5}, "/w/a/b.php", file("b.php", 1), false},
+
+		{"max size, under", Directory{MaxSize: 100}, "/w/a.php", file("a.php", 100), true},
+		{"max size, over", Directory{MaxSize: 100}, "/w/a.php", file("a.php", 101), false},
+		{"max size doesn't apply to folders", Directory{MaxSize: 1}, "/w/a", fakeInfo{name: "a", size: 4096, dir: true}, true},
+
+		{"include matches", Directory{Include: []string{"*.php"}}, "/w/a/b.php", file("b.php", 1), true},
+		{"include doesn't match", Directory{Include: []string{"*.php"}}, "/w/a/b.log", file("b.log", 1), false},
+		{"include doesn't apply to folders", Directory{Include: []string{"*.php"}}, "/w/a", folder("a"), true},
+		{"any include", Directory{Include: []string{"*.php", "*.html"}}, "/w/b.html", file("b.html", 1), true},
+		{"exclude matches", Directory{Exclude: []string{"*.log"}}, "/w/b.log", file("b.log", 1), false},
+		{"exclude applies to folders", Directory{Exclude: []string{"cache"}}, "/w/app/cache", folder("cache"), false},
+		{"exclude beats include", Directory{Include: []string{"*.php"}, Exclude: []string{"uploads/**"}}, "/w/uploads/x.php", file("x.php", 1), false},
+		{"include with exclude elsewhere", Directory{Include: []string{"*.php"}, Exclude: []string{"uploads/**"}}, "/w/app/x.php", file("x.php", 1), true},
+		{"size limit with include", Directory{Include: []string{"*.php"}, MaxSize: 5}, "/w/x.php", file("x.php", 6), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := test.dir
+			dir.Path = "/w"
+			if got := dir.InScope(test.path, test.info); got != test.want {
+				t.Errorf("InScope(%q) = %v, want %v", test.path, got, test.want)
+			}
+		})
+	}
+}
@@ -9,29 +9,78 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"syscall"
+	"time"
 )
 
 // File object
 type ServiceObject struct {
-	Mode     fs.FileMode // File permissions
-	Name     string
-	Owner    int // UID
-	Group    int // GID
-	Path     string
-	Checksum string
-	Backup   []byte // Contents of the file are stored in memory
-	isDir    bool
+	Mode         fs.FileMode       `json:"-"` // File permissions
+	Name         string            `json:"name,omitempty"`
+	Owner        int               `json:"-"` // UID
+	Group        int               `json:"-"` // GID
+	Path         string            `json:"path"`
+	Checksum     string            `json:"-"`
+	Generations  int               `json:"generations,omitempty"` // Number of past baselines to keep (0 for config.generations)
+	Policy       string            `json:"policy,omitempty"`      // What to do when the object changes (restore, alert, perms or content)
+	Interval     int               `json:"interval,omitempty"`    // How often to check the object, in ms (0 for the default)
+	Backup       []byte            `json:"-"`                     // Contents of the file are stored in memory
+	Target       string            `json:"-"`                     // Where the link points, if the file is a symlink
+	xattrs       map[string][]byte // Extended attributes (ACLs, capabilities, SELinux labels, etc.)
+	flags        uint32            // Inode flags (immutable, append only, etc.)
+	hasFlags     bool              // False if the filesystem doesn't support inode flags
+	locked       bool              // Made immutable because it was flapping
+	flapping     bool              // Restored too many times within config.flapWindow
+	restores     []time.Time       // Times of recent restores, used to detect flapping
+	due          time.Time         // When the object is next checked
+	flapRestores int               // Number of restores since the object started flapping
+	isDir        bool
+	isLink       bool
+	stat         fileStat // Stat of the file the last time its checksum was verified
+	checks       int      // Number of checks since the last full hash
+	streamed     bool     // Backup was dropped from memory and is read from the backup folder
+	size         int64    // Size of the backup while it's streamed
+	blob         string   // Key of the backup's contents in the blob store
+	buffered     bool     // Backup is a shared buffer we hold a reference to
+	seen         string   // What the file looked like (checksum) the last time it didn't match
+	seenStat     fileStat // Stat of the file when seen was taken
+	alerted      string   // Content change that was already reported under the alert policy
+	alertedPerms string   // Permission change that was already reported under the alert policy
+	ownPolicy    bool     // Policy was set on the file itself, so its directory's policy doesn't replace it
+	ownInterval  bool     // Same for the interval
+}
+
+// The parts of a file's stat that change whenever its contents do
+type fileStat struct {
+	valid bool
+	mode  uint32
+	size  int64
+	mtime syscall.Timespec
+	ctime syscall.Timespec
+	ino   uint64
+	dev   uint64
 }
 
 type Directory struct {
-	Name        string `json:"name"` // These tags are added let us use JSON unmarshal
-	Path        string
-	isRecursive bool
+	Name        string           `json:"name"` // These tags are added let us use JSON unmarshal
+	Path        string           `json:"path"`
+	NewFiles    string           `json:"new_files,omitempty"`   // Policy for files added after startup (alert, quarantine or delete)
+	Generations int              `json:"generations,omitempty"` // Number of past baselines to keep for each file (0 for config.generations)
+	Policy      string           `json:"policy,omitempty"`      // Policy for every file in the directory (restore, alert, perms or content)
+	Interval    int              `json:"interval,omitempty"`    // How often to check each file, in ms (0 for the default)
+	Include     []string         `json:"include,omitempty"`     // Only protect files matching one of these globs (every file if empty)
+	Exclude     []string         `json:"exclude,omitempty"`     // Skip files and folders matching these globs
+	MaxDepth    int              `json:"max_depth,omitempty"`   // How many folders deep to protect (0 for no limit)
+	Recursive   *bool            `json:"recursive,omitempty"`   // Protect the contents of subfolders (true if unset)
+	MaxSize     int64            `json:"max_size,omitempty"`    // Skip files bigger than this many bytes (0 for no limit)
 	files       []*ServiceObject // Store pointers instead of actual variables to aid with making changes
+	known       map[string]bool  // Paths of every file in files, used to detect new ones
+	alerted     map[string]bool  // New files that have already been reported
 }
 
 type Service struct {
@@ -48,31 +97,75 @@ type Services struct {
 	Directories []Directory     `json:"directories"`
 }
 
-// Check to see if the permissions for a file have been modified
-func (a *ServiceObject) CheckPerms() bool {
-	stat, _ := os.Stat(a.Path)
-	if stat.Mode() != a.Mode {
-		if config.outputEnabled {
-			fmt.Printf("\nPermissions for %s have been modified. Restoring...\n", a.Name)
-		}
-		return false
+// Check to see if the permissions for a file have been modified.
+// Returns a description of the change, or "" if there wasn't one.
+func (a *ServiceObject) PermsChange() string {
+	stat, err := os.Lstat(a.Path)
+	if err != nil {
+		return ""
+	}
+	// Symlinks don't have permissions of their own, only an owner
+	if !a.isLink && stat.Mode() != a.Mode {
+		return fmt.Sprintf("Permissions for %s have been modified (%s)", a.Name, stat.Mode())
 	}
 	// Also check uid and gid
-	inf := stat.Sys().(*syscall.Stat_t)
+	inf, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
 	if int(inf.Uid) != a.Owner || int(inf.Gid) != a.Group {
-		if config.outputEnabled {
-			fmt.Printf("Permissions for %s have been modified. Restoring...\n", a.Name)
+		return fmt.Sprintf("Owner of %s has been modified (%s:%d)", a.Name, LookupUser(int(inf.Uid)), inf.Gid)
+	}
+	// Check the inode flags, i.e. chattr +a or +i
+	if a.hasFlags {
+		if flags, err := GetFlags(a.Path); err == nil && flags != a.ExpectedFlags() {
+			return fmt.Sprintf("Inode flags for %s have been modified (%s)", a.Name, FlagString(flags))
 		}
-		return false
 	}
-	return true
+	// Finally check ACLs, capabilities and other extended attributes
+	if !a.isLink && !XattrsEqual(IgnoreLSMXattrs(GetXattrs(a.Path), a.xattrs), a.xattrs) {
+		return fmt.Sprintf("Extended attributes for %s have been modified", a.Name)
+	}
+	return ""
 }
 
 // Check to see if file has been deleted or modified
 func (a *ServiceObject) CheckFile() bool {
+	// Content changes are allowed under the perms policy
+	if !a.checksContent() {
+		return true
+	}
 	if a.isDir {
-		return FileExists(a.Path)
+		if IsDir(a.Path) && !IsLink(a.Path) {
+			return true
+		}
+		a.seen = "deleted"
+		return false
+	}
+	current, err := GetStat(a.Path)
+	if err {
+		a.seen = "deleted"
+		return false
+	}
+	// A link replaced by a regular file (or vice versa) is always a change,
+	// regardless of what the checksum says
+	if current.IsLink() != a.isLink {
+		a.stat = fileStat{}
+		a.seen = "type"
+		return false
+	}
+	// A change that was already reported doesn't need to be hashed again
+	if a.Policy == policyAlert && a.seenStat.valid && current == a.seenStat {
+		return false
 	}
+	// If nothing about the file has changed since its checksum was last
+	// verified, skip the hash. Every config.rehashEvery checks we hash
+	// anyway, to catch anyone restoring the timestamps by hand.
+	a.checks++
+	if a.stat.valid && current == a.stat && (config.rehashEvery <= 0 || a.checks < config.rehashEvery) {
+		return true
+	}
+	a.checks = 0
 	// Get the SHA checksum of the file's current state
 	// and compare it to the one stored in memory
 	sha, err := a.GetSHA()
@@ -80,11 +173,39 @@ func (a *ServiceObject) CheckFile() bool {
 		return false
 	}
 	if sha != a.Checksum {
+		a.stat = fileStat{}
+		a.seen = sha
+		a.seenStat = current
 		return false
 	}
+	// The stat was taken before hashing, so any write that
+	// raced the hash will still show up on the next check
+	a.stat = current
 	return true
 }
 
+// Get the stat fields used by the CheckFile fast path.
+// Symlinks are not followed.
+func GetStat(path string) (fileStat, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return fileStat{}, true
+	}
+	return fileStat{
+		valid: true,
+		mode:  st.Mode,
+		size:  st.Size,
+		mtime: st.Mtim,
+		ctime: st.Ctim,
+		ino:   st.Ino,
+		dev:   st.Dev,
+	}, false
+}
+
+func (a fileStat) IsLink() bool {
+	return a.mode&syscall.S_IFMT == syscall.S_IFLNK
+}
+
 func (a *Service) Init() bool {
 	var err bool
 	// Initialize the locations array
@@ -102,6 +223,7 @@ func (a *Service) Init() bool {
 		}
 		// If it does, get the SHA (from backup or from current state if no backup / disabled)
 		location.Checksum, err = location.GetBackupSHA()
+		location.CheckPolicy(a.Name)
 	}
 	if err {
 		Warnf("Filepath error while importing %s. Skipping...\n", a.Name)
@@ -113,53 +235,156 @@ func (a *Service) Init() bool {
 // Initialize a file object
 func (a *ServiceObject) InitSO() bool {
 	var err bool
+	// Directories have no contents to hash
+	if a.isDir {
+		if !FileExists(a.Path) {
+			Warnf("Filepath error while importing %s. Skipping...\n", a.Name)
+			return false
+		}
+		return true
+	}
 	a.Checksum, err = a.GetBackupSHA()
 	if err {
 		Warnf("Filepath error while importing %s. Skipping...\n", a.Name)
 		return false
 	}
+	a.CheckPolicy(a.Name)
 	return true
 }
 
-// Add a directory and all of its files & subfolders recursively
-func AddDir(path string, files []*ServiceObject) []*ServiceObject {
+// Add all of a folder's files & subfolders recursively, skipping
+// anything outside the directory's filters
+func (a *Directory) AddDir(path string, files []*ServiceObject) []*ServiceObject {
 	// Iterate through all items in the directory
 	items, _ := ioutil.ReadDir(path)
 	for _, item := range items {
 		// Get the path of the current item
 		subPath := ConcatenatePath(path, item.Name())
-		if item.IsDir() {
-			// Create a file object for the directory
-			newDir := &ServiceObject{
-				Name:  subPath,
-				Path:  subPath,
-				isDir: true,
-			}
-			// Make sure directory successfully inits first
-			if newDir.InitSO() {
-				newDir.InitBackup()
-				files = append(files, newDir)
-				// Recusively add all files and items in the subdirectory
-				files = append(files, AddDir(subPath, []*ServiceObject{})...)
-			}
+		if a.InScope(subPath, item) {
+			files = a.AddPath(subPath, item.IsDir(), files)
+		}
+	}
+	return files
+}
+
+// Add a single item in a directory (and everything below it, if it's a folder)
+func (a *Directory) AddPath(path string, isDir bool, files []*ServiceObject) []*ServiceObject {
+	if isDir {
+		// Create a file object for the directory
+		newDir := &ServiceObject{
+			Name:  path,
+			Path:  path,
+			isDir: true,
+		}
+		// Make sure directory successfully inits first
+		if newDir.InitSO() {
+			newDir.InitBackup()
+			files = append(files, newDir)
+			// Recusively add all files and items in the subdirectory
+			files = append(files, a.AddDir(path, []*ServiceObject{})...)
+		}
+	} else {
+		// If the item is a file, just add it to the files array.
+		// ReadDir uses lstat, so symlinks (even ones pointing at
+		// folders) end up here and are protected as links.
+		newFile := &ServiceObject{
+			Name:  path,
+			Path:  path,
+			isDir: false,
+		}
+		if newFile.InitSO() {
+			newFile.InitBackup()
+			files = append(files, newFile)
+		}
+	}
+	return files
+}
+
+// Make the current contents of a directory its new baseline. Files
+// that were removed are dropped, and new files are added. Returns the
+// number of files accepted, added and removed. The caller must hold isFreeing.
+func (a *Directory) Accept() (int, int, int) {
+	accepted, added, removed := 0, 0, 0
+	var files []*ServiceObject
+	for _, file := range a.files {
+		if file.Accept() {
+			files = append(files, file)
+			accepted++
 		} else {
-			// If the item is a file, just add it to the files array
-			newFile := &ServiceObject{
-				Name:  subPath,
-				Path:  subPath,
-				isDir: false,
-			}
-			if newFile.InitSO() {
-				newFile.InitBackup()
-				files = append(files, newFile)
-			}
+			file.FreeBackup()
+			removed++
 		}
 	}
+	for _, path := range a.FindNewFiles() {
+		before := len(files)
+		files = a.AdoptPath(path, files)
+		added += len(files) - before
+	}
+	a.files = files
+	a.known = map[string]bool{}
+	for _, file := range a.files {
+		a.known[file.Path] = true
+	}
+	a.alerted = map[string]bool{}
+	a.ApplyOptions()
+	return accepted, added, removed
+}
+
+// Add a new item to a directory's files. A stale copy of the path may
+// be sitting in the backup folder from an earlier run, so the
+// baseline is always taken from the file itself.
+func (a *Directory) AdoptPath(path string, files []*ServiceObject) []*ServiceObject {
+	before := len(files)
+	files = a.AddPath(path, IsDir(path) && !IsLink(path), files)
+	for _, file := range files[before:] {
+		file.Accept()
+	}
 	return files
 }
 
+// Add a single new file (or folder) to a directory's baseline.
+// The caller must hold isFreeing.
+func (a *Directory) Adopt(path string) bool {
+	if a.known[path] || !a.known[filepath.Dir(path)] {
+		return false
+	}
+	info, err := os.Lstat(path)
+	if err != nil || !a.InScope(path, info) {
+		return false
+	}
+	before := len(a.files)
+	a.files = a.AdoptPath(path, a.files)
+	for _, file := range a.files[before:] {
+		a.known[file.Path] = true
+	}
+	delete(a.alerted, path)
+	a.ApplyOptions()
+	return len(a.files) > before
+}
+
+// Apply the directory's history retention, policy and interval to every file in it.
+// Files are added before this is set, so prune anything they saved past it.
+// Files with a policy or interval of their own keep it.
+func (a *Directory) ApplyOptions() {
+	for _, file := range a.files {
+		if file.Generations != a.Generations {
+			file.Generations = a.Generations
+			file.PruneHistory()
+		}
+		if file.Policy != a.Policy && !file.ownPolicy {
+			file.SetPolicy(a.Policy)
+		}
+		if !file.ownInterval {
+			file.Interval = a.Interval
+		}
+	}
+}
+
 // Initialize a directory object
 func (a *Directory) InitDir() bool {
+	// New files are matched against their parent folder's path, so strip any trailing slash
+	a.Path = filepath.Clean(a.Path)
+	a.CheckPatterns()
 	if FileExists(a.Path) {
 		// Create the ServiceObject for the top directory
 		topDir := &ServiceObject{
@@ -172,7 +397,24 @@ func (a *Directory) InitDir() bool {
 			topDir.InitBackup()
 		}
 		// Add all files recursively
-		a.files = AddDir(a.Path, []*ServiceObject{topDir})
+		a.files = a.AddDir(a.Path, []*ServiceObject{topDir})
+		a.known = map[string]bool{}
+		for _, file := range a.files {
+			a.known[file.Path] = true
+		}
+		if a.Policy == "" {
+			a.Policy = policyRestore
+		} else if !contains(policies, a.Policy) {
+			Warnf("Invalid policy (%s) for %s. Using %s.\n", a.Policy, a.Name, policyRestore)
+			a.Policy = policyRestore
+		}
+		a.ApplyOptions()
+		if a.NewFiles == "" {
+			a.NewFiles = newFilesAlert
+		} else if !contains(newFilesPolicies, a.NewFiles) {
+			Warnf("Invalid new_files policy (%s) for %s. Using %s.\n", a.NewFiles, a.Name, newFilesAlert)
+			a.NewFiles = newFilesAlert
+		}
 		return true
 	}
 	Warnf("Directory %s doesn't exist. Skipping...", a.Path)
@@ -194,44 +436,72 @@ func (a *ServiceObject) GetBackupSHA() (string, bool) {
 		path = filename
 		doEncrypt = true
 	}
-	f, err := os.Open(path)
+	// Links are hashed by their target rather than followed
+	if IsLink(path) {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "ERR", true
+		}
+		return LinkSHA(target), false
+	}
+	// If we're reading from a backup, follow it to its blob and decrypt it as it's hashed
+	var f io.ReadCloser
+	var err error
+	if doEncrypt {
+		f, err = OpenStored(path)
+	} else {
+		f, err = os.Open(path)
+	}
 	if err != nil {
 		return "ERR", true
 	}
 	defer f.Close()
-	read, err := ioutil.ReadAll(f)
+	// Return the sha256 in string format
+	ret, err := HashReader(f)
 	if err != nil {
 		return "ERR", true
 	}
-	// If we're reading from a backup, decrypt it
-	if config.doEncryption && doEncrypt {
-		read = decrypt(read, config.key)
-	}
-	// Return the sha256 in string format
-	sha := sha256.Sum256(read)
-	ret := hex.EncodeToString(sha[:])
 	return ret, false
 }
 
 // Get the SHA256 checksum of a file object
 func (a *ServiceObject) GetSHA() (string, bool) {
+	if IsLink(a.Path) {
+		target, err := os.Readlink(a.Path)
+		if err != nil {
+			return "ERR", true
+		}
+		return LinkSHA(target), false
+	}
 	f, err := os.Open(a.Path)
 	if err != nil {
 		return "ERR", true
 	}
 	defer f.Close()
-	read, _ := ioutil.ReadAll(f)
-	sha := sha256.Sum256(read)
-	ret := hex.EncodeToString(sha[:])
+	ret, err := HashReader(f)
+	if err != nil {
+		return "ERR", true
+	}
 	return ret, false
 }
 
-// Remove the backup file when freeing a file
+// Get the checksum used for a symlink, which is the hash of its target
+func LinkSHA(target string) string {
+	sha := sha256.Sum256([]byte(target))
+	return hex.EncodeToString(sha[:])
+}
+
+// Remove the backup file when freeing a file. Its blob is only deleted
+// once nothing else points at it. The caller must hold isFreeing.
 func (a *ServiceObject) FreeBackup() {
 	filename := GetConfigName(a.Path)
-	if FileExists(filename) {
+	// Another object may still be protecting the same path
+	if BackupExists(a.Path) && !a.PathInUse() {
 		os.Remove(filename)
+		blobs.Unref(filename)
 	}
+	a.releaseBuffer()
+	a.blob = ""
 }
 
 // Initialize the backup for a file
@@ -246,35 +516,158 @@ func (a *ServiceObject) InitBackup() {
 		doEncrypt = true
 		path = filename
 	}
-	// Get permissions, owner, etc.
-	stat, _ := os.Stat(path)
-	inf := stat.Sys().(*syscall.Stat_t)
+	if !a.ReadState(path, doEncrypt) && doEncrypt {
+		Warnf("Could not read the backup of %s. Using the current file...\n", a.Path)
+		a.ReadState(a.Path, false)
+	}
+	if config.doBackup {
+		a.WriteStore()
+	}
+	a.DropBackup()
+}
+
+// Read the baseline of an object (contents, permissions, owner,
+// attributes and flags) from path, which is either the file itself
+// or its copy in the backup folder. Returns false if the contents
+// couldn't be read.
+func (a *ServiceObject) ReadState(path string, doEncrypt bool) bool {
+	// Get permissions, owner, etc. Symlinks are recorded as links
+	// rather than as whatever they happen to point at.
+	// The path can disappear between noticing it and reading it
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	inf, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
 	a.Owner = int(inf.Uid)
 	a.Group = int(inf.Gid)
 	a.Mode = stat.Mode()
-	// If the file isn't a directory, read and store the file's contents
-	if !a.isDir {
-		f, _ := os.Open(path)
-		a.Backup, _ = ioutil.ReadAll(f)
-		if doEncrypt {
-			a.Backup = decrypt(a.Backup, config.key)
+	a.isLink = stat.Mode()&os.ModeSymlink != 0
+	a.releaseBuffer()
+	a.blob = ""
+	if a.isLink {
+		// The backup of a link is just where it points
+		a.Target, _ = os.Readlink(path)
+		a.Backup = []byte(a.Target)
+		a.xattrs = nil
+	} else {
+		// The backup file carries the original's xattrs, same as its mode
+		a.xattrs = GetXattrs(path)
+	}
+	// Inode flags can't be stored on the backup (an immutable backup
+	// couldn't be rewritten), so they always come from the live file
+	flags, err := GetFlags(a.Path)
+	a.flags = flags
+	a.hasFlags = err == nil
+	a.streamed = false
+	if a.isLink || a.isDir {
+		return true
+	}
+	// If the file isn't a directory, read and store the file's contents.
+	// Backups in the backup folder are followed to their blob.
+	var f io.ReadCloser
+	if doEncrypt {
+		f, err = OpenStored(path)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	// In low memory mode big files go straight into the blob store,
+	// so they're never held in memory at all
+	if a.streamsAt(StoredSize(path, stat, doEncrypt)) {
+		key, checksum, size, err := blobs.WriteStream(f)
+		if err != nil {
+			return false
 		}
-		defer f.Close()
+		a.blob = key
+		a.Checksum = checksum
+		a.size = size
+		a.streamed = true
+		return true
 	}
-	if config.doBackup {
-		// Write to the backup file
-		cnfPath := GetConfigName(a.Path)
-		if a.isDir {
-			cnfPath = cnfPath + "._."
-		} else if config.doEncryption {
-			writeFile(cnfPath, encrypt(a.Backup, config.key))
-		} else {
-			writeFile(cnfPath, a.Backup)
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false
+	}
+	a.setBackup(contents)
+	return true
+}
+
+// Write an object's baseline to the backup folder
+func (a *ServiceObject) WriteStore() bool {
+	cnfPath := GetConfigName(a.Path)
+	if a.isDir {
+		// Directories have no contents to back up
+		return true
+	} else if a.isLink {
+		// Store links as links, so they're recognized when loading from backup
+		if !SymlinkAtomic(a.Target, cnfPath, a.Owner, a.Group) {
+			return false
 		}
-		// Set the backup's permisssions to match the file
-		os.Chmod(cnfPath, a.Mode)
-		os.Chown(cnfPath, a.Owner, a.Group)
+		// It may have been a file before
+		blobs.Unref(cnfPath)
+		return a.SaveGeneration()
+	}
+	// The contents go in the blob store, and the backup just points at them
+	if !a.writePointer(cnfPath) {
+		return false
 	}
+	return a.SaveGeneration()
+}
+
+// Get the checksum of an object's backup in memory
+func (a *ServiceObject) BackupSHA() string {
+	if a.isLink {
+		return LinkSHA(a.Target)
+	}
+	if a.streamed {
+		// Backups on disk are checked against this every time they're read
+		return a.Checksum
+	}
+	sha := sha256.Sum256(a.Backup)
+	return hex.EncodeToString(sha[:])
+}
+
+// Make the current state of an object on disk its new baseline, for
+// when one of our own admins changes a file. The caller must hold isFreeing.
+func (a *ServiceObject) Accept() bool {
+	if !FileExists(a.Path) {
+		return false
+	}
+	// A protected folder can't turn into a file (or vice versa)
+	if a.isDir != (IsDir(a.Path) && !IsLink(a.Path)) {
+		return false
+	}
+	flags := a.flags
+	if !a.ReadState(a.Path, false) {
+		return false
+	}
+	// The immutable bit we set ourselves isn't part of the baseline
+	if config.lockdown || a.locked {
+		a.flags = a.flags&^FS_IMMUTABLE_FL | flags&FS_IMMUTABLE_FL
+	}
+	// Hash what was read rather than reading the file again
+	if !a.isDir {
+		a.Checksum = a.BackupSHA()
+	}
+	a.stat = fileStat{}
+	a.checks = 0
+	a.restores = nil
+	a.flapping = false
+	a.alerted = ""
+	a.alertedPerms = ""
+	a.seenStat = fileStat{}
+	if config.doBackup && !a.WriteStore() {
+		return false
+	}
+	a.DropBackup()
+	return true
 }
 
 // Initialize the backup folder
@@ -309,56 +702,119 @@ func (e *ServiceObject) writeBackup() bool {
 		// Each file object is scanned directly, so once we restore
 		// the directory, the files and directories below it will
 		// automatically be restored as well
+		if IsLink(e.Path) {
+			// Don't chmod whatever the link points to
+			os.Remove(e.Path)
+		}
 		if !FileExists(e.Path) {
 			err := os.Mkdir(e.Path, e.Mode)
 			if err != nil {
-				if config.outputEnabled {
+				if e.verbose() {
 					Warnf("Error: Could not restore directory %s", e.Name)
 				}
 				return false
 			}
 		}
 		// We don't really need this but better safe than sorry idk
-		os.Chmod(e.Path, e.Mode)
-		os.Chown(e.Path, e.Owner, e.Group)
+		ClearBlockingFlags(e.Path)
+		ApplyAttrs(e.Path, e.Mode, e.Owner, e.Group, e.xattrs)
+		e.applyFlags()
 		return true
 	}
+	if e.isLink {
+		return e.writeLink()
+	}
+	// If red team swapped the file for a symlink, remove the link
+	// so we don't write the backup to wherever it points
+	if IsLink(e.Path) {
+		if e.verbose() {
+			fmt.Printf("File %s was replaced by a symlink. Removing link...\n", e.Path)
+		}
+		os.Remove(e.Path)
+	}
 	// Check to see if the file was deleted or just modified
 	if !FileExists(e.Path) {
-		if config.outputEnabled {
+		if e.verbose() {
 			fmt.Printf("File %s was deleted. Restoring...\n", e.Path)
 		}
-		// See if file is immutable
-	} else if IsImmutable(e.Path) {
-		if config.outputEnabled {
-			fmt.Printf("File %s is immutable. Removing immutable flag...\n", e.Path)
+		// See if file is immutable or append only
+	} else if flags, cleared := ClearBlockingFlags(e.Path); cleared {
+		if e.verbose() {
+			fmt.Printf("File %s has blocking flags set (%s). Removing them...\n", e.Path, FlagString(flags))
 		}
-		RemoveImmutable(e.Path)
 	}
-	// Restore the backup
-	ret := writeFile(e.Path, e.Backup)
-	if ret {
-		err := os.Chmod(e.Path, e.Mode)
-		if err != nil {
-			if config.outputEnabled {
-				fmt.Printf("Error setting permissions for %s", e.Path)
+	// An immutable parent folder would stop us from recreating the file.
+	// Its flags are put back once we're done.
+	parent := filepath.Dir(e.Path)
+	parentFlags, parentCleared := ClearBlockingFlags(parent)
+	// Restore the backup. This writes to a temp file and renames it into
+	// place, so nothing reading the file ever sees it truncated.
+	ret := WriteStreamAtomic(e.Path, e.OpenBackup, e.Mode, e.Owner, e.Group, e.xattrs)
+	if parentCleared {
+		SetFlags(parent, parentFlags)
+	}
+	if !ret {
+		if e.verbose() {
+			fmt.Printf("Error restoring %s\n", e.Path)
+		}
+		return false
+	}
+	e.applyFlags()
+	return true
+}
+
+// Restore a symlink by recreating the link itself
+func (e *ServiceObject) writeLink() bool {
+	if stat, err := os.Lstat(e.Path); err == nil {
+		if e.verbose() {
+			if stat.Mode()&os.ModeSymlink == 0 {
+				fmt.Printf("Symlink %s was replaced by a file. Restoring link...\n", e.Path)
+			} else {
+				fmt.Printf("Symlink %s was retargeted. Restoring link...\n", e.Path)
 			}
-			return false
 		}
-		os.Chown(e.Path, e.Owner, e.Group)
+		UnblockTree(e.Path)
+		// A rename can replace a file or link, but not a folder
+		if stat.IsDir() {
+			if err := os.RemoveAll(e.Path); err != nil {
+				return false
+			}
+		}
+	} else if e.verbose() {
+		fmt.Printf("Symlink %s was deleted. Restoring...\n", e.Path)
 	}
-	return ret
+	return SymlinkAtomic(e.Target, e.Path, e.Owner, e.Group)
 }
 
 // Revert the permissions of a file back to its backup
 func (e *ServiceObject) WritePerms() bool {
-	err := os.Chmod(e.Path, e.Mode)
-	if err != nil {
-		return false
+	if e.isLink {
+		return os.Lchown(e.Path, e.Owner, e.Group) == nil
 	}
-	err = os.Chown(e.Path, e.Owner, e.Group)
-	if err != nil {
-		return false
+	ClearBlockingFlags(e.Path)
+	ok := ApplyAttrs(e.Path, e.Mode, e.Owner, e.Group, e.xattrs)
+	return e.applyFlags() && ok
+}
+
+// Check if output should be printed for an object. Restores
+// of flapping objects are silenced to avoid flooding the console.
+func (e *ServiceObject) verbose() bool {
+	return config.outputEnabled && !e.flapping
+}
+
+// Get the inode flags a file should have. In lockdown mode,
+// regular files are also made immutable.
+func (e *ServiceObject) ExpectedFlags() uint32 {
+	if (config.lockdown || e.locked) && !e.isDir && !e.isLink {
+		return e.flags | FS_IMMUTABLE_FL
 	}
-	return true
+	return e.flags
+}
+
+// Put a file's inode flags back after restoring it
+func (e *ServiceObject) applyFlags() bool {
+	if !e.hasFlags {
+		return true
+	}
+	return SetFlags(e.Path, e.ExpectedFlags()) == nil
 }
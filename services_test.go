@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatFastPath(t *testing.T) {
+	dir := tempBackupFolder(t)
+	config.rehashEvery = 0
+	path := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(path, mtime, mtime)
+	a := &ServiceObject{Name: "a", Path: path}
+	if !a.InitSO() {
+		t.Fatal("couldn't initialize a")
+	}
+	if !a.CheckFile() || !a.stat.valid {
+		t.Fatal("the first check didn't pass and save the stat")
+	}
+
+	t.Run("same size rewrite with the mtime put back", func(t *testing.T) {
+		// Let the ctime tick over
+		time.Sleep(10 * time.Millisecond)
+		if err := ioutil.WriteFile(path, []byte("tampered"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+		if a.CheckFile() {
+			t.Errorf("the rewrite wasn't noticed")
+		}
+		if a.stat.valid {
+			t.Errorf("the stat of a changed file was kept")
+		}
+		ioutil.WriteFile(path, []byte("original"), 0644)
+		if !a.CheckFile() {
+			t.Errorf("the original contents didn't pass")
+		}
+	})
+
+	t.Run("unchanged files are only rehashed every rehash checks", func(t *testing.T) {
+		// A wrong checksum is only noticed when the file is hashed
+		checksum := a.Checksum
+		defer func() { a.Checksum = checksum }()
+		a.Checksum = "wrong"
+		config.rehashEvery = 3
+		a.checks = 0
+		for i := 1; i < config.rehashEvery; i++ {
+			if !a.CheckFile() {
+				t.Fatalf("check %d hashed an unchanged file", i)
+			}
+		}
+		if a.CheckFile() {
+			t.Errorf("check %d didn't hash the file", config.rehashEvery)
+		}
+	})
+}
@@ -0,0 +1,521 @@
+/*
+settings.go- Runtime settings. Every setting can come from four
+places, and each one overrides the last:
+defaults < the settings section of config.json < BANDAID_<NAME>
+environment variables < command line flags.
+Changes made from the console are tracked too, so the settings
+command can show where each value came from.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where a setting's value came from
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+	sourceConsole = "console"
+)
+
+// A single setting, and how to read and write it
+type Setting struct {
+	name    string
+	usage   string
+	startup bool                             // Only read at startup, so it can't be changed while running
+	source  string                           // Where the current value came from
+	def     string                           // Default value
+	value   func() interface{}               // Current value, as it's written to the config file
+	parse   func(string) (interface{}, bool) // Parse a value, returns false if it's invalid
+	apply   func(interface{})                // Set a parsed value
+	changed func()                           // Called after a change while running, if anything needs updating
+}
+
+// Command line flags that set a setting. Flags with a value
+// set it to that, and anything else takes an argument.
+type flagSetting struct {
+	short   string
+	long    string
+	setting string
+	value   string
+}
+
+// Every setting, in the order they're listed and saved. Built by InitSettings.
+var settings []*Setting
+
+var flagSettings []flagSetting = []flagSetting{
+	{"-c", "--no-ipchairs", "ipchairs", "false"},
+	{"-n", "--no-backup", "backup", "false"},
+	{"-e", "--no-encrypt", "encrypt", "false"},
+	{"-r", "--no-restore", "restore", "false"},
+	{"-b", "--backup", "backup_location", ""},
+	{"-q", "--quiet", "output", "false"},
+	{"-u", "--upkeep", "upkeep", "false"},
+	{"-p", "--no-perms", "perms", "false"},
+	{"-d", "--delay", "interval", ""},
+	{"-i", "--icmpdelay", "icmp_interval", ""},
+	{"-w", "--no-watch", "watch", "false"},
+	{"-s", "--safety", "safety_interval", ""},
+	{"-j", "--workers", "workers", ""},
+	{"-x", "--rehash", "rehash", ""},
+	{"-F", "--no-forensics", "forensics", "false"},
+	{"-l", "--lockdown", "lockdown", "true"},
+	{"-t", "--flap-threshold", "flap_threshold", ""},
+	{"-W", "--flap-window", "flap_window", ""},
+	{"-a", "--flap-actions", "flap_actions", ""},
+	{"-g", "--generations", "generations", ""},
+	{"-m", "--low-memory", "low_memory", "true"},
+	{"-M", "--mem-threshold", "mem_threshold", ""},
+	{"-P", "--priority", "priority_interval", ""},
+	{"-J", "--jitter", "jitter", ""},
+	{"-R", "--no-reload", "auto_reload", "false"},
+	{"-S", "--autosave", "autosave", "true"},
+}
+
+func boolSetting(name string, usage string, p *bool) *Setting {
+	return &Setting{
+		name:  name,
+		usage: usage,
+		value: func() interface{} { return *p },
+		parse: func(s string) (interface{}, bool) {
+			b, err := strconv.ParseBool(s)
+			return b, err == nil
+		},
+		apply: func(v interface{}) { *p = v.(bool) },
+	}
+}
+
+// An int setting with a minimum, and a maximum if max isn't -1
+func intSetting(name string, usage string, p *int, min int, max int) *Setting {
+	return &Setting{
+		name:  name,
+		usage: usage,
+		value: func() interface{} { return *p },
+		parse: func(s string) (interface{}, bool) {
+			n, err := strconv.Atoi(s)
+			return n, err == nil && n >= min && (max < 0 || n <= max)
+		},
+		apply: func(v interface{}) { *p = v.(int) },
+	}
+}
+
+func int64Setting(name string, usage string, p *int64) *Setting {
+	return &Setting{
+		name:  name,
+		usage: usage,
+		value: func() interface{} { return *p },
+		parse: func(s string) (interface{}, bool) {
+			n, err := strconv.ParseInt(s, 10, 64)
+			return n, err == nil && n >= 0
+		},
+		apply: func(v interface{}) { *p = v.(int64) },
+	}
+}
+
+// An interval in milliseconds
+func durationSetting(name string, usage string, p *time.Duration, min int) *Setting {
+	return &Setting{
+		name:  name,
+		usage: usage,
+		value: func() interface{} { return int(*p) },
+		parse: func(s string) (interface{}, bool) {
+			n, err := strconv.Atoi(s)
+			return time.Duration(n), err == nil && n >= min
+		},
+		apply: func(v interface{}) { *p = v.(time.Duration) },
+	}
+}
+
+func stringSetting(name string, usage string, p *string) *Setting {
+	return &Setting{
+		name:  name,
+		usage: usage,
+		value: func() interface{} { return *p },
+		parse: func(s string) (interface{}, bool) { return s, s != "" },
+		apply: func(v interface{}) { *p = v.(string) },
+	}
+}
+
+// A comma separated list, where every item has to pass check (if it's set)
+func listSetting(name string, usage string, p *[]string, check func(string) bool) *Setting {
+	return &Setting{
+		name:  name,
+		usage: usage,
+		value: func() interface{} { return *p },
+		parse: func(s string) (interface{}, bool) {
+			list := []string{}
+			for _, item := range strings.Split(s, ",") {
+				item = strings.TrimSpace(item)
+				if item == "" {
+					continue
+				}
+				if check != nil && !check(item) {
+					return nil, false
+				}
+				list = append(list, item)
+			}
+			return list, true
+		},
+		apply: func(v interface{}) { *p = v.([]string) },
+	}
+}
+
+// Check if a string is a port number
+func isPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0 && n < 65536
+}
+
+// Build the list of settings. Has to be called after the defaults are set and
+// IpChairs is initialized, since settings point straight at their fields.
+func InitSettings() {
+	flapActionsSetting := listSetting("flap_actions", "Escalation for flapping files (alert,interval,lock,kill)", &config.flapActions, nil)
+	flapActionsSetting.parse = func(s string) (interface{}, bool) {
+		return ParseFlapActions(s)
+	}
+	ip := ipchairs.config
+	settings = []*Setting{
+		durationSetting("interval", "Default check interval (ms)", &config.delay, 1),
+		durationSetting("icmp_interval", "ICMP check interval (ms)", &config.icmpDelay, 1),
+		stringSetting("backup_location", "Folder to store backups in", &config.backupLocation),
+		boolSetting("output", "Print changes as they're found", &config.outputEnabled),
+		boolSetting("restore", "Load baselines from the backup folder at startup", &config.loadFromConfig),
+		boolSetting("backup", "Keep baselines in the backup folder", &config.doBackup),
+		boolSetting("encrypt", "Encrypt the backup folder", &config.doEncryption),
+		boolSetting("upkeep", "Restart stopped services", &config.upkeep),
+		boolSetting("perms", "Check permissions and attributes", &config.checkPerms),
+		boolSetting("watch", "Watch protected files with inotify", &config.watch),
+		durationSetting("safety_interval", "Check interval while inotify is watching (ms)", &config.safetyDelay, 1),
+		intSetting("workers", "Files verified concurrently", &config.workers, 1, -1),
+		boolSetting("timing", "Print a timing report after every sweep", &config.timing),
+		intSetting("rehash", "Fully rehash unchanged files every n checks (0 to never)", &config.rehashEvery, 0, -1),
+		boolSetting("forensics", "Capture tampered files before restoring them", &config.forensics),
+		int64Setting("forensics_max_size", "Max bytes captured from a single file", &config.forensicMaxSize),
+		int64Setting("forensics_max_total", "Max total size of the forensics folder", &config.forensicMaxTotal),
+		intSetting("forensics_keep", "Max samples kept for each path", &config.forensicKeep, 0, -1),
+		boolSetting("diff", "Print a diff of tampered files", &config.showDiff),
+		boolSetting("lockdown", "Make protected files immutable after restoring them", &config.lockdown),
+		intSetting("flap_threshold", "Restores within the flap window before a file is flapping (0 to disable)", &config.flapThreshold, 0, -1),
+		durationSetting("flap_window", "Flap window (ms)", &config.flapWindow, 0),
+		durationSetting("flap_interval", "Check interval for flapping files (ms)", &config.flapDelay, 1),
+		flapActionsSetting,
+		intSetting("generations", "Past baselines kept for each file", &config.generations, 1, -1),
+		boolSetting("low_memory", "Keep large backups on disk only", &config.lowMemory),
+		int64Setting("mem_threshold", "Backups over this many bytes stay on disk in low memory mode", &config.memThreshold),
+		listSetting("priority_paths", "Files and folders checked every priority interval", &config.priorityPaths, nil),
+		durationSetting("priority_interval", "Check interval for priority files (ms)", &config.priorityDelay, 1),
+		intSetting("jitter", "Percent check intervals are randomized by", &config.jitter, 0, 100),
+		boolSetting("auto_reload", "Reload the config file when it changes", &config.autoReload),
+		durationSetting("reload_interval", "How often the config file is checked for changes (ms)", &config.reloadDelay, 100),
+		boolSetting("autosave", "Save changes made from the console to the config file", &config.autoSave),
+		boolSetting("ipchairs", "Run IpChairs at all", &config.ipChairs),
+		boolSetting("ipchairs_enabled", "Enforce the IpChairs rules", &ip.enabled),
+		boolSetting("ipchairs_demo", "Don't actually change any rules", &ip.demo),
+		boolSetting("ipchairs_safe_mode", "Safe mode (off for iron wall)", &ip.safeMode),
+		boolSetting("ipchairs_only_flush", "Flush all rules and don't create new ones", &ip.onlyFlush),
+		boolSetting("ipchairs_disable_firewalls", "Disable firewalld and ufw", &ip.disableFirewalls),
+		boolSetting("ipchairs_flush_all", "Flush existing rules before creating ours", &ip.flushAllAllow),
+		boolSetting("ipchairs_pre_drop", "Drop everything before creating rules", &ip.preDrop),
+		boolSetting("ipchairs_pre_kill", "Try to drop all connections first", &ip.preKill),
+		boolSetting("ipchairs_basic_flush", "Only flush with iptables -F", &ip.basicFlush),
+		boolSetting("ipchairs_allow_established", "Allow established connections", &ip.allowEstablished),
+		boolSetting("ipchairs_allow_icmp", "Allow ICMP", &ip.allowICMP),
+		listSetting("ipchairs_tcp", "TCP ports to allow", &ipchairs.tcp, isPort),
+		listSetting("ipchairs_udp", "UDP ports to allow", &ipchairs.udp, isPort),
+	}
+	for _, name := range []string{"backup_location", "restore", "backup", "encrypt", "ipchairs"} {
+		FindSetting(name).startup = true
+	}
+	FindSetting("watch").changed = func() {
+		if config.watch && !watcher.Enabled() {
+			InitWatcher()
+		}
+	}
+	applyMemory := func() {
+		isFreeing.Lock()
+		ApplyMemoryMode()
+		isFreeing.Unlock()
+	}
+	FindSetting("low_memory").changed = applyMemory
+	FindSetting("mem_threshold").changed = applyMemory
+	for _, s := range settings {
+		s.def = s.String()
+		s.source = sourceDefault
+	}
+}
+
+// Find a setting by name
+func FindSetting(name string) *Setting {
+	for _, s := range settings {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Get the environment variable for a setting
+func (s *Setting) Env() string {
+	return "BANDAID_" + strings.ToUpper(s.name)
+}
+
+// Get the flag for a setting, if it has one
+func (s *Setting) Flag() string {
+	var flags []string
+	for _, f := range flagSettings {
+		if f.setting == s.name {
+			flags = append(flags, f.short+" | "+f.long)
+		}
+	}
+	return strings.Join(flags, ", ")
+}
+
+// Get a setting's value the way it's typed in
+func (s *Setting) String() string {
+	if list, ok := s.value().([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return fmt.Sprint(s.value())
+}
+
+// Set a setting and record where the value came from. Returns false if it's invalid.
+func (s *Setting) Set(value string, source string) bool {
+	v, ok := s.parse(value)
+	if !ok {
+		return false
+	}
+	s.apply(v)
+	s.source = source
+	return true
+}
+
+// Get a setting's value from the config file as a string. Lists are
+// joined with commas, so they parse the same as a flag.
+func rawSetting(raw json.RawMessage) (string, bool) {
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return str, true
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return strings.Join(list, ","), true
+	}
+	var v interface{}
+	if json.Unmarshal(raw, &v) != nil {
+		return "", false
+	}
+	switch v.(type) {
+	case bool, float64:
+		return string(bytes.TrimSpace(raw)), true
+	}
+	return "", false
+}
+
+// Check the settings section of a config file. Returns every problem.
+func CheckSettings(raw json.RawMessage) []string {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return []string{"settings must be an object"}
+	}
+	var problems []string
+	for name, value := range values {
+		s := FindSetting(name)
+		if s == nil {
+			problems = append(problems, fmt.Sprintf("Unknown setting (%s)", name))
+			continue
+		}
+		str, ok := rawSetting(value)
+		if ok {
+			_, ok = s.parse(str)
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("Invalid value for setting %s (%s)", name, string(value)))
+		}
+	}
+	return problems
+}
+
+// Check the settings section of a whole config file, if it has one
+func CheckFileSettings(configBytes []byte) []string {
+	var sections map[string]json.RawMessage
+	if json.Unmarshal(configBytes, &sections) != nil {
+		return nil
+	}
+	if raw, ok := sections["settings"]; ok {
+		return CheckSettings(raw)
+	}
+	return nil
+}
+
+// Apply the settings section of a config file. Settings that came from
+// the environment, a flag or the console are left alone, and settings
+// that are no longer in the file go back to their defaults. While
+// running, settings that are only read at startup are skipped. Returns
+// the names of the settings that changed, and any problems.
+func ApplyFileSettings(configBytes []byte, running bool) ([]string, []string) {
+	var sections map[string]json.RawMessage
+	if json.Unmarshal(configBytes, &sections) != nil {
+		return nil, nil
+	}
+	values := map[string]json.RawMessage{}
+	if raw, ok := sections["settings"]; ok && json.Unmarshal(raw, &values) != nil {
+		return nil, []string{"settings must be an object"}
+	}
+	var changed []string
+	var problems []string
+	for name := range values {
+		if FindSetting(name) == nil {
+			problems = append(problems, fmt.Sprintf("Unknown setting (%s)", name))
+		}
+	}
+	for _, s := range settings {
+		if s.source != sourceDefault && s.source != sourceFile {
+			continue
+		}
+		value, source := s.def, sourceDefault
+		if raw, ok := values[s.name]; ok {
+			str, ok := rawSetting(raw)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("Invalid value for setting %s (%s)", s.name, string(raw)))
+				continue
+			}
+			value, source = str, sourceFile
+		}
+		old := s.String()
+		if running && s.startup {
+			if value != old {
+				Warnf("%s can only be changed at startup. Restart bandaid to use the new value.\n", s.name)
+			}
+			continue
+		}
+		if !s.Set(value, source) {
+			problems = append(problems, fmt.Sprintf("Invalid value for setting %s (%s)", s.name, value))
+			continue
+		}
+		if s.String() != old {
+			changed = append(changed, s.name)
+			if running && s.changed != nil {
+				s.changed()
+			}
+		}
+	}
+	return changed, problems
+}
+
+// Apply the settings in the environment. Returns false if one is invalid.
+func ApplyEnvSettings() bool {
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.Env())
+		if !ok {
+			continue
+		}
+		if !s.Set(value, sourceEnv) {
+			Errorf("Error: invalid value for %s (%s)\n", s.Env(), value)
+			return false
+		}
+	}
+	return true
+}
+
+// Get the values of every setting, to see what a console command changed
+func SettingValues() []string {
+	var values []string
+	for _, s := range settings {
+		values = append(values, s.String())
+	}
+	return values
+}
+
+// Mark every setting that changed since before was taken as set from the console
+func MarkConsoleSettings(before []string) {
+	for i, s := range settings {
+		if s.String() != before[i] {
+			s.source = sourceConsole
+		}
+	}
+}
+
+// Get the settings section of the config file, in the same order as
+// settings. Only settings from the file or the console are written, and
+// anything from the environment or a flag keeps what the file had, so
+// one-off overrides don't end up saved.
+func SettingsJSON(existing json.RawMessage) (json.RawMessage, error) {
+	old := map[string]json.RawMessage{}
+	json.Unmarshal(existing, &old)
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for _, s := range settings {
+		var value []byte
+		switch s.source {
+		case sourceFile, sourceConsole:
+			v, err := json.Marshal(s.value())
+			if err != nil {
+				return nil, err
+			}
+			value = v
+		case sourceEnv, sourceFlag:
+			value = old[s.name]
+		}
+		if value == nil {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, "%q:%s", s.name, value)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// Handle the settings REPL command
+func SettingsCommand(args []string) {
+	switch len(args) {
+	case 1:
+		for _, s := range settings {
+			fmt.Printf("%-28s %-24s (%s)\n", s.name, s.String(), s.source)
+		}
+	case 2:
+		s := FindSetting(args[1])
+		if s == nil {
+			Errorf("Error: unknown setting\n")
+			return
+		}
+		fmt.Printf("%s: %s (%s)\n%s\nDefault: %s\nEnvironment: %s\n", s.name, s.String(), s.source, s.usage, s.def, s.Env())
+		if flag := s.Flag(); flag != "" {
+			fmt.Printf("Flag: %s\n", flag)
+		}
+	case 3:
+		s := FindSetting(args[1])
+		if s == nil {
+			Errorf("Error: unknown setting\n")
+			return
+		}
+		if s.startup {
+			Errorf("Error: %s can only be changed at startup\n", s.name)
+			return
+		}
+		if !s.Set(args[2], sourceConsole) {
+			Errorf("Error: invalid value for %s\n", s.name)
+			return
+		}
+		if s.changed != nil {
+			s.changed()
+		}
+		fmt.Printf("%s set to %s.\n", s.name, s.String())
+		// Pick up new intervals right away
+		RequestSweep()
+	default:
+		Errorf("Error: invalid number of arguments\n")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Set an environment variable for the rest of a test
+func setEnv(t *testing.T, key string, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// Run HandleArgs with the given arguments
+func handleArgs(t *testing.T, args ...string) {
+	saved := os.Args
+	os.Args = append([]string{"bandaid"}, args...)
+	defer func() { os.Args = saved }()
+	HandleArgs()
+}
+
+func TestSettingLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	withSetting := filepath.Join(dir, "with.json")
+	withoutSetting := filepath.Join(dir, "without.json")
+	ioutil.WriteFile(withSetting, []byte(`{"settings": {"jitter": 30, "watch": false}}`), 0644)
+	ioutil.WriteFile(withoutSetting, []byte(`{"settings": {"watch": false}}`), 0644)
+	tests := []struct {
+		name   string
+		file   bool
+		env    bool
+		flag   bool
+		value  string
+		source string
+	}{
+		{"default", false, false, false, "20", sourceDefault},
+		{"file beats default", true, false, false, "30", sourceFile},
+		{"env beats default", false, true, false, "40", sourceEnv},
+		{"env beats file", true, true, false, "40", sourceEnv},
+		{"flag beats default", false, false, true, "50", sourceFlag},
+		{"flag beats file", true, false, true, "50", sourceFlag},
+		{"flag beats env", false, true, true, "50", sourceFlag},
+		{"flag beats everything", true, true, true, "50", sourceFlag},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := []string{"-f", withoutSetting}
+			if test.file {
+				args[1] = withSetting
+			}
+			if test.env {
+				setEnv(t, "BANDAID_JITTER", "40")
+			}
+			if test.flag {
+				args = append(args, "-J", "50")
+			}
+			handleArgs(t, args...)
+			s := FindSetting("jitter")
+			if s.String() != test.value || s.source != test.source {
+				t.Errorf("jitter is %s (%s), want %s (%s)", s.String(), s.source, test.value, test.source)
+			}
+			// The rest of the file still applies
+			if w := FindSetting("watch"); w.String() != "false" || w.source != sourceFile {
+				t.Errorf("watch is %s (%s), want false (file)", w.String(), w.source)
+			}
+		})
+	}
+}
+
+func TestConfigFileLayers(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want string
+	}{
+		{"default", "", nil, "config.json"},
+		{"env", "env.json", nil, "env.json"},
+		{"flag", "", []string{"--configfile", "flag.json"}, "flag.json"},
+		{"flag beats env", "env.json", []string{"-f", "flag.json"}, "flag.json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				setEnv(t, "BANDAID_CONFIG", test.env)
+			}
+			// validate returns before anything is read
+			handleArgs(t, append([]string{"validate"}, test.args...)...)
+			if config.configFile != test.want {
+				t.Errorf("config file is %s, want %s", config.configFile, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyFileSettings(t *testing.T) {
+	resetSettings()
+	interval := FindSetting("interval")
+	jitter := FindSetting("jitter")
+	backup := FindSetting("backup_location")
+	load := func(contents string, running bool) ([]string, []string) {
+		return ApplyFileSettings([]byte(contents), running)
+	}
+
+	changed, problems := load(`{"settings": {"interval": 500, "jitter": 5, "backup_location": "/b"}}`, false)
+	checkMessages(t, "changed", changed, []string{"interval", "jitter", "backup_location"})
+	checkMessages(t, "problems", problems, nil)
+	if interval.String() != "500" || interval.source != sourceFile {
+		t.Errorf("interval is %s (%s), want 500 (file)", interval.String(), interval.source)
+	}
+
+	// Reloading leaves the environment, flags and the console alone,
+	// and settings that were taken out go back to their defaults
+	jitter.Set("50", sourceEnv)
+	changed, problems = load(`{"settings": {"jitter": 7, "backup_location": "/b"}}`, true)
+	checkMessages(t, "changed", changed, []string{"interval"})
+	checkMessages(t, "problems", problems, nil)
+	if interval.String() != interval.def || interval.source != sourceDefault {
+		t.Errorf("interval is %s (%s), want %s (default)", interval.String(), interval.source, interval.def)
+	}
+	if jitter.String() != "50" || jitter.source != sourceEnv {
+		t.Errorf("jitter is %s (%s), want 50 (env)", jitter.String(), jitter.source)
+	}
+	for _, source := range []string{sourceFlag, sourceConsole} {
+		interval.Set("900", source)
+		load(`{"settings": {"interval": 100}}`, true)
+		if interval.String() != "900" || interval.source != source {
+			t.Errorf("interval is %s (%s), want 900 (%s)", interval.String(), interval.source, source)
+		}
+	}
+
+	// Startup settings can't change while running
+	load(`{"settings": {"backup_location": "/elsewhere"}}`, true)
+	if backup.String() != "/b" {
+		t.Errorf("backup_location changed to %s while running", backup.String())
+	}
+	load(`{"settings": {"backup_location": "/elsewhere"}}`, false)
+	if backup.String() != "/elsewhere" {
+		t.Errorf("backup_location is %s, want /elsewhere", backup.String())
+	}
+}
+
+func TestSettingErrors(t *testing.T) {
+	resetSettings()
+	t.Run("file", func(t *testing.T) {
+		tests := []struct {
+			contents string
+			problems []string
+		}{
+			{`{"settings": {"intreval": 5}}`, []string{"Unknown setting (intreval)"}},
+			{`{"settings": {"interval": 0}}`, []string{"Invalid value for setting interval (0)"}},
+			{`{"settings": {"interval": "soon"}}`, []string{"Invalid value for setting interval (soon)"}},
+			{`{"settings": {"interval": {"ms": 5}}}`, []string{`Invalid value for setting interval ({"ms": 5})`}},
+			{`{"settings": {"jitter": 101}}`, []string{"Invalid value for setting jitter (101)"}},
+			{`{"settings": {"flap_actions": "alert,explode"}}`, []string{"Invalid value for setting flap_actions"}},
+			{`{"settings": {"ipchairs_tcp": [22, 80]}}`, []string{"Invalid value for setting ipchairs_tcp"}},
+			{`{"settings": {"ipchairs_tcp": ["22", "99999"]}}`, []string{"Invalid value for setting ipchairs_tcp"}},
+			{`{"settings": "interval=5"}`, []string{"settings must be an object"}},
+			// Not json at all is left for the rest of the config loading to report
+			{`{"settings": `, nil},
+		}
+		for _, test := range tests {
+			resetSettings()
+			_, problems := ApplyFileSettings([]byte(test.contents), false)
+			checkMessages(t, "problems", problems, test.problems)
+			if s := FindSetting("interval"); s.source != sourceDefault {
+				t.Errorf("%s: interval was set from the file", test.contents)
+			}
+		}
+	})
+	t.Run("env", func(t *testing.T) {
+		saved := colors
+		colors = Colors{}
+		defer func() { colors = saved }()
+		for _, value := range []string{"", "abc", "0", "-5"} {
+			resetSettings()
+			setEnv(t, "BANDAID_INTERVAL", value)
+			if ApplyEnvSettings() {
+				t.Errorf("BANDAID_INTERVAL=%q was accepted", value)
+			}
+		}
+		resetSettings()
+		setEnv(t, "BANDAID_INTERVAL", "250")
+		if !ApplyEnvSettings() || FindSetting("interval").String() != "250" {
+			t.Errorf("BANDAID_INTERVAL=250 wasn't applied")
+		}
+	})
+	t.Run("flag", func(t *testing.T) {
+		tests := []struct {
+			setting string
+			value   string
+			ok      bool
+		}{
+			{"interval", "250", true},
+			{"interval", "0", false},
+			{"interval", "1.5", false},
+			{"watch", "false", true},
+			{"watch", "nope", false},
+			{"workers", "0", false},
+			{"rehash", "0", true},
+			{"mem_threshold", "-1", false},
+			{"backup_location", "", false},
+			{"flap_actions", "alert,kill", true},
+			{"flap_actions", "alert,explode", false},
+			{"ipchairs_udp", "53, 123", true},
+			{"ipchairs_udp", "dns", false},
+		}
+		for _, test := range tests {
+			resetSettings()
+			s := FindSetting(test.setting)
+			before := s.String()
+			if ok := s.Set(test.value, sourceFlag); ok != test.ok {
+				t.Errorf("%s=%q: got %v, want %v", test.setting, test.value, ok, test.ok)
+			}
+			if !test.ok && (s.String() != before || s.source != sourceDefault) {
+				t.Errorf("%s=%q: an invalid value changed the setting", test.setting, test.value)
+			}
+		}
+	})
+}
@@ -0,0 +1,435 @@
+/*
+systemd.go- Reading systemd units. Finds unit files the same way
+systemd does (including overrides in /etc and drop-in folders),
+and works out which binary a unit runs and which config files
+it reads, so services can be protected by unit name alone.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Folders unit files are loaded from, highest priority first
+var unitPaths []string = []string{
+	"/etc/systemd/system",
+	"/run/systemd/system",
+	"/usr/local/lib/systemd/system",
+	"/lib/systemd/system",
+	"/usr/lib/systemd/system",
+}
+
+// Where well known daemons keep their config, by binary name.
+// Only the ones that exist are used.
+var knownConfigs map[string][]string = map[string][]string{
+	"sshd":          {"/etc/ssh/sshd_config"},
+	"vsftpd":        {"/etc/vsftpd.conf", "/etc/vsftpd/vsftpd.conf"},
+	"proftpd":       {"/etc/proftpd/proftpd.conf", "/etc/proftpd.conf"},
+	"httpd":         {"/etc/httpd/conf/httpd.conf"},
+	"apache2":       {"/etc/apache2/apache2.conf"},
+	"apachectl":     {"/etc/apache2/apache2.conf", "/etc/httpd/conf/httpd.conf"},
+	"nginx":         {"/etc/nginx/nginx.conf"},
+	"mysqld":        {"/etc/mysql/my.cnf", "/etc/my.cnf"},
+	"mariadbd":      {"/etc/mysql/my.cnf", "/etc/my.cnf"},
+	"mysqld_safe":   {"/etc/mysql/my.cnf", "/etc/my.cnf"},
+	"postgres":      {"/etc/postgresql/postgresql.conf"},
+	"named":         {"/etc/bind/named.conf", "/etc/named.conf"},
+	"smbd":          {"/etc/samba/smb.conf"},
+	"nmbd":          {"/etc/samba/smb.conf"},
+	"master":        {"/etc/postfix/main.cf"},
+	"dovecot":       {"/etc/dovecot/dovecot.conf"},
+	"redis-server":  {"/etc/redis/redis.conf", "/etc/redis.conf"},
+	"cron":          {"/etc/crontab"},
+	"crond":         {"/etc/crontab"},
+	"rsyslogd":      {"/etc/rsyslog.conf"},
+	"dnsmasq":       {"/etc/dnsmasq.conf"},
+	"squid":         {"/etc/squid/squid.conf"},
+	"slapd":         {"/etc/openldap/slapd.conf", "/etc/ldap/slapd.conf"},
+	"xinetd":        {"/etc/xinetd.conf"},
+	"exim4":         {"/etc/exim4/exim4.conf.template"},
+	"php-fpm":       {"/etc/php-fpm.conf"},
+	"dhcpd":         {"/etc/dhcp/dhcpd.conf"},
+	"ntpd":          {"/etc/ntp.conf"},
+	"chronyd":       {"/etc/chrony.conf", "/etc/chrony/chrony.conf"},
+	"mongod":        {"/etc/mongod.conf"},
+	"haproxy":       {"/etc/haproxy/haproxy.cfg"},
+	"openvpn":       {"/etc/openvpn/server.conf"},
+	"elasticsearch": {"/etc/elasticsearch/elasticsearch.yml"},
+}
+
+// Arguments that are followed by a config file (i.e. nginx -c, httpd -f)
+var configFlags []string = []string{"-c", "-f", "--config", "--conf", "--config-file", "--conf-file", "--defaults-file", "-config"}
+
+// What we know about a service unit
+type Unit struct {
+	Name             string   // i.e. sshd.service
+	Path             string   // The unit file
+	DropIns          []string // Drop-in files that override it, in the order they're applied
+	Binary           string   // What ExecStart runs
+	Args             []string // The rest of ExecStart, with variables from EnvironmentFile filled in
+	EnvironmentFiles []string // EnvironmentFile paths that exist
+}
+
+// Add .service to a unit name if it doesn't have a type
+func UnitName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+// Find the file a unit is loaded from, following aliases. Template
+// instances (getty@tty1) are loaded from their template (getty@).
+// Returns "" if there isn't one, or if the unit is masked.
+func FindUnitFile(name string) string {
+	name = UnitName(name)
+	names := []string{name}
+	if at := strings.Index(name, "@"); at >= 0 {
+		names = append(names, name[:at+1]+filepath.Ext(name))
+	}
+	for _, n := range names {
+		for _, dir := range unitPaths {
+			path := ConcatenatePath(dir, n)
+			if !FileExists(path) {
+				continue
+			}
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil || real == "/dev/null" {
+				return ""
+			}
+			return real
+		}
+	}
+	return ""
+}
+
+// Find the drop-in files for a unit. Drop-ins are applied in order of
+// their names, and one in /etc hides one with the same name further down.
+func FindDropIns(name string) []string {
+	name = UnitName(name)
+	found := map[string]string{}
+	for _, dir := range unitPaths {
+		matches, _ := filepath.Glob(ConcatenatePath(dir, name+".d/*.conf"))
+		for _, path := range matches {
+			base := filepath.Base(path)
+			if _, ok := found[base]; !ok {
+				found[base] = path
+			}
+		}
+	}
+	var bases []string
+	for base := range found {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	var dropIns []string
+	for _, base := range bases {
+		if real, err := filepath.EvalSymlinks(found[base]); err == nil && real != "/dev/null" {
+			dropIns = append(dropIns, real)
+		}
+	}
+	return dropIns
+}
+
+// Read the [Service] section of a unit file into keys, joining lines
+// that end with a backslash. An empty value resets a key, like it
+// does for systemd.
+func readUnitFile(path string, values map[string][]string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	section := ""
+	line := ""
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line += text
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+		} else if section == "[Service]" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, ";") {
+			if split := strings.SplitN(line, "=", 2); len(split) == 2 {
+				key, value := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+				if value == "" {
+					delete(values, key)
+				} else {
+					values[key] = append(values[key], value)
+				}
+			}
+		}
+		line = ""
+	}
+}
+
+// Read the variables set in an EnvironmentFile
+func readEnvironmentFile(path string) map[string]string {
+	env := map[string]string{}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return env
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if split := strings.SplitN(line, "=", 2); len(split) == 2 {
+			env[strings.TrimPrefix(split[0], "export ")] = strings.Trim(split[1], "\"'")
+		}
+	}
+	return env
+}
+
+// Load a service unit, its drop-ins and what it runs. Returns false if
+// the unit doesn't exist.
+func LoadUnit(name string) (*Unit, bool) {
+	unit := &Unit{Name: UnitName(name)}
+	unit.Path = FindUnitFile(unit.Name)
+	if unit.Path == "" {
+		return nil, false
+	}
+	unit.DropIns = FindDropIns(unit.Name)
+	values := map[string][]string{}
+	readUnitFile(unit.Path, values)
+	for _, dropIn := range unit.DropIns {
+		readUnitFile(dropIn, values)
+	}
+	env := map[string]string{}
+	for _, value := range values["EnvironmentFile"] {
+		// A leading - means the file is optional
+		path := strings.TrimPrefix(value, "-")
+		if !FileExists(path) {
+			continue
+		}
+		unit.EnvironmentFiles = append(unit.EnvironmentFiles, path)
+		for k, v := range readEnvironmentFile(path) {
+			env[k] = v
+		}
+	}
+	if len(values["ExecStart"]) == 0 {
+		return unit, true
+	}
+	// Only oneshot units can have more than one ExecStart, and the first is the main one
+	fields := strings.Fields(values["ExecStart"][0])
+	if len(fields) == 0 {
+		return unit, true
+	}
+	// Prefixes change how systemd runs the command, not what it runs
+	binary := strings.TrimLeft(fields[0], "@-:+!")
+	if !strings.HasPrefix(binary, "/") {
+		if path, err := exec.LookPath(binary); err == nil {
+			binary = path
+		}
+	}
+	if real, err := filepath.EvalSymlinks(binary); err == nil {
+		binary = real
+	}
+	unit.Binary = binary
+	// Fill in $VAR and ${VAR} from the environment files, which can hold whole argument lists
+	for _, field := range fields[1:] {
+		expanded := os.Expand(field, func(key string) string { return env[key] })
+		for _, arg := range strings.Fields(expanded) {
+			unit.Args = append(unit.Args, strings.Trim(arg, "\"'"))
+		}
+	}
+	return unit, true
+}
+
+// Get the config files a unit reads: anything passed with a config flag
+// (-f, -c, --config=...), then the well known config for its binary.
+// Only files that exist are returned.
+func (u *Unit) ConfigFiles() []string {
+	var configs []string
+	add := func(path string) {
+		if filepath.IsAbs(path) && FileExists(path) && !IsDir(path) && !contains(configs, path) {
+			configs = append(configs, path)
+		}
+	}
+	for i, arg := range u.Args {
+		for _, flag := range configFlags {
+			if arg == flag && i+1 < len(u.Args) {
+				add(u.Args[i+1])
+			} else if strings.HasPrefix(arg, flag+"=") {
+				add(strings.TrimPrefix(arg, flag+"="))
+			}
+		}
+	}
+	for _, path := range knownConfigs[filepath.Base(u.Binary)] {
+		add(path)
+	}
+	return configs
+}
+
+// Work out the config file for a unit's service, falling back to its
+// EnvironmentFile if it doesn't have one. Also returns everything else
+// that changes how it runs (other configs, environment files and
+// drop-ins). config is "" if nothing was found.
+func (u *Unit) Resolve() (string, []string) {
+	var config string
+	var extras []string
+	for _, path := range append(u.ConfigFiles(), u.EnvironmentFiles...) {
+		if config == "" {
+			config = path
+		} else {
+			extras = append(extras, path)
+		}
+	}
+	return config, append(extras, u.DropIns...)
+}
+
+// List the services that are enabled or running. Falls back to the
+// wants folders if systemctl can't be used (i.e. in a container).
+func ListServices() []string {
+	var units []string
+	add := func(name string) {
+		if strings.HasSuffix(name, ".service") && !contains(units, name) {
+			units = append(units, name)
+		}
+	}
+	running, err1 := exec.Command("systemctl", "list-units", "--type=service", "--state=running", "--no-legend", "--plain").Output()
+	enabled, err2 := exec.Command("systemctl", "list-unit-files", "--type=service", "--state=enabled", "--no-legend").Output()
+	if err1 == nil && err2 == nil {
+		for _, line := range strings.Split(string(running)+string(enabled), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				add(fields[0])
+			}
+		}
+		sort.Strings(units)
+		return units
+	}
+	wants, _ := filepath.Glob("/etc/systemd/system/*.wants/*.service")
+	for _, path := range wants {
+		add(filepath.Base(path))
+	}
+	sort.Strings(units)
+	return units
+}
+
+// Read /etc/os-release (or /usr/lib/os-release)
+func ReadOSRelease() map[string]string {
+	for _, path := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		if FileExists(path) {
+			return readEnvironmentFile(path)
+		}
+	}
+	return map[string]string{}
+}
+
+// Check if a unit is a template (foo@.service) or an instance of one
+// (foo@bar.service). Upkeep restarts a service by its unit file's name,
+// which for these is the template, so they can't be used as services.
+func (u *Unit) IsTemplate() bool {
+	return strings.Contains(u.Name, "@")
+}
+
+// Handle addservice [name] [unit]. Shows what the unit resolves to and
+// asks before protecting it, since the guesses can be wrong.
+func AddUnitCommand(name string, unitName string) {
+	unit, ok := LoadUnit(unitName)
+	if !ok {
+		Errorf("Error: could not find a unit file for %s\n", UnitName(unitName))
+		return
+	}
+	if unit.IsTemplate() {
+		Errorf("Error: %s is a template unit, which upkeep can't restart. Protect its files with addfile instead\n", unit.Name)
+		return
+	}
+	if unit.Binary == "" || !FileExists(unit.Binary) {
+		Errorf("Error: could not find what %s runs\n", unit.Name)
+		return
+	}
+	config, extras := unit.Resolve()
+	if config == "" {
+		// Same as services in the config file without one
+		config = "/dev/nil"
+	}
+	isFreeing.Lock()
+	if CheckName(name) {
+		isFreeing.Unlock()
+		Errorf("Error: %s already exists\n", name)
+		return
+	}
+	// Extra files are protected on their own, unless they already are
+	var files []ServiceObject
+	for _, path := range extras {
+		protected := false
+		for _, file := range master.Files {
+			if file.Path == path {
+				protected = true
+			}
+		}
+		fileName := name + "_" + filepath.Base(path)
+		for i := 2; CheckName(fileName) || indexOfFile(files, fileName) >= 0; i++ {
+			fileName = fmt.Sprintf("%s_%s_%d", name, filepath.Base(path), i)
+		}
+		if !protected {
+			files = append(files, ServiceObject{Name: fileName, Path: path})
+		}
+	}
+	isFreeing.Unlock()
+	fmt.Printf("%s (%s):\n", name, unit.Name)
+	fmt.Printf("Binary: %s\n", unit.Binary)
+	fmt.Printf("Service: %s\n", unit.Path)
+	fmt.Printf("Config: %s\n", config)
+	for _, file := range files {
+		fmt.Printf("Also protecting %s: %s\n", file.Name, file.Path)
+	}
+	Warnf("Add %s? [y/n]: ", name)
+	if GetInput() != "y" {
+		fmt.Printf("Cancelled\n")
+		return
+	}
+	// Don't hold the lock while waiting for an answer, so check again
+	isFreeing.Lock()
+	defer isFreeing.Unlock()
+	if CheckName(name) {
+		Errorf("Error: %s already exists\n", name)
+		return
+	}
+	serv := Service{
+		Name:    name,
+		Binary:  &ServiceObject{Path: unit.Binary},
+		Service: &ServiceObject{Path: unit.Path},
+		Config:  &ServiceObject{Path: config},
+	}
+	if !serv.Init() {
+		Errorf("Error: Couldn't initialize service\n")
+		return
+	}
+	for _, attr := range serviceNames {
+		serv.getAttr(attr).InitBackup()
+	}
+	master.Services = append(master.Services, serv)
+	fmt.Printf("Added %s\n", name)
+	for _, file := range files {
+		if !file.InitSO() {
+			continue
+		}
+		file.InitBackup()
+		master.Files = append(master.Files, file)
+		fmt.Printf("Added %s\n", file.Name)
+	}
+}
+
+// Get the index of a file by name, or -1 if it isn't in files
+func indexOfFile(files []ServiceObject, name string) int {
+	for i, file := range files {
+		if file.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Write a file, making the folders it's in
+func writeTestFile(t *testing.T, path string, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Point unitPaths at an /etc and a /lib folder in a temp folder, which is returned
+func tempUnitPaths(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paths come back with symlinks resolved, so compare against the real one
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := unitPaths
+	unitPaths = []string{filepath.Join(root, "etc"), filepath.Join(root, "lib")}
+	for _, path := range unitPaths {
+		os.MkdirAll(path, 0755)
+	}
+	t.Cleanup(func() {
+		unitPaths = saved
+		os.RemoveAll(dir)
+	})
+	return root
+}
+
+func TestReadUnitFile(t *testing.T) {
+	dir := tempUnitPaths(t)
+	tests := []struct {
+		name     string
+		contents string
+		want     map[string][]string
+	}{
+		{
+			"only the service section",
+			"[Unit]\nDescription=x\n[Service]\nType=simple\nExecStart=/bin/a\n[Install]\nWantedBy=multi-user.target\n",
+			map[string][]string{"Type": {"simple"}, "ExecStart": {"/bin/a"}},
+		},
+		{
+			"comments and spacing",
+			"[Service]\n# ExecStart=/bin/a\n; ExecStart=/bin/b\n  ExecStart = /bin/c -x  \n\nUser=nobody\n",
+			map[string][]string{"ExecStart": {"/bin/c -x"}, "User": {"nobody"}},
+		},
+		{
+			"continuation lines",
+			"[Service]\nExecStart=/bin/a \\\n    -c /etc/a.conf \\\n    --verbose\nUser=nobody\n",
+			map[string][]string{"ExecStart": {"/bin/a  -c /etc/a.conf  --verbose"}, "User": {"nobody"}},
+		},
+		{
+			"repeated keys add up",
+			"[Service]\nEnvironmentFile=/a\nEnvironmentFile=-/b\n",
+			map[string][]string{"EnvironmentFile": {"/a", "-/b"}},
+		},
+		{
+			"an empty value resets a key",
+			"[Service]\nExecStart=/bin/a\nExecStart=\nExecStart=/bin/b\n",
+			map[string][]string{"ExecStart": {"/bin/b"}},
+		},
+		{"missing file", "", map[string][]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "test.service")
+			os.Remove(path)
+			if test.contents != "" {
+				writeTestFile(t, path, test.contents)
+			}
+			values := map[string][]string{}
+			readUnitFile(path, values)
+			if !reflect.DeepEqual(values, test.want) {
+				t.Errorf("got %q, want %q", values, test.want)
+			}
+		})
+	}
+}
+
+func TestFindDropIns(t *testing.T) {
+	dir := tempUnitPaths(t)
+	etc, lib := unitPaths[0], unitPaths[1]
+	writeTestFile(t, filepath.Join(lib, "web.service.d", "10-a.conf"), "")
+	writeTestFile(t, filepath.Join(lib, "web.service.d", "30-c.conf"), "")
+	writeTestFile(t, filepath.Join(lib, "web.service.d", "40-d.conf"), "")
+	writeTestFile(t, filepath.Join(lib, "web.service.d", "notes.txt"), "")
+	writeTestFile(t, filepath.Join(etc, "web.service.d", "20-b.conf"), "")
+	// Same name as one in /lib, so it's used instead
+	writeTestFile(t, filepath.Join(etc, "web.service.d", "30-c.conf"), "")
+	// Masked
+	os.Symlink("/dev/null", filepath.Join(etc, "web.service.d", "40-d.conf"))
+	// Linked in from somewhere else
+	writeTestFile(t, filepath.Join(dir, "shared.conf"), "")
+	os.Symlink(filepath.Join(dir, "shared.conf"), filepath.Join(etc, "web.service.d", "50-e.conf"))
+
+	want := []string{
+		filepath.Join(lib, "web.service.d", "10-a.conf"),
+		filepath.Join(etc, "web.service.d", "20-b.conf"),
+		filepath.Join(etc, "web.service.d", "30-c.conf"),
+		filepath.Join(dir, "shared.conf"),
+	}
+	for _, name := range []string{"web", "web.service"} {
+		if got := FindDropIns(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("FindDropIns(%s) = %q, want %q", name, got, want)
+		}
+	}
+	if got := FindDropIns("other"); len(got) != 0 {
+		t.Errorf("FindDropIns(other) = %q, want none", got)
+	}
+}
+
+func TestLoadUnit(t *testing.T) {
+	dir := tempUnitPaths(t)
+	etc, lib := unitPaths[0], unitPaths[1]
+	daemon := filepath.Join(dir, "bin", "daemon")
+	other := filepath.Join(dir, "bin", "other")
+	writeTestFile(t, daemon, "")
+	writeTestFile(t, other, "")
+	os.Symlink(daemon, filepath.Join(dir, "bin", "link"))
+	envFile := filepath.Join(dir, "default", "daemon")
+	writeTestFile(t, envFile, "# options\nOPTS=\"-c /srv/daemon.conf --fast\"\nexport PORT=8080\n")
+
+	tests := []struct {
+		name    string
+		files   map[string]string // Relative to dir
+		unit    string
+		want    *Unit
+		missing bool
+	}{
+		{
+			"plain",
+			map[string]string{"lib/a.service": "[Service]\nExecStart=" + daemon + " -x -y\n"},
+			"a",
+			&Unit{Name: "a.service", Path: filepath.Join(lib, "a.service"), Binary: daemon, Args: []string{"-x", "-y"}},
+			false,
+		},
+		{"- prefix", map[string]string{"lib/a.service": "[Service]\nExecStart=-" + daemon + "\n"}, "a", &Unit{Binary: daemon}, false},
+		{"@ prefix", map[string]string{"lib/a.service": "[Service]\nExecStart=@" + daemon + " name -x\n"}, "a", &Unit{Binary: daemon, Args: []string{"name", "-x"}}, false},
+		{"! prefix", map[string]string{"lib/a.service": "[Service]\nExecStart=!" + daemon + "\n"}, "a", &Unit{Binary: daemon}, false},
+		{"combined prefixes", map[string]string{"lib/a.service": "[Service]\nExecStart=-!!" + daemon + "\n"}, "a", &Unit{Binary: daemon}, false},
+		{"symlinked binary", map[string]string{"lib/a.service": "[Service]\nExecStart=" + filepath.Join(dir, "bin", "link") + "\n"}, "a", &Unit{Binary: daemon}, false},
+		{
+			"continuation lines",
+			map[string]string{"lib/a.service": "[Service]\nExecStart=" + daemon + " \\\n  -c \"/srv/a.conf\" \\\n  -v\n"},
+			"a",
+			&Unit{Binary: daemon, Args: []string{"-c", "/srv/a.conf", "-v"}},
+			false,
+		},
+		{"first ExecStart is the main one", map[string]string{"lib/a.service": "[Service]\nType=oneshot\nExecStart=" + daemon + "\nExecStart=" + other + "\n"}, "a", &Unit{Binary: daemon}, false},
+		{"no ExecStart", map[string]string{"lib/a.service": "[Service]\nType=oneshot\n"}, "a", &Unit{Path: filepath.Join(lib, "a.service")}, false},
+		{
+			"/etc wins",
+			map[string]string{
+				"lib/a.service": "[Service]\nExecStart=" + daemon + "\n",
+				"etc/a.service": "[Service]\nExecStart=" + other + "\n",
+			},
+			"a.service",
+			&Unit{Path: filepath.Join(etc, "a.service"), Binary: other},
+			false,
+		},
+		{
+			"drop-ins are applied in order",
+			map[string]string{
+				"lib/a.service":             "[Service]\nExecStart=" + daemon + " -a\n",
+				"lib/a.service.d/20-b.conf": "[Service]\nExecStart=\nExecStart=" + other + " -b\n",
+				"etc/a.service.d/10-a.conf": "[Service]\nExecStart=\nExecStart=" + daemon + " -z\n",
+			},
+			"a",
+			&Unit{
+				Path:    filepath.Join(lib, "a.service"),
+				DropIns: []string{filepath.Join(etc, "a.service.d", "10-a.conf"), filepath.Join(lib, "a.service.d", "20-b.conf")},
+				Binary:  other,
+				Args:    []string{"-b"},
+			},
+			false,
+		},
+		{
+			"a drop-in without a reset doesn't replace ExecStart",
+			map[string]string{
+				"lib/a.service":             "[Service]\nExecStart=" + daemon + "\n",
+				"lib/a.service.d/10-a.conf": "[Service]\nExecStart=" + other + "\n",
+			},
+			"a",
+			&Unit{Binary: daemon},
+			false,
+		},
+		{
+			"EnvironmentFile",
+			map[string]string{"lib/a.service": "[Service]\nEnvironmentFile=" + envFile + "\nExecStart=" + daemon + " $OPTS --port=${PORT} $UNSET\n"},
+			"a",
+			&Unit{Binary: daemon, Args: []string{"-c", "/srv/daemon.conf", "--fast", "--port=8080"}, EnvironmentFiles: []string{envFile}},
+			false,
+		},
+		{
+			"optional EnvironmentFile",
+			map[string]string{"lib/a.service": "[Service]\nEnvironmentFile=-" + envFile + "\nEnvironmentFile=-/nonexistent\nExecStart=" + daemon + " $OPTS\n"},
+			"a",
+			&Unit{Binary: daemon, Args: []string{"-c", "/srv/daemon.conf", "--fast"}, EnvironmentFiles: []string{envFile}},
+			false,
+		},
+		{
+			"template instance",
+			map[string]string{"lib/worker@.service": "[Service]\nExecStart=" + daemon + " %i\n"},
+			"worker@1",
+			&Unit{Name: "worker@1.service", Path: filepath.Join(lib, "worker@.service"), Binary: daemon, Args: []string{"%i"}},
+			false,
+		},
+		{"missing", nil, "a", nil, true},
+		{
+			"masked",
+			map[string]string{"lib/a.service": "[Service]\nExecStart=" + daemon + "\n", "etc/a.service": "/dev/null"},
+			"a",
+			nil,
+			true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.RemoveAll(etc)
+			os.RemoveAll(lib)
+			for name, contents := range test.files {
+				path := filepath.Join(dir, name)
+				if contents == "/dev/null" {
+					os.MkdirAll(filepath.Dir(path), 0755)
+					os.Symlink(contents, path)
+				} else {
+					writeTestFile(t, path, contents)
+				}
+			}
+			unit, ok := LoadUnit(test.unit)
+			if ok == test.missing {
+				t.Fatalf("LoadUnit(%s) found = %v, want %v", test.unit, ok, !test.missing)
+			}
+			if test.missing {
+				return
+			}
+			want := *test.want
+			// Only check the name and paths when they're given
+			if want.Name == "" {
+				want.Name = unit.Name
+			}
+			if want.Path == "" {
+				want.Path = unit.Path
+			}
+			if want.DropIns == nil {
+				want.DropIns = unit.DropIns
+			}
+			if !reflect.DeepEqual(*unit, want) {
+				t.Errorf("got %+v, want %+v", *unit, want)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := tempUnitPaths(t)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for _, name := range []string{"a.conf", "b.conf", "c.conf", "env", "env2", "override.conf"} {
+		writeTestFile(t, path(name), "")
+	}
+	os.MkdirAll(path("confdir"), 0755)
+	tests := []struct {
+		name   string
+		unit   Unit
+		config string
+		extras []string
+	}{
+		{"nothing", Unit{Binary: "/bin/daemon"}, "", nil},
+		{"config flag", Unit{Binary: "/bin/daemon", Args: []string{"-f", path("a.conf")}}, path("a.conf"), nil},
+		{
+			"every kind of config flag",
+			Unit{Binary: "/bin/daemon", Args: []string{"--config=" + path("a.conf"), "-c", path("b.conf"), "--defaults-file", path("c.conf"), "-c", path("a.conf")}},
+			path("a.conf"),
+			[]string{path("b.conf"), path("c.conf")},
+		},
+		{
+			"configs that can't be used",
+			Unit{Binary: "/bin/daemon", Args: []string{"-c", "relative.conf", "-c", path("missing.conf"), "-c", path("confdir"), "-c"}},
+			"", nil,
+		},
+		{"environment file", Unit{Binary: "/bin/daemon", EnvironmentFiles: []string{path("env")}}, path("env"), nil},
+		{
+			"config, environment files and drop-ins",
+			Unit{
+				Binary:           "/bin/daemon",
+				Args:             []string{"-c", path("a.conf")},
+				EnvironmentFiles: []string{path("env"), path("env2")},
+				DropIns:          []string{path("override.conf")},
+			},
+			path("a.conf"),
+			[]string{path("env"), path("env2"), path("override.conf")},
+		},
+		{"only drop-ins", Unit{Binary: "/bin/daemon", DropIns: []string{path("override.conf")}}, "", []string{path("override.conf")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, extras := test.unit.Resolve()
+			if config != test.config {
+				t.Errorf("config is %q, want %q", config, test.config)
+			}
+			if len(extras) != 0 || len(test.extras) != 0 {
+				if !reflect.DeepEqual(extras, test.extras) {
+					t.Errorf("extras are %q, want %q", extras, test.extras)
+				}
+			}
+		})
+	}
+}
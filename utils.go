@@ -2,15 +2,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Colors object, to be used for printing colored output
@@ -162,19 +169,62 @@ func encrypt(plaintext, key []byte) []byte {
 	return ciphertext
 }
 
-// Completely remove a service
-func removeService(slice []Service, s int) []Service {
-	// Lock the mutex
-	isFreeing.Lock()
-	defer isFreeing.Unlock()
-	for _, name := range serviceNames {
-		// Remove the backup file
-		slice[s].getAttr(name).FreeBackup()
-		// Set all data to nil to free RAM
-		slice[s].getAttr(name).Backup = nil
-		slice[s].getAttr(name).Path = ""
-		slice[s].getAttr(name).Checksum = ""
+// Decrypt a stream written by encrypt (the IV, then AES-CFB) as it's
+// read, so large files never have to be held in memory
+func DecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return nil, err
 	}
+	return cipher.StreamReader{S: cipher.NewCFBDecrypter(block, iv), R: r}, nil
+}
+
+// Encrypt everything written to w the same way encrypt does (the IV,
+// then AES-CFB), so large files never have to be held in memory
+func EncryptWriter(w io.Writer, key []byte) (io.Writer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(iv); err != nil {
+		return nil, err
+	}
+	return cipher.StreamWriter{S: cipher.NewCFBEncrypter(block, iv), W: w}, nil
+}
+
+// Get the SHA-256 checksum of everything in a reader
+func HashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Format a number of bytes for output
+func FormatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(1024), 0
+	for m := n / 1024; m >= 1024; m /= 1024 {
+		div *= 1024
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Completely remove a service. The caller must hold isFreeing.
+func removeService(slice []Service, s int) []Service {
+	freeService(&slice[s])
 	// Remove from the slice to trigger golang's garbgage detection
 	if s == len(slice) {
 		return slice[:s-1]
@@ -183,17 +233,21 @@ func removeService(slice []Service, s int) []Service {
 	}
 }
 
-// Completely remove a file
+// Free the backups of a service. The caller must hold isFreeing.
+func freeService(service *Service) {
+	for _, name := range serviceNames {
+		// Remove the backup file
+		service.getAttr(name).FreeBackup()
+		// Set all data to nil to free RAM
+		service.getAttr(name).Backup = nil
+		service.getAttr(name).Path = ""
+		service.getAttr(name).Checksum = ""
+	}
+}
+
+// Completely remove a file. The caller must hold isFreeing.
 func removeSO(slice []ServiceObject, s int) []ServiceObject {
-	// Lock the mutex
-	isFreeing.Lock()
-	defer isFreeing.Unlock()
-	// Remove the backup file
-	slice[s].FreeBackup()
-	// Set all data to nil to free RAM
-	slice[s].Backup = nil
-	slice[s].Checksum = ""
-	slice[s].Checksum = ""
+	freeFile(&slice[s])
 	// Remove from the slice to trigger golang's garbgage detection
 	if s == len(slice) {
 		return slice[:s-1]
@@ -202,20 +256,18 @@ func removeSO(slice []ServiceObject, s int) []ServiceObject {
 	}
 }
 
-// Remove a directory
+// Free the backup of a file. The caller must hold isFreeing.
+func freeFile(file *ServiceObject) {
+	// Remove the backup file
+	file.FreeBackup()
+	// Set all data to nil to free RAM
+	file.Backup = nil
+	file.Checksum = ""
+}
+
+// Remove a directory. The caller must hold isFreeing.
 func removeDirectory(slice []Directory, s int) []Directory {
-	isFreeing.Lock()
-	defer isFreeing.Unlock()
-	// First free the backup for each file
-	for i := range slice[s].files {
-		slice[s].files[i].FreeBackup()
-		slice[s].files[i].Backup = nil
-		slice[s].files[i].Checksum = ""
-		slice[s].files[i].Checksum = ""
-		slice[s].files[i] = nil
-	}
-	// then set the files object to nil
-	slice[s].files = nil
+	freeDirectory(&slice[s])
 	if s == len(slice) {
 		return slice[:s-1]
 	} else {
@@ -223,6 +275,22 @@ func removeDirectory(slice []Directory, s int) []Directory {
 	}
 }
 
+// Free the backups of every file in a directory. The caller must hold isFreeing.
+func freeDirectory(dir *Directory) {
+	// First free the backup for each file. This has to be done before
+	// any of them are cleared, since freeing looks through every object.
+	for _, file := range dir.files {
+		file.FreeBackup()
+	}
+	for i := range dir.files {
+		dir.files[i].Backup = nil
+		dir.files[i].Checksum = ""
+		dir.files[i] = nil
+	}
+	// then set the files object to nil
+	dir.files = nil
+}
+
 // Get the service, binary, or config file object from a Service object
 func (e *Service) getAttr(field string) *ServiceObject {
 	return e.locations[find(serviceNames, field)]
@@ -304,7 +372,112 @@ func writeFile(file string, contents []byte) bool {
 	}
 	defer f.Close()
 	_, err = f.Write(contents)
-	return err == nil
+	if err != nil {
+		return false
+	}
+	return f.Sync() == nil
+}
+
+// Write a file without ever leaving it truncated or half-written. The contents
+// go to a temp file in the same folder, which gets the right owner, mode and
+// xattrs, is synced to disk, and is then renamed over the target. If the
+// rename can't be done (i.e. the target is a bind-mounted file), fall back
+// to writing in place.
+func WriteFileAtomic(path string, contents []byte, mode os.FileMode, owner int, group int, attrs map[string][]byte) bool {
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(contents)), nil
+	}
+	return WriteStreamAtomic(path, open, mode, owner, group, attrs)
+}
+
+// Same as WriteFileAtomic, but the contents are copied from a reader.
+// Everything is read into the temp file before the target is touched,
+// so if reading fails (i.e. the backup didn't match its checksum),
+// nothing is replaced.
+func WriteStreamAtomic(path string, open func() (io.ReadCloser, error), mode os.FileMode, owner int, group int, attrs map[string][]byte) bool {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".bandaid-")
+	if err != nil {
+		return false
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	err = copyFrom(tmp, open)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil || !ApplyAttrs(tmpPath, mode, owner, group, attrs) {
+		return false
+	}
+	err = os.Rename(tmpPath, path)
+	if err == nil {
+		// Make sure the rename itself survives a crash
+		if d, err := os.Open(dir); err == nil {
+			d.Sync()
+			d.Close()
+		}
+		return true
+	}
+	// Only write in place if the target can't be renamed over
+	// (a mount point, or on another filesystem)
+	if !errors.Is(err, syscall.EXDEV) && !errors.Is(err, syscall.EBUSY) {
+		return false
+	}
+	return writeInPlace(path, tmpPath, mode, owner, group, attrs)
+}
+
+// Copy a verified temp file over the target without truncating it first,
+// so the target is never left empty. It's only cut to length once
+// everything has been written.
+func writeInPlace(path string, tmpPath string, mode os.FileMode, owner int, group int, attrs map[string][]byte) bool {
+	src, err := os.Open(tmpPath)
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, mode)
+	if err != nil {
+		return false
+	}
+	n, err := io.Copy(f, src)
+	if err == nil {
+		err = f.Truncate(n)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return false
+	}
+	return ApplyAttrs(path, mode, owner, group, attrs)
+}
+
+// Copy everything from a freshly opened reader into w
+func copyFrom(w io.Writer, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Create (or replace) a symlink by making it under a temp name and
+// renaming it into place
+func SymlinkAtomic(target string, path string, owner int, group int) bool {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.bandaid-%d", filepath.Base(path), time.Now().UnixNano()))
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return false
+	}
+	os.Lchown(tmpPath, owner, group)
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return false
+	}
+	return true
 }
 
 func readFile(path string) string {
@@ -313,20 +486,50 @@ func readFile(path string) string {
 	return str
 }
 
+// Check if a path exists. Symlinks count as existing even if they're broken.
 func FileExists(path string) bool {
-	if _, err := os.Stat(path); err == nil {
+	if _, err := os.Lstat(path); err == nil {
 		return true
 	}
 	return false
 }
+
+func IsDir(path string) bool {
+	if stat, err := os.Stat(path); err == nil {
+		return stat.IsDir()
+	}
+	return false
+}
+
+func IsLink(path string) bool {
+	if stat, err := os.Lstat(path); err == nil {
+		return stat.Mode()&os.ModeSymlink != 0
+	}
+	return false
+}
+
 func BackupExists(path string) bool {
 	path = GetConfigName(path)
-	if _, err := os.Stat(path); err == nil {
+	if _, err := os.Lstat(path); err == nil {
 		return true
 	}
 	return false
 }
 
+// Guess whether some content is text by looking for NUL bytes
+func IsText(contents []byte) bool {
+	limit := len(contents)
+	if limit > 8000 {
+		limit = 8000
+	}
+	for _, b := range contents[:limit] {
+		if b == 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func Reverse(s string) string {
 	runes := []rune(s)
 	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
@@ -0,0 +1,362 @@
+/*
+validate.go- Offline checking of the config file. bandaid validate
+parses the config strictly and prints what would be protected,
+skipped or conflicting, without asking for the key, touching the
+backup store or needing root. It exits non-zero if anything is
+wrong, so configs can be checked before they're deployed.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sections of the config file, in the order they're reported
+var configSections []string = []string{"services", "other_files", "directories", "settings"}
+
+// Something protecting a path, used to find conflicts between objects
+type claim struct {
+	label  string
+	policy string
+}
+
+// Describe a json error, with the line and column it happened at
+// if we know it (data is nil if we don't)
+func JSONError(data []byte, err error) string {
+	var offset int64 = -1
+	msg := strings.TrimPrefix(err.Error(), "json: ")
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+		if e.Field != "" {
+			msg = fmt.Sprintf("%s should be %s, not %s", e.Field, e.Type, e.Value)
+		}
+	}
+	if data == nil || offset < 0 || offset > int64(len(data)) {
+		return msg
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d: %s", line, column, msg)
+}
+
+// Decode one object from the config, rejecting any field we don't know
+// about (i.e. a misspelled option that would otherwise be ignored)
+func decodeStrict(raw json.RawMessage, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// Parse a config file strictly. Every object is decoded on its own, so
+// one bad object doesn't hide problems in the rest. Returns the parsed
+// config, errors, and warnings.
+func ParseConfigStrict(configBytes []byte) (Services, []string, []string) {
+	var parsed Services
+	var errors []string
+	var warnings []string
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(configBytes, &sections); err != nil {
+		return parsed, []string{JSONError(configBytes, err)}, nil
+	}
+	for key := range sections {
+		if !contains(configSections, key) {
+			warnings = append(warnings, fmt.Sprintf("Unknown section (%s) is ignored", key))
+		}
+	}
+	for _, section := range configSections {
+		raw, ok := sections[section]
+		if !ok {
+			continue
+		}
+		if section == "settings" {
+			errors = append(errors, CheckSettings(raw)...)
+			continue
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			errors = append(errors, fmt.Sprintf("%s must be a list", section))
+			continue
+		}
+		for i, item := range items {
+			var err error
+			var name string
+			switch section {
+			case "services":
+				var service Service
+				err = decodeStrict(item, &service)
+				name = service.Name
+				parsed.Services = append(parsed.Services, service)
+			case "other_files":
+				var file ServiceObject
+				err = decodeStrict(item, &file)
+				name = file.Name
+				parsed.Files = append(parsed.Files, file)
+			case "directories":
+				var dir Directory
+				err = decodeStrict(item, &dir)
+				name = dir.Name
+				parsed.Directories = append(parsed.Directories, dir)
+			}
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%s[%d] (%s): %s", section, i, name, JSONError(nil, err)))
+			}
+		}
+	}
+	errors = append(errors, CheckConfig(parsed)...)
+	errors = append(errors, CheckOptions(parsed)...)
+	return parsed, errors, warnings
+}
+
+// Check option values that are replaced with a default at startup.
+// Returns every invalid value.
+func CheckOptions(parsed Services) []string {
+	var problems []string
+	checkObject := func(obj *ServiceObject, label string) {
+		if obj == nil {
+			return
+		}
+		if obj.Policy != "" && !contains(policies, obj.Policy) {
+			problems = append(problems, fmt.Sprintf("Invalid policy (%s) for %s", obj.Policy, label))
+		}
+		if obj.Interval < 0 {
+			problems = append(problems, fmt.Sprintf("Invalid interval (%d) for %s", obj.Interval, label))
+		}
+		if obj.Generations < 0 {
+			problems = append(problems, fmt.Sprintf("Invalid generations (%d) for %s", obj.Generations, label))
+		}
+	}
+	for _, service := range parsed.Services {
+		for i, obj := range []*ServiceObject{service.Binary, service.Service, service.Config} {
+			checkObject(obj, service.Name+" "+strings.ToLower(serviceNames[i]))
+		}
+	}
+	for i := range parsed.Files {
+		checkObject(&parsed.Files[i], parsed.Files[i].Name)
+	}
+	for _, dir := range parsed.Directories {
+		checkObject(&ServiceObject{Policy: dir.Policy, Interval: dir.Interval, Generations: dir.Generations}, dir.Name)
+		if dir.NewFiles != "" && !contains(newFilesPolicies, dir.NewFiles) {
+			problems = append(problems, fmt.Sprintf("Invalid new_files policy (%s) for %s", dir.NewFiles, dir.Name))
+		}
+		for _, pattern := range append(dir.Include, dir.Exclude...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid pattern (%s) for %s", pattern, dir.Name))
+			}
+		}
+		if dir.MaxDepth < 0 {
+			problems = append(problems, fmt.Sprintf("Invalid max_depth (%d) for %s", dir.MaxDepth, dir.Name))
+		}
+		if dir.MaxSize < 0 {
+			problems = append(problems, fmt.Sprintf("Invalid max_size (%d) for %s", dir.MaxSize, dir.Name))
+		}
+	}
+	return problems
+}
+
+// Get the policy an object would end up with
+func effectivePolicy(policy string) string {
+	if policy == "" {
+		return policyRestore
+	}
+	return policy
+}
+
+// Count what a directory would protect, the same way AddDir walks it.
+// Returns the number of files, folders, their total size, and how many
+// items were filtered out.
+func (a *Directory) CountScope() (int, int, int64, int) {
+	files, folders, filtered := 0, 0, 0
+	var size int64
+	var walk func(path string)
+	walk = func(path string) {
+		items, _ := ioutil.ReadDir(path)
+		for _, item := range items {
+			subPath := ConcatenatePath(path, item.Name())
+			if !a.InScope(subPath, item) {
+				filtered++
+				continue
+			}
+			if item.IsDir() {
+				folders++
+				walk(subPath)
+			} else {
+				files++
+				size += item.Size()
+			}
+		}
+	}
+	walk(a.Path)
+	return files, folders, size, filtered
+}
+
+// Print what a parsed config would protect. Returns the conflicts
+// between objects that make it invalid.
+func PrintConfigReport(parsed Services) []string {
+	var problems []string
+	claims := map[string][]claim{}
+	var paths []string
+	addClaim := func(path string, label string, policy string) {
+		path = filepath.Clean(path)
+		for _, c := range claims[path] {
+			if c.label == label {
+				return
+			}
+		}
+		if len(claims[path]) == 0 {
+			paths = append(paths, path)
+		}
+		claims[path] = append(claims[path], claim{label, effectivePolicy(policy)})
+	}
+	Warnf("---Services---\n")
+	for _, service := range parsed.Services {
+		members := []*ServiceObject{service.Binary, service.Service, service.Config}
+		status := "protected"
+		for _, obj := range members {
+			if obj == nil || obj.Path == "" {
+				status = "invalid"
+				break
+			}
+			if !FileExists(obj.Path) {
+				status = fmt.Sprintf("skipped (%s doesn't exist)", obj.Path)
+				break
+			}
+		}
+		fmt.Printf("(%s) %s\n", service.Name, status)
+		if status != "protected" {
+			continue
+		}
+		for i, obj := range members {
+			fmt.Printf("%s: %s\n", serviceNames[i], obj.Path)
+			addClaim(obj.Path, service.Name, obj.Policy)
+		}
+	}
+	Warnf("\n---Files---\n")
+	for _, file := range parsed.Files {
+		status := "protected"
+		if file.Path == "" {
+			status = "invalid"
+		} else if !FileExists(file.Path) {
+			status = "skipped (doesn't exist)"
+		} else if IsDir(file.Path) && !IsLink(file.Path) {
+			status = "skipped (folders go under directories)"
+		} else {
+			addClaim(file.Path, file.Name, file.Policy)
+		}
+		fmt.Printf("%s: %s %s\n", file.Name, file.Path, status)
+	}
+	Warnf("\n---Directories---\n")
+	for i := range parsed.Directories {
+		dir := parsed.Directories[i]
+		dir.Path = filepath.Clean(dir.Path)
+		if dir.Path == "." {
+			fmt.Printf("(%s) invalid\n", dir.Name)
+			continue
+		}
+		if !IsDir(dir.Path) {
+			fmt.Printf("(%s) %s skipped (doesn't exist)\n", dir.Name, dir.Path)
+			continue
+		}
+		files, folders, size, filtered := dir.CountScope()
+		fmt.Printf("(%s) %s: %d files and %d folders (%s) protected", dir.Name, dir.Path, files, folders, FormatSize(size))
+		if filtered > 0 {
+			fmt.Printf(", %d filtered out", filtered)
+		}
+		fmt.Println()
+		if filters := dir.Filters(); filters != "" {
+			fmt.Printf("filters: %s\n", filters)
+		}
+		// Anything else that lives in the directory is protected by both
+		for path := range claims {
+			if strings.HasPrefix(path, dir.Path+"/") && dir.InScopeTree(path) {
+				addClaim(path, dir.Name, dir.Policy)
+			}
+		}
+		for j := range parsed.Directories {
+			other := filepath.Clean(parsed.Directories[j].Path)
+			if j != i && strings.HasPrefix(other, dir.Path+"/") && dir.InScopeTree(other) {
+				addClaim(other, dir.Name, dir.Policy)
+				addClaim(other, parsed.Directories[j].Name, parsed.Directories[j].Policy)
+			}
+		}
+	}
+	Warnf("\n---Shared paths---\n")
+	sort.Strings(paths)
+	for _, path := range paths {
+		if len(claims[path]) < 2 {
+			continue
+		}
+		var labels []string
+		conflict := false
+		for _, c := range claims[path] {
+			labels = append(labels, fmt.Sprintf("%s (%s)", c.label, c.policy))
+			if c.policy != claims[path][0].policy {
+				conflict = true
+			}
+		}
+		if conflict {
+			Errorf("%s: %s\n", path, strings.Join(labels, ", "))
+			problems = append(problems, fmt.Sprintf("Conflicting policies for %s", path))
+		} else {
+			fmt.Printf("%s: %s\n", path, strings.Join(labels, ", "))
+		}
+	}
+	return problems
+}
+
+// Validate a config file and print the report. Returns false if it has errors.
+func ValidateConfig(file string) bool {
+	fmt.Printf("Validating %s\n\n", file)
+	configBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		Errorf("Error: could not read %s: %v\n", file, err)
+		return false
+	}
+	parsed, errors, warnings := ParseConfigStrict(configBytes)
+	if len(errors) == 0 || len(parsed.Services)+len(parsed.Files)+len(parsed.Directories) > 0 {
+		errors = append(errors, PrintConfigReport(parsed)...)
+	}
+	if len(warnings) > 0 {
+		Warnf("\n---Warnings---\n")
+		for _, warning := range warnings {
+			Warnf("%s\n", warning)
+		}
+	}
+	if len(errors) > 0 {
+		Errorf("\n---Errors---\n")
+		for _, e := range errors {
+			Errorf("%s\n", e)
+		}
+	}
+	summary := fmt.Sprintf("\n%s: %d errors, %d warnings\n", file, len(errors), len(warnings))
+	if len(errors) > 0 {
+		Errorf("%s", summary)
+		return false
+	}
+	fmt.Print(summary)
+	return true
+}
+
+// Handle the validate subcommand, which checks the config and exits
+// before anything else is set up
+func RunValidate() {
+	file := config.configFile
+	if len(os.Args) > 2 && !strings.HasPrefix(os.Args[2], "-") {
+		file = os.Args[2]
+	}
+	if !ValidateConfig(file) {
+		os.Exit(-1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Start from the default config with every setting registered. HandleArgs
+// stops there for validate.
+func resetSettings() {
+	saved := os.Args
+	os.Args = []string{"bandaid", "validate"}
+	defer func() { os.Args = saved }()
+	HandleArgs()
+}
+
+// Check that exactly the wanted messages turned up, by substring
+func checkMessages(t *testing.T, kind string, got []string, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %d %s %q, want %d %q", len(got), kind, got, len(want), want)
+		return
+	}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if strings.Contains(g, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s %q don't mention %q", kind, got, w)
+		}
+	}
+}
+
+func TestParseConfigStrict(t *testing.T) {
+	resetSettings()
+	tests := []struct {
+		name     string
+		config   string
+		errors   []string
+		warnings []string
+	}{
+		{
+			"valid",
+			`{"services": [{"name": "web", "binary": {"path": "/a"}, "service": {"path": "/b"}, "config": {"path": "/c"}}],
+			"other_files": [{"name": "passwd", "path": "/etc/passwd", "policy": "alert"}],
+			"directories": [{"name": "www", "path": "/var/www", "new_files": "quarantine", "include": ["*.php"]}],
+			"settings": {"interval": 500, "watch": false, "ipchairs_tcp": ["22", "80"]}}`,
+			nil, nil,
+		},
+		{"empty", `{}`, nil, nil},
+		{"syntax error", "{\n\"other_files\": [\n{\"name\": \"a\",}\n]}", []string{"line 3, column"}, nil},
+		{"not a list", `{"other_files": {"name": "a", "path": "/a"}}`, []string{"other_files must be a list"}, nil},
+		{"wrong type", `{"other_files": [{"name": "a", "path": "/a", "interval": "fast"}]}`, []string{"other_files[0] (a): interval should be int"}, nil},
+		{"unknown section", `{"other_file": []}`, nil, []string{"Unknown section (other_file)"}},
+		{
+			"unknown fields",
+			`{"services": [{"name": "web", "binary": {"path": "/a", "polcy": "alert"}, "service": {"path": "/b"}, "config": {"path": "/c"}}],
+			"other_files": [{"name": "a", "path": "/a", "intreval": 5}],
+			"directories": [{"name": "d", "path": "/d", "recursve": false}]}`,
+			[]string{`services[0] (web): unknown field "polcy"`, `other_files[0] (a): unknown field "intreval"`, `directories[0] (d): unknown field "recursve"`},
+			nil,
+		},
+		{
+			"an unknown field doesn't hide the next object",
+			`{"other_files": [{"name": "a", "path": "/a", "bad": 1}, {"name": "a", "path": "/b"}]}`,
+			[]string{`unknown field "bad"`, "Duplicate name (a)"},
+			nil,
+		},
+		{
+			"duplicate names across sections",
+			`{"services": [{"name": "web", "binary": {"path": "/a"}, "service": {"path": "/b"}, "config": {"path": "/c"}}],
+			"other_files": [{"name": "web", "path": "/d"}],
+			"directories": [{"name": "web", "path": "/e"}]}`,
+			[]string{"Duplicate name (web)", "Duplicate name (web)"},
+			nil,
+		},
+		{
+			"missing names and paths",
+			`{"services": [{"name": "web", "binary": {"path": "/a"}, "config": {"path": "/c"}}],
+			"other_files": [{"path": "/a"}, {"name": "b"}]}`,
+			[]string{"Service web has no service path", "File with no name", "File b has no path"},
+			nil,
+		},
+		{
+			"invalid options",
+			`{"other_files": [{"name": "a", "path": "/a", "policy": "ignore", "interval": -1, "generations": -2}],
+			"directories": [{"name": "d", "path": "/d", "new_files": "shred", "include": ["[a-"], "max_depth": -1, "max_size": -1}]}`,
+			[]string{
+				"Invalid policy (ignore) for a", "Invalid interval (-1) for a", "Invalid generations (-2) for a",
+				"Invalid new_files policy (shred) for d", "Invalid pattern ([a-) for d", "Invalid max_depth (-1) for d", "Invalid max_size (-1) for d",
+			},
+			nil,
+		},
+		{
+			"invalid service policy",
+			`{"services": [{"name": "web", "binary": {"path": "/a"}, "service": {"path": "/b"}, "config": {"path": "/c", "policy": "nope"}}]}`,
+			[]string{"Invalid policy (nope) for web config"},
+			nil,
+		},
+		{
+			"bad settings",
+			`{"settings": {"intreval": 500, "interval": 0, "jitter": 101, "watch": "maybe", "ipchairs_tcp": ["22", "http"]}}`,
+			[]string{
+				"Unknown setting (intreval)", "Invalid value for setting interval", "Invalid value for setting jitter",
+				"Invalid value for setting watch", "Invalid value for setting ipchairs_tcp",
+			},
+			nil,
+		},
+		{"settings not an object", `{"settings": [1]}`, []string{"settings must be an object"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, errors, warnings := ParseConfigStrict([]byte(test.config))
+			checkMessages(t, "errors", errors, test.errors)
+			checkMessages(t, "warnings", warnings, test.warnings)
+		})
+	}
+}
+
+func TestPrintConfigReport(t *testing.T) {
+	saved := colors
+	colors = Colors{}
+	defer func() { colors = saved }()
+	dir, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	www := filepath.Join(dir, "www")
+	os.MkdirAll(filepath.Join(www, "uploads"), 0755)
+	for _, path := range []string{"a", "b", "c", "www/index.php", "www/uploads/x.php"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+	file := func(name string, p string, policy string) ServiceObject {
+		return ServiceObject{Name: name, Path: path(p), Policy: policy}
+	}
+	service := func(name string, config string, policy string) Service {
+		return Service{
+			Name:    name,
+			Binary:  &ServiceObject{Path: path("a")},
+			Service: &ServiceObject{Path: path("b")},
+			Config:  &ServiceObject{Path: path(config), Policy: policy},
+		}
+	}
+	tests := []struct {
+		name     string
+		services Services
+		problems []string
+	}{
+		{"nothing shared", Services{Files: []ServiceObject{file("a", "a", ""), file("b", "b", "alert")}}, nil},
+		{
+			"same path, same policy",
+			Services{Files: []ServiceObject{file("a", "a", ""), file("a2", "a", policyRestore)}},
+			nil,
+		},
+		{
+			"same path, different policies",
+			Services{Files: []ServiceObject{file("a", "a", policyAlert), file("a2", "a", policyPerms)}},
+			[]string{"Conflicting policies for " + path("a")},
+		},
+		{
+			"file and service",
+			Services{Services: []Service{service("web", "c", "")}, Files: []ServiceObject{file("c", "c", policyContent)}},
+			[]string{"Conflicting policies for " + path("c")},
+		},
+		{
+			"missing files don't claim anything",
+			Services{Files: []ServiceObject{file("a", "missing", policyAlert), file("a2", "missing", policyPerms)}},
+			nil,
+		},
+		{
+			"file inside a directory",
+			Services{Files: []ServiceObject{file("index", "www/index.php", policyAlert)}, Directories: []Directory{{Name: "www", Path: www}}},
+			[]string{"Conflicting policies for " + path("www/index.php")},
+		},
+		{
+			"file filtered out of a directory",
+			Services{
+				Files:       []ServiceObject{file("x", "www/uploads/x.php", policyAlert)},
+				Directories: []Directory{{Name: "www", Path: www, Exclude: []string{"uploads"}}},
+			},
+			nil,
+		},
+		{
+			"nested directories",
+			Services{Directories: []Directory{{Name: "www", Path: www}, {Name: "uploads", Path: path("www/uploads"), Policy: policyAlert}}},
+			[]string{"Conflicting policies for " + path("www/uploads")},
+		},
+		{
+			"nested directories, same policy",
+			Services{Directories: []Directory{{Name: "www", Path: www, Policy: policyAlert}, {Name: "uploads", Path: path("www/uploads"), Policy: policyAlert}}},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkMessages(t, "problems", PrintConfigReport(test.services), test.problems)
+		})
+	}
+}
+
+// Run validate instead of the tests when TestValidateExitStatus starts
+// the test binary again. It has to happen before the tests start, since
+// they aren't allowed to exit cleanly.
+func TestMain(m *testing.M) {
+	if file := os.Getenv("VALIDATE_TEST_FILE"); file != "" {
+		resetSettings()
+		os.Args = []string{"bandaid", "validate", file}
+		RunValidate()
+	}
+	os.Exit(m.Run())
+}
+
+func TestValidateExitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "target")
+	ioutil.WriteFile(target, []byte("x"), 0644)
+	tests := []struct {
+		name   string
+		config string
+		code   int
+	}{
+		{"valid", `{"other_files": [{"name": "t", "path": "` + target + `"}]}`, 0},
+		{"missing files are only skipped", `{"other_files": [{"name": "t", "path": "` + target + `.gone"}]}`, 0},
+		{"unknown section is a warning", `{"other_file": []}`, 0},
+		{"unknown field", `{"other_files": [{"name": "t", "path": "` + target + `", "polcy": "alert"}]}`, 255},
+		{"duplicate names", `{"other_files": [{"name": "t", "path": "` + target + `"}, {"name": "t", "path": "/x"}]}`, 255},
+		{
+			"conflicting policies",
+			`{"other_files": [{"name": "t", "path": "` + target + `"}, {"name": "t2", "path": "` + target + `", "policy": "alert"}]}`,
+			255,
+		},
+		{"syntax error", `{"other_files": [`, 255},
+		{"no file", "", 255},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, "missing.json")
+			if test.config != "" {
+				file = filepath.Join(dir, strings.Repeat("c", i+1)+".json")
+				if err := ioutil.WriteFile(file, []byte(test.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd := exec.Command(os.Args[0])
+			cmd.Env = append(os.Environ(), "VALIDATE_TEST_FILE="+file)
+			out, err := cmd.CombinedOutput()
+			code := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if code != test.code {
+				t.Errorf("exit status %d, want %d. Output:\n%s", code, test.code, out)
+			}
+		})
+	}
+}
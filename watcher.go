@@ -0,0 +1,322 @@
+/*
+watcher.go- Event-driven tamper detection. Every protected
+path is registered with inotify so that a modification is
+caught (and reverted) immediately instead of on the next
+polling interval.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// Events on a protected file or directory itself
+	watchSelfMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	// Events on the children of a watched directory. These let us
+	// catch a file being replaced by rename, which never touches
+	// the original inode's watch.
+	watchDirMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+	// How long to wait for a burst of events to finish before checking.
+	// Without this we'd catch files half-written (i.e. right after the
+	// truncate of "echo foo > file") and capture the wrong contents.
+	watchSettle = 50 * time.Millisecond
+)
+
+// Global watcher object
+var watcher Watcher
+
+// Signals RunBandaid to do a full sweep right away (i.e. after an inotify queue overflow)
+var sweepNow = make(chan struct{}, 1)
+
+type Watcher struct {
+	fd      int            // The inotify descriptor, owned by file
+	file    *os.File       // Closing it wakes up the event goroutine
+	enabled int32          // Set from the event goroutine as well, so only use it through Enabled
+	lock    sync.Mutex     // Guards everything but enabled
+	paths   map[string]int // Watched path -> watch descriptor
+	wds     map[int]string // Watch descriptor -> watched path
+}
+
+// (Re)initialize the global watcher and start reading events
+func InitWatcher() {
+	// Don't leak the descriptor of the last one
+	watcher.Close()
+	if !config.watch {
+		return
+	}
+	// Non-blocking, so reads go through the runtime poller and return once it's closed
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		Warnf("Could not initialize inotify (%v). Falling back to polling.\n", err)
+		return
+	}
+	file := os.NewFile(uintptr(fd), "inotify")
+	watcher.lock.Lock()
+	watcher.fd = fd
+	watcher.file = file
+	watcher.lock.Unlock()
+	watcher.setEnabled(true)
+	watcher.Sync()
+	go watcher.Start(file)
+}
+
+// Stop watching and close the inotify descriptor
+func (a *Watcher) Close() {
+	a.setEnabled(false)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	a.paths = map[string]int{}
+	a.wds = map[int]string{}
+}
+
+// Returns true if inotify is set up and reading events
+func (a *Watcher) Enabled() bool {
+	return atomic.LoadInt32(&a.enabled) == 1
+}
+
+func (a *Watcher) setEnabled(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&a.enabled, value)
+}
+
+// Returns true if events are being delivered, meaning the
+// polling loop only needs to run as a safety net
+func (a *Watcher) Active() bool {
+	return a.Enabled() && config.watch
+}
+
+// Make the set of watches match the set of protected paths in master.
+// Parent directories of protected files are watched as well so that
+// replacement by rename can be detected.
+func (a *Watcher) Sync() {
+	if !a.Enabled() {
+		return
+	}
+	wanted := map[string]bool{}
+	isFreeing.Lock()
+	ForEachObject(func(obj *ServiceObject, label string) {
+		wanted[obj.Path] = true
+		wanted[filepath.Dir(obj.Path)] = true
+	})
+	isFreeing.Unlock()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for path := range wanted {
+		if _, ok := a.paths[path]; !ok {
+			a.add(path)
+		}
+	}
+	for path, wd := range a.paths {
+		if !wanted[path] {
+			syscall.InotifyRmWatch(a.fd, uint32(wd))
+			delete(a.paths, path)
+			delete(a.wds, wd)
+		}
+	}
+}
+
+// Add (or re-arm) a watch on a path. The caller must hold a.lock.
+func (a *Watcher) add(path string) bool {
+	if path == "" {
+		return false
+	}
+	var mask uint32 = watchSelfMask
+	if IsDir(path) {
+		mask |= watchDirMask
+	}
+	wd, err := syscall.InotifyAddWatch(a.fd, path, mask)
+	if err != nil {
+		// The path may not exist right now (deleted by red team);
+		// the next Sync will pick it up again after it's restored
+		return false
+	}
+	// If the path now points at a new inode, drop the stale descriptor
+	if old, ok := a.paths[path]; ok && old != wd {
+		delete(a.wds, old)
+	}
+	a.paths[path] = wd
+	a.wds[wd] = path
+	return true
+}
+
+// Read inotify events until the descriptor is closed
+func (a *Watcher) Start(file *os.File) {
+	events := make(chan []string, 64)
+	defer close(events)
+	go a.Settle(events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+256))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			// Closed by InitWatcher or Close, which have already taken care of enabled
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			Errorf("\nInotify read failed (%v). Falling back to polling.\n", err)
+			a.lock.Lock()
+			if a.file == file {
+				a.setEnabled(false)
+			}
+			a.lock.Unlock()
+			return
+		}
+		var changed []string
+		overflow := false
+		a.lock.Lock()
+		// Watch descriptors from an old instance mean nothing to the new one
+		if a.file != file {
+			a.lock.Unlock()
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				overflow = true
+				continue
+			}
+			base, ok := a.wds[int(event.Wd)]
+			if !ok {
+				continue
+			}
+			path := base
+			if event.Len > 0 {
+				name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+				path = ConcatenatePath(base, name)
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// The kernel dropped the watch because the inode went away
+				delete(a.wds, int(event.Wd))
+				if a.paths[base] == int(event.Wd) {
+					delete(a.paths, base)
+				}
+			}
+			changed = append(changed, path)
+		}
+		a.lock.Unlock()
+		// Events are still drained while watching is toggled off,
+		// they just aren't acted on
+		if !config.watch {
+			continue
+		}
+		if overflow {
+			Warnf("\nInotify queue overflowed. Running a full sweep...\n")
+			RequestSweep()
+		}
+		events <- changed
+	}
+}
+
+// Ask RunBandaid for a full sweep right away, rather than waiting out its delay
+func RequestSweep() {
+	select {
+	case sweepNow <- struct{}{}:
+	default:
+	}
+}
+
+// Collect the paths from a burst of events so that a series
+// of writes to the same file only triggers a single check
+func (a *Watcher) Settle(events chan []string) {
+	for paths := range events {
+		var changed []string
+		seen := map[string]bool{}
+		collect := func(paths []string) {
+			for _, path := range paths {
+				if !seen[path] {
+					seen[path] = true
+					changed = append(changed, path)
+				}
+			}
+		}
+		collect(paths)
+		timer := time.After(watchSettle)
+	wait:
+		for {
+			select {
+			case more := <-events:
+				collect(more)
+			case <-timer:
+				break wait
+			}
+		}
+		a.HandlePaths(changed)
+	}
+}
+
+// Check (and restore) every protected object affected by an event,
+// then re-arm the watches on those paths since a restore or an
+// attacker's rename may have replaced the inode
+func (a *Watcher) HandlePaths(paths []string) {
+	change := false
+	protected := map[string]bool{}
+	isFreeing.Lock()
+	for _, path := range paths {
+		ForEachObject(func(obj *ServiceObject, label string) {
+			if obj.Path != path {
+				return
+			}
+			protected[path] = true
+			verbose := obj.verbose()
+			if CheckObject(obj, label) && verbose {
+				change = true
+			}
+		})
+		// Anything created inside a protected directory
+		// that isn't part of its snapshot is an intruder
+		if !protected[path] {
+			for i := range master.Directories {
+				dir := &master.Directories[i]
+				if dir.known[filepath.Dir(path)] && dir.HandleNewFile(path) {
+					change = true
+				}
+			}
+		}
+	}
+	isFreeing.Unlock()
+
+	a.lock.Lock()
+	for _, path := range paths {
+		if _, ok := a.paths[path]; ok || protected[path] {
+			a.add(path)
+		}
+	}
+	a.lock.Unlock()
+	// Restored directories need their fanotify marks back too
+	attributor.Sync()
+	if change && config.outputEnabled {
+		caret()
+	}
+}
+
+// Print the current watcher status
+func (a *Watcher) PrintStatus() {
+	if !a.Active() {
+		fmt.Printf("Inotify watching is off. Polling every %d ms.\n", config.delay)
+		return
+	}
+	a.lock.Lock()
+	count := len(a.paths)
+	a.lock.Unlock()
+	fmt.Printf("Watching %d paths. Safety-net sweep every %d ms.\n", count, config.safetyDelay)
+}
@@ -0,0 +1,106 @@
+/*
+workers.go- Worker pool used by RunBandaid to verify
+checksums concurrently. Only the hashing is done in
+parallel; restores and output happen afterwards, in
+order, on the main sweep goroutine.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A single object to verify during a sweep
+type checkJob struct {
+	obj   *ServiceObject
+	label string
+	ok    bool // Result of CheckFile
+}
+
+// Timing information for every check between two full passes
+type SweepStats struct {
+	start   time.Time
+	objects int // Number of checks, so priority files count more than once
+	changes int
+	verify  time.Duration // Time spent hashing
+	restore time.Duration // Time spent handling results (restores, perms, upkeep)
+	total   time.Duration
+	workers int
+}
+
+// Stats for the most recently completed sweep
+var lastSweep SweepStats
+var sweepLock sync.Mutex
+
+// Verify the checksums of all jobs concurrently, with at most
+// config.workers files being hashed at once. Results are stored
+// in each job so they can be handled in their original order.
+func VerifyAll(jobs []*checkJob) int {
+	workers := config.workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	queue := make(chan *checkJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job.ok = job.obj.CheckFile()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	return workers
+}
+
+// Save the stats for a sweep and print them if timing is enabled
+func ReportSweep(stats SweepStats) {
+	sweepLock.Lock()
+	lastSweep = stats
+	sweepLock.Unlock()
+	if config.timing && config.outputEnabled {
+		fmt.Println()
+		PrintSweep(stats)
+		caret()
+	}
+}
+
+// Print the stats for a single sweep
+func PrintSweep(stats SweepStats) {
+	if stats.start.IsZero() {
+		fmt.Println("No sweep has completed yet.")
+		return
+	}
+	fmt.Printf("Sweep at %s: %d checks in %s (verify %s, restore %s) using %d workers, %d changes\n",
+		stats.start.Format("15:04:05"),
+		stats.objects,
+		stats.total.Round(time.Microsecond),
+		stats.verify.Round(time.Microsecond),
+		stats.restore.Round(time.Microsecond),
+		stats.workers,
+		stats.changes,
+	)
+	if stats.total > config.delay*time.Millisecond {
+		Warnf("Sweep took longer than the %d ms interval\n", config.delay)
+	}
+}
+
+// Print the stats for the most recently completed sweep
+func PrintLastSweep() {
+	sweepLock.Lock()
+	stats := lastSweep
+	sweepLock.Unlock()
+	PrintSweep(stats)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyAllMatchesSerial(t *testing.T) {
+	dir := tempBackupFolder(t)
+	config.rehashEvery = 0
+	var paths []string
+	for i := 0; i < 40; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	// Each worker count gets its own objects, since checking updates them
+	newJobs := func() []*checkJob {
+		var jobs []*checkJob
+		for i, path := range paths {
+			obj := &ServiceObject{Name: fmt.Sprintf("f%d", i), Path: path}
+			if !obj.InitSO() {
+				t.Fatalf("couldn't initialize %s", path)
+			}
+			jobs = append(jobs, &checkJob{obj: obj, label: obj.Name})
+		}
+		return jobs
+	}
+	serial := newJobs()
+	parallel := map[int][]*checkJob{}
+	for _, workers := range []int{1, 4, 100} {
+		parallel[workers] = newJobs()
+	}
+	// Change some files after the baseline was taken
+	for i, path := range paths {
+		switch i % 4 {
+		case 1:
+			ioutil.WriteFile(path, []byte("tampered"), 0644)
+		case 2:
+			os.Remove(path)
+		}
+	}
+
+	for _, job := range serial {
+		job.ok = job.obj.CheckFile()
+	}
+	for workers, jobs := range parallel {
+		config.workers = workers
+		used := VerifyAll(jobs)
+		if want := workers; want > len(jobs) {
+			if used != len(jobs) {
+				t.Errorf("%d workers used for %d jobs, want %d", used, len(jobs), len(jobs))
+			}
+		} else if used != want {
+			t.Errorf("%d workers used, want %d", used, want)
+		}
+		for i, job := range jobs {
+			if job.ok != serial[i].ok || job.obj.seen != serial[i].obj.seen {
+				t.Errorf("%d workers: %s is %v (%q), serially %v (%q)",
+					workers, job.label, job.ok, job.obj.seen, serial[i].ok, serial[i].obj.seen)
+			}
+		}
+	}
+	for i, job := range serial {
+		if want := i%4 == 0 || i%4 == 3; job.ok != want {
+			t.Errorf("%s is %v, want %v", job.label, job.ok, want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+xattr.go- Extended attribute handling. This covers POSIX ACLs
+(system.posix_acl_*), file capabilities (security.capability)
+and SELinux labels (security.selinux), which are all stored
+as xattrs and are invisible to a plain mode/owner check.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Get every extended attribute set on a path
+func GetXattrs(path string) map[string][]byte {
+	attrs := map[string][]byte{}
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size <= 0 {
+		return attrs
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return attrs
+	}
+	// The list is a series of NUL terminated names
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		vsize, err = syscall.Getxattr(path, name, value)
+		if err != nil {
+			continue
+		}
+		attrs[name] = value[:vsize]
+	}
+	return attrs
+}
+
+// Attributes managed by a security module. The kernel gives every new
+// file a label, and won't let it be removed, so a baseline taken without
+// one (or where it couldn't be read) can't be enforced.
+var lsmXattrs []string = []string{"security.selinux", "security.SMACK64", "security.apparmor", "security.ima", "security.evm"}
+
+// Check if an extended attribute is managed by a security module
+func isLSMXattr(name string) bool {
+	for _, prefix := range lsmXattrs {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drop the security module attributes from current that the baseline
+// doesn't have, since there's no way to get rid of them
+func IgnoreLSMXattrs(current map[string][]byte, baseline map[string][]byte) map[string][]byte {
+	filtered := map[string][]byte{}
+	for name, value := range current {
+		if _, ok := baseline[name]; ok || !isLSMXattr(name) {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
+
+// Make the extended attributes on a path match the given set,
+// removing any that were added (other than security module labels).
+// Returns false if any couldn't be set.
+func SetXattrs(path string, attrs map[string][]byte) bool {
+	ok := true
+	current := GetXattrs(path)
+	for name := range current {
+		if _, keep := attrs[name]; !keep && !isLSMXattr(name) {
+			if err := syscall.Removexattr(path, name); err != nil {
+				ok = false
+			}
+		}
+	}
+	for name, value := range attrs {
+		if old, exists := current[name]; exists && bytes.Equal(old, value) {
+			continue
+		}
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Check if two sets of extended attributes are identical
+func XattrsEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the names of a set of extended attributes, sorted
+func XattrNames(attrs map[string][]byte) []string {
+	var names []string
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Set the owner, mode and extended attributes of a path. The order
+// matters: chown clears setuid bits and file capabilities, and
+// chmod rewrites the ACL mask, so xattrs have to go last.
+func ApplyAttrs(path string, mode os.FileMode, owner int, group int, attrs map[string][]byte) bool {
+	ok := true
+	if err := os.Chown(path, owner, group); err != nil {
+		ok = false
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ok = false
+	}
+	if attrs != nil && !SetXattrs(path, attrs) {
+		ok = false
+	}
+	return ok
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestIgnoreLSMXattrs(t *testing.T) {
+	label := []byte("system_u:object_r:etc_t:s0")
+	acl := []byte("acl")
+	tests := []struct {
+		name     string
+		current  map[string][]byte
+		baseline map[string][]byte
+		want     map[string][]byte
+	}{
+		{"label the baseline doesn't have", map[string][]byte{"security.selinux": label}, map[string][]byte{}, map[string][]byte{}},
+		{"label the baseline has", map[string][]byte{"security.selinux": label}, map[string][]byte{"security.selinux": []byte("x")}, map[string][]byte{"security.selinux": label}},
+		{"smack labels", map[string][]byte{"security.SMACK64EXEC": label}, nil, map[string][]byte{}},
+		{"other attributes are kept", map[string][]byte{"security.capability": acl, "user.x": acl}, nil, map[string][]byte{"security.capability": acl, "user.x": acl}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IgnoreLSMXattrs(test.current, test.baseline); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f")
+	ioutil.WriteFile(path, nil, 0644)
+	if err := syscall.Setxattr(path, "user.added", []byte("1"), 0); err != nil {
+		t.Skipf("no user xattrs here: %v", err)
+	}
+	// security.selinux may or may not be set (and settable) here, but it's never removed
+	label, hasLabel := GetXattrs(path)["security.selinux"]
+	if !SetXattrs(path, map[string][]byte{"user.kept": []byte("2")}) {
+		t.Fatalf("SetXattrs failed")
+	}
+	want := map[string][]byte{"user.kept": []byte("2")}
+	if hasLabel {
+		want["security.selinux"] = label
+	}
+	if got := GetXattrs(path); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}